@@ -0,0 +1,291 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"math/big"
+	"strings"
+	"sync"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/robert-zaremba/errstack"
+)
+
+// rangeErrors are fragments of errors returned by nodes and providers when
+// the `eth_getLogs` range or result is too big.
+var rangeErrors = []string{
+	"too many results",
+	"returned more than",
+	"response size exceeded",
+	"range is too",
+	"block range",
+	"is limited to",
+	"query timeout",
+}
+
+// IsRangeTooLarge checks if the `eth_getLogs` error is caused by a too big block range
+// or too many results.
+func IsRangeTooLarge(err error) bool {
+	if err == nil {
+		return false
+	}
+	s := strings.ToLower(err.Error())
+	for _, r := range rangeErrors {
+		if strings.Contains(s, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// BackfillOpts configures Backfill.
+type BackfillOpts struct {
+	// ChunkSize is the initial number of blocks fetched in one request. Default 1000.
+	ChunkSize uint64
+	// MaxChunkSize limits the chunk growth. Default 100000.
+	MaxChunkSize uint64
+	// SparseLogs is the number of logs below which a chunk is considered sparse
+	// and the chunk size is doubled. Default 100.
+	SparseLogs int
+	// Concurrency is the number of chunks fetched concurrently. Default 4.
+	Concurrency int
+	// Checkpoints, if set, is used to resume the `Consumer` after the last processed log
+	// and to save its progress. A log is acknowledged when `Next` is called again.
+	Checkpoints CheckpointStore
+	Consumer    string
+}
+
+// LogIterator iterates over logs returned by Backfill.
+type LogIterator struct {
+	logs   chan types.Log
+	cancel context.CancelFunc
+	log    types.Log
+	err    errstack.E
+
+	f      ethereum.LogFilterer
+	query  ethereum.FilterQuery
+	opts   BackfillOpts
+	failed errstack.E // set before the logs channel is closed
+	mu     sync.Mutex
+	size   uint64
+
+	ctx   context.Context // used to save checkpoints
+	acker *logAcker
+}
+
+type chunkResult struct {
+	logs []types.Log
+	err  errstack.E
+}
+
+// Backfill fetches historical logs from the `from`-`to` block range (inclusive) for the
+// given topics and addresses (see SubscribeSimple). The range is split into chunks, which
+// are shrunk when the node rejects a request and grown when they contain few logs.
+// Chunks are fetched concurrently and logs are returned in the chain order.
+// The iterator must be closed when not fully consumed.
+func Backfill(ctx context.Context, f ethereum.LogFilterer,
+	topics [][]common.Hash, addresses []common.Address, from, to uint64, opts BackfillOpts) *LogIterator {
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = 1000
+	}
+	if opts.MaxChunkSize < opts.ChunkSize {
+		opts.MaxChunkSize = 100000
+		if opts.MaxChunkSize < opts.ChunkSize {
+			opts.MaxChunkSize = opts.ChunkSize
+		}
+	}
+	if opts.SparseLogs <= 0 {
+		opts.SparseLogs = 100
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 4
+	}
+	it := &LogIterator{
+		logs:  make(chan types.Log, opts.SparseLogs),
+		f:     f,
+		query: ethereum.FilterQuery{Topics: topics, Addresses: addresses},
+		opts:  opts,
+		size:  opts.ChunkSize,
+		ctx:   ctx,
+		acker: newLogAcker(opts.Checkpoints, opts.Consumer),
+	}
+	ctx, it.cancel = context.WithCancel(ctx)
+	go it.run(ctx, from, to)
+	return it
+}
+
+// Next moves the iterator to the next log. It returns false when there are no more
+// logs or an error occurred. With checkpoints, Next acknowledges the previous log.
+func (it *LogIterator) Next() bool {
+	l, ok := <-it.logs
+	if !ok {
+		it.err = it.failed
+		if it.acker != nil {
+			if err := it.acker.flush(it.ctx); err != nil && it.err == nil {
+				it.err = err
+			}
+		}
+		return false
+	}
+	if it.acker != nil {
+		if err := it.acker.delivered(it.ctx, l); err != nil {
+			it.Close()
+			it.err = err
+			return false
+		}
+	}
+	it.log = l
+	return true
+}
+
+// Log returns the current log.
+func (it *LogIterator) Log() types.Log {
+	return it.log
+}
+
+// Err returns the error which stopped the iteration.
+func (it *LogIterator) Err() errstack.E {
+	return it.err
+}
+
+// Close stops the iteration and releases resources.
+func (it *LogIterator) Close() {
+	it.cancel()
+	for range it.logs {
+	}
+}
+
+func (it *LogIterator) run(ctx context.Context, from, to uint64) {
+	defer close(it.logs)
+	defer it.cancel()
+	var resumed *Checkpoint
+	if it.acker != nil {
+		var err errstack.E
+		if resumed, err = it.acker.load(ctx); err != nil {
+			it.failed = err
+			return
+		}
+		if resumed != nil && resumed.Block > from {
+			from = resumed.Block
+		}
+	}
+	results := make(chan chan chunkResult, it.opts.Concurrency)
+	sem := make(chan struct{}, it.opts.Concurrency)
+	go func() {
+		defer close(results)
+		for next := from; next <= to; {
+			select {
+			case <-ctx.Done():
+				return
+			case sem <- struct{}{}:
+			}
+			end := next + it.chunkSize() - 1
+			if end > to || end < next {
+				end = to
+			}
+			r := make(chan chunkResult, 1)
+			go func(from, to uint64) {
+				logs, err := it.fetch(ctx, from, to)
+				r <- chunkResult{logs, err}
+				<-sem
+			}(next, end)
+			select {
+			case <-ctx.Done():
+				return
+			case results <- r:
+			}
+			if end == to {
+				return
+			}
+			next = end + 1
+		}
+	}()
+	for r := range results {
+		res := <-r
+		if res.err != nil {
+			it.failed = res.err
+			return
+		}
+		for _, l := range res.logs {
+			if resumed != nil && resumed.Covers(l) {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				it.failed = errstack.WrapAsIO(ctx.Err(), "Logs backfill interrupted")
+				return
+			case it.logs <- l:
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		it.failed = errstack.WrapAsIO(ctx.Err(), "Logs backfill interrupted")
+	}
+}
+
+func (it *LogIterator) chunkSize() uint64 {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	return it.size
+}
+
+// adjust updates the chunk size based on a fetched chunk
+func (it *LogIterator) adjust(blocks uint64, logs int, tooLarge bool) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if tooLarge {
+		if s := blocks / 2; s < it.size {
+			it.size = s
+		}
+		if it.size == 0 {
+			it.size = 1
+		}
+	} else if logs < it.opts.SparseLogs && blocks >= it.size {
+		if it.size *= 2; it.size > it.opts.MaxChunkSize {
+			it.size = it.opts.MaxChunkSize
+		}
+	}
+}
+
+// fetch gets logs from the range, splitting it when the node rejects the request
+func (it *LogIterator) fetch(ctx context.Context, from, to uint64) ([]types.Log, errstack.E) {
+	q := it.query
+	q.FromBlock = new(big.Int).SetUint64(from)
+	q.ToBlock = new(big.Int).SetUint64(to)
+	blocks := to - from + 1
+	logs, err := it.f.FilterLogs(ctx, q)
+	if err == nil {
+		it.adjust(blocks, len(logs), false)
+		return logs, nil
+	}
+	if !IsRangeTooLarge(err) || from == to {
+		return nil, errstack.WrapAsIOf(err, "Can't get logs from blocks %d-%d", from, to)
+	}
+	it.adjust(blocks, 0, true)
+	mid := from + blocks/2 - 1
+	left, errE := it.fetch(ctx, from, mid)
+	if errE != nil {
+		return nil, errE
+	}
+	right, errE := it.fetch(ctx, mid+1, to)
+	if errE != nil {
+		return nil, errE
+	}
+	return append(left, right...), nil
+}
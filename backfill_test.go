@@ -0,0 +1,125 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+	. "github.com/robert-zaremba/checkers"
+	. "gopkg.in/check.v1"
+)
+
+// fakeLogFilterer returns one log per every `every` blocks and rejects queries
+// returning more than `limit` logs.
+type fakeLogFilterer struct {
+	every, limit uint64
+	failAt       uint64
+
+	mu       sync.Mutex
+	requests int
+}
+
+func (f *fakeLogFilterer) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	f.mu.Lock()
+	f.requests++
+	f.mu.Unlock()
+	from, to := q.FromBlock.Uint64(), q.ToBlock.Uint64()
+	if f.failAt != 0 && from <= f.failAt && f.failAt <= to {
+		return nil, errors.New("connection refused")
+	}
+	var logs []types.Log
+	for n := from; n <= to; n++ {
+		if n%f.every == 0 {
+			logs = append(logs, types.Log{BlockNumber: n})
+		}
+	}
+	if uint64(len(logs)) > f.limit {
+		return nil, fmt.Errorf("query returned more than %d results", f.limit)
+	}
+	return logs, nil
+}
+
+func (f *fakeLogFilterer) SubscribeFilterLogs(ctx context.Context, q ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	return nil, errors.New("not supported")
+}
+
+type BackfillSuite struct{}
+
+func (s BackfillSuite) collect(c *C, it *LogIterator) []uint64 {
+	var blocks []uint64
+	for it.Next() {
+		blocks = append(blocks, it.Log().BlockNumber)
+	}
+	return blocks
+}
+
+func (s BackfillSuite) TestOrderAndAdaptiveChunks(c *C) {
+	f := &fakeLogFilterer{every: 3, limit: 10}
+	it := Backfill(context.Background(), f, nil, nil, 5, 1000,
+		BackfillOpts{ChunkSize: 100, SparseLogs: 5, Concurrency: 3})
+	blocks := s.collect(c, it)
+	c.Assert(it.Err(), IsNil)
+	c.Assert(blocks, HasLen, 332)
+	for i, b := range blocks {
+		c.Assert(b, Equals, uint64(6+3*i))
+	}
+	c.Check(it.chunkSize() < 100, IsTrue, Comment("chunk size should shrink, got ", it.chunkSize()))
+}
+
+func (s BackfillSuite) TestGrowSparse(c *C) {
+	f := &fakeLogFilterer{every: 1000, limit: 10}
+	it := Backfill(context.Background(), f, nil, nil, 0, 100000,
+		BackfillOpts{ChunkSize: 10, SparseLogs: 5, Concurrency: 1})
+	blocks := s.collect(c, it)
+	c.Assert(it.Err(), IsNil)
+	c.Check(blocks, HasLen, 101)
+	c.Check(f.requests < 100, IsTrue, Comment("chunks should grow, requests: ", f.requests))
+}
+
+func (s BackfillSuite) TestError(c *C) {
+	f := &fakeLogFilterer{every: 10, limit: 100, failAt: 500}
+	it := Backfill(context.Background(), f, nil, nil, 0, 1000,
+		BackfillOpts{ChunkSize: 100, SparseLogs: 1, Concurrency: 2})
+	blocks := s.collect(c, it)
+	c.Check(it.Err(), ErrorMatches, "Can't get logs from blocks 500-599.*")
+	c.Check(blocks, HasLen, 50)
+}
+
+func (s BackfillSuite) TestCancelDuringDelivery(c *C) {
+	f := &fakeLogFilterer{every: 1, limit: 1000}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	it := Backfill(ctx, f, nil, nil, 0, 99,
+		BackfillOpts{ChunkSize: 100, SparseLogs: 1, Concurrency: 1})
+	c.Assert(it.Next(), IsTrue)
+	cancel()
+	blocks := s.collect(c, it)
+	c.Check(it.Err(), ErrorMatches, "Logs backfill interrupted.*")
+	c.Check(len(blocks) < 99, IsTrue, Comment("logs delivered after cancel: ", len(blocks)))
+}
+
+func (s BackfillSuite) TestIsRangeTooLarge(c *C) {
+	c.Check(IsRangeTooLarge(nil), IsFalse)
+	c.Check(IsRangeTooLarge(errors.New("query returned more than 10000 results")), IsTrue)
+	c.Check(IsRangeTooLarge(errors.New("exceed maximum block range: 5000")), IsTrue)
+	c.Check(IsRangeTooLarge(errors.New("Log response size exceeded.")), IsTrue)
+	c.Check(IsRangeTooLarge(errors.New("connection refused")), IsFalse)
+}
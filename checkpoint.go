@@ -0,0 +1,258 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/robert-zaremba/errstack"
+	bat "github.com/robert-zaremba/go-bat"
+	"github.com/robert-zaremba/log15"
+)
+
+// Checkpoint is a position of the last log processed by an event consumer.
+type Checkpoint struct {
+	Block     uint64      `json:"block"`
+	BlockHash common.Hash `json:"blockHash"`
+	LogIndex  uint        `json:"logIndex"`
+}
+
+// NewCheckpoint creates a checkpoint of the given log.
+func NewCheckpoint(l types.Log) Checkpoint {
+	return Checkpoint{l.BlockNumber, l.BlockHash, l.Index}
+}
+
+// Covers checks if the log was already processed according to the checkpoint.
+func (cp Checkpoint) Covers(l types.Log) bool {
+	return l.BlockNumber < cp.Block ||
+		(l.BlockNumber == cp.Block && l.BlockHash == cp.BlockHash && l.Index <= cp.LogIndex)
+}
+
+// CheckpointStore persists checkpoints of event consumers.
+type CheckpointStore interface {
+	// Load returns the consumer checkpoint. `found` is false if there is no checkpoint.
+	Load(ctx context.Context, consumer string) (cp Checkpoint, found bool, err errstack.E)
+	// Save stores the consumer checkpoint.
+	Save(ctx context.Context, consumer string, cp Checkpoint) errstack.E
+}
+
+// logAcker saves checkpoints of logs delivered to a consumer through an unbuffered
+// channel or an iterator. A log is acknowledged when the consumer takes the next one,
+// so the consumer gets at-least-once delivery: after a restart it receives logs
+// starting from the last not acknowledged one.
+type logAcker struct {
+	store    CheckpointStore
+	consumer string
+
+	mu    sync.Mutex
+	last  *types.Log // delivered, not acknowledged log
+	saved *Checkpoint
+}
+
+func newLogAcker(store CheckpointStore, consumer string) *logAcker {
+	if store == nil {
+		return nil
+	}
+	return &logAcker{store: store, consumer: consumer}
+}
+
+// load returns the consumer checkpoint or nil if there is no checkpoint
+func (a *logAcker) load(ctx context.Context) (*Checkpoint, errstack.E) {
+	cp, found, err := a.store.Load(ctx, a.consumer)
+	if err != nil || !found {
+		return nil, err
+	}
+	a.mu.Lock()
+	a.saved = &cp
+	a.mu.Unlock()
+	return &cp, nil
+}
+
+// delivered acknowledges the previously delivered log and remembers `l`. A removed log
+// moves the checkpoint back before its block, if it was already acknowledged.
+func (a *logAcker) delivered(ctx context.Context, l types.Log) errstack.E {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	prev := a.last
+	a.last = nil
+	if prev != nil && (!l.Removed || logBefore(*prev, l)) {
+		if err := a.save(ctx, NewCheckpoint(*prev)); err != nil {
+			return err
+		}
+	}
+	if !l.Removed {
+		a.last = &l
+		return nil
+	}
+	if a.saved != nil && a.saved.Covers(l) {
+		return a.save(ctx, Checkpoint{Block: l.BlockNumber})
+	}
+	return nil
+}
+
+// ack acknowledges the processed log
+func (a *logAcker) ack(ctx context.Context, l types.Log) errstack.E {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.last != nil && a.last.BlockHash == l.BlockHash && a.last.Index == l.Index {
+		a.last = nil
+	}
+	return a.save(ctx, NewCheckpoint(l))
+}
+
+// flush acknowledges the last delivered log
+func (a *logAcker) flush(ctx context.Context) errstack.E {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.last == nil {
+		return nil
+	}
+	l := *a.last
+	a.last = nil
+	return a.save(ctx, NewCheckpoint(l))
+}
+
+// save stores the checkpoint. Must be called with the lock held.
+func (a *logAcker) save(ctx context.Context, cp Checkpoint) errstack.E {
+	if err := a.store.Save(ctx, a.consumer, cp); err != nil {
+		return err
+	}
+	a.saved = &cp
+	return nil
+}
+
+// logBefore checks if the log `a` precedes the log `b` in the chain order
+func logBefore(a, b types.Log) bool {
+	return a.BlockNumber < b.BlockNumber || (a.BlockNumber == b.BlockNumber && a.Index < b.Index)
+}
+
+var reConsumerName = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// FileCheckpointStore is a CheckpointStore which keeps each consumer checkpoint
+// in a separate JSON file in the `Dir` directory.
+type FileCheckpointStore struct {
+	Dir    string
+	logger log15.Logger
+}
+
+// NewFileCheckpointStore creates FileCheckpointStore. The directory must exist.
+func NewFileCheckpointStore(dir string, logger log15.Logger) (FileCheckpointStore, errstack.E) {
+	return FileCheckpointStore{dir, logger}, bat.IsDir(dir)
+}
+
+func (s FileCheckpointStore) filename(consumer string) (string, errstack.E) {
+	if !reConsumerName.MatchString(consumer) {
+		return "", errstack.NewReqF("Invalid consumer name %q", consumer)
+	}
+	return path.Join(s.Dir, consumer+".json"), nil
+}
+
+// Load implements CheckpointStore interface
+func (s FileCheckpointStore) Load(ctx context.Context, consumer string) (cp Checkpoint, found bool, err errstack.E) {
+	fn, err := s.filename(consumer)
+	if err != nil {
+		return
+	}
+	if _, errStd := os.Stat(fn); os.IsNotExist(errStd) {
+		return cp, false, nil
+	}
+	err = bat.DecodeJSONFile(fn, &cp, s.logger)
+	return cp, err == nil, err
+}
+
+// Save implements CheckpointStore interface. The file is replaced atomically.
+func (s FileCheckpointStore) Save(ctx context.Context, consumer string, cp Checkpoint) errstack.E {
+	fn, errE := s.filename(consumer)
+	if errE != nil {
+		return errE
+	}
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return errstack.WrapAsDomain(err, "Can't serialize checkpoint")
+	}
+	tmp := fn + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errstack.WrapAsIOf(err, "Can't write checkpoint file %q", tmp)
+	}
+	return errstack.WrapAsIOf(os.Rename(tmp, fn), "Can't replace checkpoint file %q", fn)
+}
+
+// SQLCheckpointStore is a CheckpointStore using a SQL database table with the following
+// schema (see CreateTable):
+//
+//	consumer     TEXT PRIMARY KEY
+//	block_number BIGINT
+//	block_hash   TEXT
+//	log_index    INTEGER
+//
+// Queries use PostgreSQL placeholders and upsert syntax.
+type SQLCheckpointStore struct {
+	db    *sql.DB
+	table string
+}
+
+// NewSQLCheckpointStore creates SQLCheckpointStore using the `table` table.
+func NewSQLCheckpointStore(db *sql.DB, table string) (SQLCheckpointStore, errstack.E) {
+	if !reConsumerName.MatchString(table) {
+		return SQLCheckpointStore{}, errstack.NewReqF("Invalid table name %q", table)
+	}
+	return SQLCheckpointStore{db, table}, nil
+}
+
+// CreateTable creates the checkpoints table if it doesn't exist.
+func (s SQLCheckpointStore) CreateTable(ctx context.Context) errstack.E {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+s.table+` (
+		consumer TEXT PRIMARY KEY,
+		block_number BIGINT NOT NULL,
+		block_hash TEXT NOT NULL,
+		log_index INTEGER NOT NULL)`)
+	return errstack.WrapAsIOf(err, "Can't create %q table", s.table)
+}
+
+// Load implements CheckpointStore interface
+func (s SQLCheckpointStore) Load(ctx context.Context, consumer string) (cp Checkpoint, found bool, err errstack.E) {
+	var hash PgtHash
+	var block int64
+	var index int64
+	errStd := s.db.QueryRowContext(ctx,
+		`SELECT block_number, block_hash, log_index FROM `+s.table+` WHERE consumer = $1`,
+		consumer).Scan(&block, &hash, &index)
+	if errStd == sql.ErrNoRows {
+		return cp, false, nil
+	}
+	if errStd != nil {
+		return cp, false, errstack.WrapAsIOf(errStd, "Can't load %q checkpoint", consumer)
+	}
+	return Checkpoint{uint64(block), hash.Hash, uint(index)}, true, nil
+}
+
+// Save implements CheckpointStore interface
+func (s SQLCheckpointStore) Save(ctx context.Context, consumer string, cp Checkpoint) errstack.E {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO `+s.table+` (consumer, block_number, block_hash, log_index) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (consumer) DO UPDATE SET block_number = $2, block_hash = $3, log_index = $4`,
+		consumer, int64(cp.Block), PgtHash{cp.BlockHash}, int64(cp.LogIndex))
+	return errstack.WrapAsIOf(err, "Can't save %q checkpoint", consumer)
+}
@@ -0,0 +1,352 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	. "github.com/robert-zaremba/checkers"
+	"github.com/robert-zaremba/errstack"
+	"github.com/robert-zaremba/log15"
+	. "gopkg.in/check.v1"
+)
+
+type CheckpointSuite struct {
+	SubscriptionSuite
+}
+
+func (s *CheckpointSuite) TestCovers(c *C) {
+	h1, h2 := common.HexToHash("0x01"), common.HexToHash("0x02")
+	cp := Checkpoint{Block: 10, BlockHash: h1, LogIndex: 2}
+	c.Check(cp.Covers(types.Log{BlockNumber: 9, BlockHash: h2, Index: 5}), IsTrue)
+	c.Check(cp.Covers(types.Log{BlockNumber: 10, BlockHash: h1, Index: 2}), IsTrue)
+	c.Check(cp.Covers(types.Log{BlockNumber: 10, BlockHash: h1, Index: 3}), IsFalse)
+	c.Check(cp.Covers(types.Log{BlockNumber: 10, BlockHash: h2, Index: 0}), IsFalse,
+		Comment("the checkpoint block was reorganized"))
+	c.Check(cp.Covers(types.Log{BlockNumber: 11, BlockHash: h1, Index: 0}), IsFalse)
+}
+
+func (s *CheckpointSuite) TestFileStore(c *C) {
+	ctx := context.Background()
+	_, err := NewFileCheckpointStore(c.MkDir()+"/missing", log15.Root())
+	c.Check(err, NotNil)
+	st, err := NewFileCheckpointStore(c.MkDir(), log15.Root())
+	c.Assert(err, IsNil)
+
+	_, found, err := st.Load(ctx, "indexer")
+	c.Assert(err, IsNil)
+	c.Check(found, IsFalse)
+	_, _, err = st.Load(ctx, "../indexer")
+	c.Check(err, ErrorMatches, "Invalid consumer name.*")
+
+	cp := Checkpoint{12, common.HexToHash("0xabcd"), 3}
+	c.Assert(st.Save(ctx, "indexer", cp), IsNil)
+	cp.LogIndex = 4
+	c.Assert(st.Save(ctx, "indexer", cp), IsNil)
+	cp2, found, err := st.Load(ctx, "indexer")
+	c.Assert(err, IsNil)
+	c.Check(found, IsTrue)
+	c.Check(cp2, DeepEquals, cp)
+}
+
+func (s *CheckpointSuite) TestPgtHash(c *C) {
+	var h PgtHash
+	c.Assert(h.Scan("0x000000000000000000000000000000000000000000000000000000000000abcd"), IsNil)
+	c.Check(h.Hash, Equals, common.HexToHash("0xabcd"))
+	v, err := h.Value()
+	c.Assert(err, IsNil)
+	c.Check(v, Equals, "0x000000000000000000000000000000000000000000000000000000000000abcd")
+	c.Check(h.Scan([]byte("0xabcd")), ErrorMatches, "Invalid hash")
+	c.Check(h.Scan("xyz"), ErrorMatches, "Invalid hash")
+}
+
+func (s *CheckpointSuite) TestResumeSubscription(c *C) {
+	st, err := NewFileCheckpointStore(c.MkDir(), log15.Root())
+	c.Assert(err, IsNil)
+	opts := SubscriptionOpts{Checkpoints: st, Consumer: "test", MinBackoff: 50 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	rs := NewResilientSubscription(ctx, s.sim, nil, nil, opts, log15.Root())
+	time.Sleep(100 * time.Millisecond)
+
+	s.sendTx(c, 0, logEmitterCode)
+	s.sendTx(c, 1, logEmitterCode)
+	s.sim.Commit()
+	l1 := s.receive(c, rs.Logs())
+	c.Check(l1.Index, Equals, uint(0))
+	c.Assert(rs.Ack(ctx, l1), IsNil)
+	cancel()
+
+	// the consumer is restarted and should receive only the not acknowledged log
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	rs = NewResilientSubscription(ctx, s.sim, nil, nil, opts, log15.Root())
+	l2 := s.receive(c, rs.Logs())
+	c.Check(l2.BlockHash, Equals, l1.BlockHash)
+	c.Check(l2.Index, Equals, uint(1))
+	block, index := rs.Last()
+	c.Check(block, Equals, l1.BlockNumber)
+	c.Check(index, Equals, uint(1))
+}
+
+// fakeSQLDriver is a minimal database/sql driver for the SQLCheckpointStore queries.
+// Rows of all connections are kept in the `rows` map, by consumer.
+type fakeSQLDriver struct {
+	mu    sync.Mutex
+	table bool
+	rows  map[string][]driver.Value
+}
+
+func (d *fakeSQLDriver) Open(name string) (driver.Conn, error) {
+	return fakeSQLConn{d}, nil
+}
+
+type fakeSQLConn struct {
+	d *fakeSQLDriver
+}
+
+func (c fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, driver.ErrSkip
+}
+
+func (c fakeSQLConn) Close() error {
+	return nil
+}
+
+func (c fakeSQLConn) Begin() (driver.Tx, error) {
+	return nil, driver.ErrSkip
+}
+
+func (c fakeSQLConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	d := c.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case strings.HasPrefix(query, "CREATE TABLE IF NOT EXISTS checkpoints "):
+		d.table = true
+	case strings.HasPrefix(query, "INSERT INTO checkpoints ") && strings.Contains(query, "ON CONFLICT (consumer)"):
+		if !d.table {
+			return nil, sql.ErrConnDone
+		}
+		d.rows[args[0].Value.(string)] = []driver.Value{args[1].Value, args[2].Value, args[3].Value}
+	default:
+		return nil, driver.ErrSkip
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c fakeSQLConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	d := c.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !strings.HasPrefix(query, "SELECT block_number, block_hash, log_index FROM checkpoints WHERE consumer = $1") {
+		return nil, driver.ErrSkip
+	}
+	rows := &fakeSQLRows{}
+	if r, ok := d.rows[args[0].Value.(string)]; ok {
+		rows.values = [][]driver.Value{r}
+	}
+	return rows, nil
+}
+
+type fakeSQLRows struct {
+	values [][]driver.Value
+}
+
+func (r *fakeSQLRows) Columns() []string {
+	return []string{"block_number", "block_hash", "log_index"}
+}
+
+func (r *fakeSQLRows) Close() error {
+	return nil
+}
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+var testSQLDriver = &fakeSQLDriver{rows: map[string][]driver.Value{}}
+
+func init() {
+	sql.Register("ethdrv-fake", testSQLDriver)
+}
+
+func (s *CheckpointSuite) TestSQLStore(c *C) {
+	ctx := context.Background()
+	testSQLDriver.mu.Lock()
+	testSQLDriver.table, testSQLDriver.rows = false, map[string][]driver.Value{}
+	testSQLDriver.mu.Unlock()
+	db, errStd := sql.Open("ethdrv-fake", "")
+	c.Assert(errStd, IsNil)
+	defer db.Close()
+	_, err := NewSQLCheckpointStore(db, "checkpoints; DROP TABLE x")
+	c.Check(err, ErrorMatches, "Invalid table name.*")
+	st, err := NewSQLCheckpointStore(db, "checkpoints")
+	c.Assert(err, IsNil)
+	c.Assert(st.CreateTable(ctx), IsNil)
+
+	_, found, err := st.Load(ctx, "indexer")
+	c.Assert(err, IsNil)
+	c.Check(found, IsFalse)
+
+	cp := Checkpoint{12, common.HexToHash("0xabcd"), 3}
+	c.Assert(st.Save(ctx, "indexer", cp), IsNil)
+	cp.Block, cp.LogIndex = 13, 0
+	c.Assert(st.Save(ctx, "indexer", cp), IsNil)
+	cp2, found, err := st.Load(ctx, "indexer")
+	c.Assert(err, IsNil)
+	c.Check(found, IsTrue)
+	c.Check(cp2, DeepEquals, cp)
+	testSQLDriver.mu.Lock()
+	c.Check(testSQLDriver.rows["indexer"][1], Equals, cp.BlockHash.Hex(), Comment("hash is stored as hex"))
+	testSQLDriver.mu.Unlock()
+}
+
+// memCheckpointStore is an in-memory CheckpointStore
+type memCheckpointStore struct {
+	mu  sync.Mutex
+	cps map[string]Checkpoint
+}
+
+func (m *memCheckpointStore) Load(ctx context.Context, consumer string) (Checkpoint, bool, errstack.E) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cp, ok := m.cps[consumer]
+	return cp, ok, nil
+}
+
+func (m *memCheckpointStore) Save(ctx context.Context, consumer string, cp Checkpoint) errstack.E {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cps[consumer] = cp
+	return nil
+}
+
+func (m *memCheckpointStore) get(consumer string) (Checkpoint, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cp, ok := m.cps[consumer]
+	return cp, ok
+}
+
+// wait waits until the consumer checkpoint is `expected`
+func (m *memCheckpointStore) wait(c *C, consumer string, expected Checkpoint) {
+	for i := 0; i < 100; i++ {
+		if cp, _ := m.get(consumer); cp == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cp, _ := m.get(consumer)
+	c.Fatalf("checkpoint %v, expected %v", cp, expected)
+}
+
+func (s *CheckpointSuite) TestLogAcker(c *C) {
+	ctx := context.Background()
+	st := &memCheckpointStore{cps: map[string]Checkpoint{}}
+	a := newLogAcker(st, "c")
+	h := common.HexToHash("0x01")
+	l1 := types.Log{BlockNumber: 1, BlockHash: h, Index: 0}
+	l2 := types.Log{BlockNumber: 2, BlockHash: h, Index: 1}
+	l3 := types.Log{BlockNumber: 3, BlockHash: h, Index: 0}
+
+	c.Assert(a.delivered(ctx, l1), IsNil)
+	_, found := st.get("c")
+	c.Check(found, IsFalse, Comment("log is acknowledged when the next one is delivered"))
+	c.Assert(a.delivered(ctx, l2), IsNil)
+	c.Assert(a.delivered(ctx, l3), IsNil)
+	cp, _ := st.get("c")
+	c.Check(cp, Equals, NewCheckpoint(l2))
+
+	// l3 is reverted before it was acknowledged, l2 is reverted after
+	l3.Removed, l2.Removed = true, true
+	c.Assert(a.delivered(ctx, l3), IsNil)
+	cp, _ = st.get("c")
+	c.Check(cp, Equals, NewCheckpoint(l2))
+	c.Assert(a.delivered(ctx, l2), IsNil)
+	cp, _ = st.get("c")
+	c.Check(cp, Equals, Checkpoint{Block: 2})
+	c.Check(cp.Covers(l1), IsTrue)
+	c.Check(cp.Covers(types.Log{BlockNumber: 2, BlockHash: common.HexToHash("0x02")}), IsFalse)
+}
+
+func (s *CheckpointSuite) TestResumeBackfill(c *C) {
+	st := &memCheckpointStore{cps: map[string]Checkpoint{}}
+	f := &fakeLogFilterer{every: 10, limit: 100}
+	opts := BackfillOpts{ChunkSize: 100, Checkpoints: st, Consumer: "bf"}
+	it := Backfill(context.Background(), f, nil, nil, 0, 99, opts)
+	for i := 0; i < 3; i++ {
+		c.Assert(it.Next(), IsTrue)
+	}
+	c.Check(it.Log().BlockNumber, Equals, uint64(20))
+	it.Close()
+
+	// the third log was not acknowledged
+	it = Backfill(context.Background(), f, nil, nil, 0, 99, opts)
+	var blocks []uint64
+	for it.Next() {
+		blocks = append(blocks, it.Log().BlockNumber)
+	}
+	c.Assert(it.Err(), IsNil)
+	c.Check(blocks, DeepEquals, []uint64{20, 30, 40, 50, 60, 70, 80, 90})
+
+	it = Backfill(context.Background(), f, nil, nil, 0, 99, opts)
+	c.Check(it.Next(), IsFalse)
+	c.Check(it.Err(), IsNil)
+}
+
+func (s *CheckpointSuite) TestResumeLogStream(c *C) {
+	st := &memCheckpointStore{cps: map[string]Checkpoint{}}
+	fc := &fakeChain{}
+	fc.extend(0, 4, 0)
+	opts := LogStreamOpts{Interval: 5 * time.Millisecond, Checkpoints: st, Consumer: "ls"}
+	l1, l2, l3 := fc.log(1, 0), fc.log(2, 0), fc.log(3, 0)
+	var lss LogStreamSuite
+
+	in := make(chan types.Log, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	ls := NewLogStream(ctx, fc, in, opts, log15.Root())
+	in <- l1
+	in <- l2
+	lss.checkEvent(c, lss.receive(c, ls), l1, false)
+	lss.checkEvent(c, lss.receive(c, ls), l2, false)
+	st.wait(c, "ls", NewCheckpoint(l1))
+	cancel()
+
+	// l2 was not acknowledged, so it's delivered again
+	in = make(chan types.Log, 3)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	ls = NewLogStream(ctx, fc, in, opts, log15.Root())
+	in <- l1
+	in <- l2
+	in <- l3
+	lss.checkEvent(c, lss.receive(c, ls), l2, false)
+	lss.checkEvent(c, lss.receive(c, ls), l3, false)
+	st.wait(c, "ls", NewCheckpoint(l2))
+}
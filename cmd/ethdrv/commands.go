@@ -0,0 +1,375 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"os"
+	"os/signal"
+	"strconv"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/robert-zaremba/errstack"
+	"github.com/robert-zaremba/ethdrv"
+	"github.com/robert-zaremba/ethdrv/wad"
+	"github.com/urfave/cli/v2"
+)
+
+var sendFlags = []cli.Flag{
+	&cli.StringFlag{Name: "keystore", Required: true, EnvVars: []string{"ETHDRV_KEYSTORE"},
+		Usage: "keystore directory"},
+	&cli.StringFlag{Name: "from", Required: true, EnvVars: []string{"ETHDRV_FROM"},
+		Usage: "sender account address"},
+	&cli.StringFlag{Name: "passphrase-file", Usage: "file with the account passphrase"},
+	&cli.StringFlag{Name: "passphrase-env", Usage: "environment variable with the account passphrase"},
+	&cli.StringFlag{Name: "value", Usage: "coin amount sent with the transaction, eg 0.1"},
+	&cli.Uint64Flag{Name: "confirmations", Value: 1,
+		Usage: "wait for the receipt with the number of confirmations, 0 to not wait"},
+}
+
+// followOverlap is the number of the latest blocks which logs printed before following
+// may be delivered again by the subscription.
+const followOverlap = 128
+
+// logsRange is the number of the latest blocks scanned for logs when --from is not set
+const logsRange = 10000
+
+var logsFlags = []cli.Flag{
+	&cli.Uint64Flag{Name: "from", DefaultText: fmt.Sprintf("the latest %d blocks", logsRange),
+		Usage: "first block"},
+	&cli.BoolFlag{Name: "follow", Usage: "wait for new events (requires ws or IPC endpoint)"},
+}
+
+// requireArgs checks the minimum number of the positional arguments
+func requireArgs(c *cli.Context, n int) errstack.E {
+	if c.NArg() < n {
+		return errstack.NewReqF("Expected %d arguments: %s", n, c.Command.ArgsUsage)
+	}
+	return nil
+}
+
+// restArgs returns positional arguments starting from the `from` index
+func restArgs(c *cli.Context, from int) []interface{} {
+	var args []interface{}
+	for _, a := range c.Args().Slice()[from:] {
+		args = append(args, a)
+	}
+	return args
+}
+
+func readSchema(c *cli.Context, name string) (ethdrv.Schema, errstack.E) {
+	sf, err := ethdrv.NewSchemaFactory(c.String("contracts"), c.Int("network"), logger)
+	if err != nil {
+		return ethdrv.Schema{}, err
+	}
+	return sf.Read(name)
+}
+
+// node is the node API used by the commands. *ethclient.Client implements it.
+type node interface {
+	bind.ContractBackend
+	ethdrv.ReceiptBackend
+	ChainID(ctx context.Context) (*big.Int, error)
+	BlockNumber(ctx context.Context) (uint64, error)
+	Close()
+}
+
+// dialFunc connects to the node endpoint
+type dialFunc func(ctx context.Context, endpoint string) (node, error)
+
+// commands implements the actions which need a node connection
+type commands struct {
+	dial dialFunc
+}
+
+// dialContract connects to the node and creates the `name` contract client
+func (cmd commands) dialContract(c *cli.Context, name string) (node, *ethdrv.DynamicContract, errstack.E) {
+	s, err := readSchema(c, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, errStd := cmd.dial(c.Context, c.String("rpc"))
+	if errStd != nil {
+		return nil, nil, errstack.WrapAsIOf(errStd, "Can't connect to %q", c.String("rpc"))
+	}
+	network := c.Int("network")
+	if network == 0 {
+		id, errStd := client.ChainID(c.Context)
+		if errStd != nil {
+			client.Close()
+			return nil, nil, errstack.WrapAsIO(errStd, "Can't get chain ID")
+		}
+		network = int(id.Int64())
+	}
+	dc, err := ethdrv.NewDynamicContract(s, network, client)
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return client, dc, nil
+}
+
+func (cmd commands) callAction(c *cli.Context) error {
+	if err := requireArgs(c, 2); err != nil {
+		return err
+	}
+	client, dc, err := cmd.dialContract(c, c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	out, errCall := dc.Call(c.Context, c.Args().Get(1), restArgs(c, 2)...)
+	if errCall != nil {
+		return errCall
+	}
+	return printValues(c, out)
+}
+
+func passphraseProvider(c *cli.Context) ethdrv.PassphraseProvider {
+	if fn := c.String("passphrase-file"); fn != "" {
+		return ethdrv.FilePassphrase{Path: fn, Logger: logger}
+	}
+	if name := c.String("passphrase-env"); name != "" {
+		return ethdrv.EnvPassphrase{Name: name}
+	}
+	return ethdrv.PromptPassphrase{}
+}
+
+func (cmd commands) sendAction(c *cli.Context) error {
+	if err := requireArgs(c, 2); err != nil {
+		return err
+	}
+	from, err := ethdrv.ParseAddress(c.String("from"))
+	if err != nil {
+		return errstack.WrapAsReq(err, "Invalid sender address")
+	}
+	var value *big.Int
+	if v := c.String("value"); v != "" {
+		errb := errstack.NewBuilder()
+		value = wad.AfToNotNegWei(v, errb.Putter("value"))
+		if errb.NotNil() {
+			return errb.ToReqErr()
+		}
+	}
+	client, dc, err := cmd.dialContract(c, c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	chainID, errStd := client.ChainID(c.Context)
+	if errStd != nil {
+		return errstack.WrapAsIO(errStd, "Can't get chain ID")
+	}
+	ks, err := ethdrv.NewKeystoreTxrFactory(c.String("keystore"), passphraseProvider(c), chainID, logger)
+	if err != nil {
+		return err
+	}
+	if err = ks.Use(from); err != nil {
+		return err
+	}
+	if err = ks.Unlock(from, 0); err != nil {
+		return err
+	}
+	defer ks.LockAll()
+	txo := ks.Txo()
+	txo.Context = c.Context
+	txo.Value = value
+	tx, errTx := dc.Transact(txo, c.Args().Get(1), restArgs(c, 2)...)
+	if errTx != nil {
+		return errTx
+	}
+	confirmations := c.Uint64("confirmations")
+	if confirmations == 0 {
+		return printTx(c, tx, nil)
+	}
+	receipt, err := ethdrv.MinedWaiter{Backend: client}.Wait(c.Context, tx.Hash(), confirmations)
+	if receipt == nil && err != nil {
+		return err
+	}
+	if errPrint := printTx(c, tx, receipt); errPrint != nil {
+		return errPrint
+	}
+	return err
+}
+
+// logKey identifies a log in the chain
+type logKey struct {
+	block common.Hash
+	index uint
+}
+
+func (cmd commands) logsAction(c *cli.Context) error {
+	if err := requireArgs(c, 2); err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(c.Context, os.Interrupt)
+	defer stop()
+	client, dc, err := cmd.dialContract(c, c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	eventName := c.Args().Get(1)
+	var query [][]interface{}
+	for _, a := range c.Args().Slice()[2:] {
+		if a == "*" {
+			query = append(query, nil)
+		} else {
+			query = append(query, []interface{}{a})
+		}
+	}
+	topics, errT := dc.Topics(eventName, query...)
+	if errT != nil {
+		return errT
+	}
+	addrs := []common.Address{dc.Address}
+
+	var stream *ethdrv.LogStream
+	var subErr <-chan error
+	if c.Bool("follow") {
+		// subscribe before fetching past events, so no event is missed
+		logs := make(chan types.Log, 16)
+		sub, errStd := client.SubscribeFilterLogs(ctx,
+			ethereum.FilterQuery{Topics: topics, Addresses: addrs}, logs)
+		if errStd != nil {
+			return errstack.WrapAsIO(errStd, "Can't subscribe to events")
+		}
+		defer sub.Unsubscribe()
+		subErr = sub.Err()
+		// new logs are buffered while the past ones are printed, so the subscription
+		// doesn't overflow
+		stream = ethdrv.NewLogStream(ctx, client, ethdrv.BufferLogs(ctx, logs), ethdrv.LogStreamOpts{}, logger)
+	}
+	head, errStd := client.BlockNumber(ctx)
+	if errStd != nil {
+		return errstack.WrapAsIO(errStd, "Can't get the latest block number")
+	}
+	from := c.Uint64("from")
+	if !c.IsSet("from") && head >= logsRange {
+		from = head - logsRange + 1
+	}
+	printed := map[logKey]bool{} // recent logs, which the subscription may deliver again
+	it := ethdrv.Backfill(ctx, client, topics, addrs, from, head, ethdrv.BackfillOpts{})
+	defer it.Close()
+	for it.Next() {
+		l := it.Log()
+		if err := printLog(c, dc, l); err != nil {
+			return err
+		}
+		if stream != nil && l.BlockNumber+followOverlap > head {
+			printed[logKey{l.BlockHash, l.Index}] = true
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	if stream == nil {
+		return nil
+	}
+	for {
+		select {
+		case e, ok := <-stream.Events():
+			if !ok {
+				return nil
+			}
+			k := logKey{e.Log.BlockHash, e.Log.Index}
+			if e.Revert {
+				delete(printed, k)
+				e.Log.Removed = true
+			} else if printed[k] {
+				continue
+			}
+			if err := printLog(c, dc, e.Log); err != nil {
+				return err
+			}
+		case err := <-subErr:
+			return errstack.WrapAsIO(err, "Events subscription failed")
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func addrAction(c *cli.Context) error {
+	if err := requireArgs(c, 1); err != nil {
+		return err
+	}
+	s, err := readSchema(c, c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	if network := c.Int("network"); network != 0 {
+		addr, err := s.Address(network)
+		if err != nil {
+			return err
+		}
+		return printOutput(c, map[string]string{"address": addr.Hex()}, addr.Hex())
+	}
+	addrs := map[string]string{}
+	var text string
+	for _, id := range s.NetworkIDs() {
+		addr, err := s.Address(id)
+		if err != nil {
+			return err
+		}
+		addrs[strconv.Itoa(id)] = addr.Hex()
+		text += fmt.Sprintf("%d\t%s\n", id, addr.Hex())
+	}
+	if len(addrs) == 0 {
+		return errstack.NewReqF("Contract %q is not deployed", s.Name)
+	}
+	return printOutput(c, addrs, text[:len(text)-1])
+}
+
+func wadAction(c *cli.Context) error {
+	if err := requireArgs(c, 1); err != nil {
+		return err
+	}
+	amount := c.Args().Get(0)
+	var wei *big.Int
+	if c.Bool("wei") {
+		var ok bool
+		if wei, ok = new(big.Int).SetString(amount, 10); !ok {
+			return errstack.NewReqF("Invalid wei amount %q", amount)
+		}
+	} else {
+		errb := errstack.NewBuilder()
+		wei = wad.AfToWei(amount, errb.Putter("amount"))
+		if errb.NotNil() {
+			return errb.ToReqErr()
+		}
+	}
+	coin := weiToCoin(wei)
+	return printOutput(c, map[string]string{"wei": wei.String(), "coin": coin},
+		fmt.Sprintf("%s wei\n%s coin", wei, coin))
+}
+
+// weiToCoin formats wei as an exact decimal coin amount
+func weiToCoin(wei *big.Int) string {
+	s := new(big.Rat).SetFrac(wei, big.NewInt(1e18)).FloatString(18)
+	for s[len(s)-1] == '0' {
+		s = s[:len(s)-1]
+	}
+	if s[len(s)-1] == '.' {
+		s = s[:len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command ethdrv calls contracts, sends transactions and tails events using truffle,
+// Hardhat or Foundry artifacts. Run `ethdrv help` for usage.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/robert-zaremba/log15"
+	"github.com/urfave/cli/v2"
+)
+
+var logger = log15.Root()
+
+func main() {
+	app := newApp(dialClient)
+	if err := app.Run(moveFlags(app, os.Args)); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+// dialClient connects to the node using ethclient
+func dialClient(ctx context.Context, endpoint string) (node, error) {
+	client, err := ethclient.DialContext(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// newApp creates the command line application. `dial` connects to the node.
+func newApp(dial dialFunc) *cli.App {
+	cmd := commands{dial}
+	return &cli.App{
+		Name:  "ethdrv",
+		Usage: "interact with smart contracts using truffle, Hardhat or Foundry artifacts",
+		Description: `Method arguments are converted to the ABI types: addresses and bytes are 0x prefixed
+hex strings, integers are decimal or hex strings, amounts with "ether" suffix
+(eg 1.5ether) are converted to wei, arrays and tuples are JSON values.`,
+		Commands: []*cli.Command{
+			{
+				Name:      "call",
+				Usage:     "call a constant contract method",
+				ArgsUsage: "<Contract> <method> [args...]",
+				Flags:     nodeFlags(),
+				Action:    cmd.callAction,
+			},
+			{
+				Name:      "send",
+				Usage:     "send a transaction invoking a contract method",
+				ArgsUsage: "<Contract> <method> [args...]",
+				Flags:     append(nodeFlags(), sendFlags...),
+				Action:    cmd.sendAction,
+			},
+			{
+				Name:      "logs",
+				Usage:     "print contract events",
+				ArgsUsage: "<Contract> <Event> [indexed args...]",
+				Description: `Indexed arguments filter the events, "*" matches any value.
+Past events are fetched in block range chunks, by default from the latest 10000
+blocks. With --follow, events removed by a chain reorganisation are printed again
+with the "(removed)" mark.`,
+				Flags:  append(nodeFlags(), logsFlags...),
+				Action: cmd.logsAction,
+			},
+			{
+				Name:      "addr",
+				Usage:     "print contract address. Addresses on all networks are printed if the network is not set",
+				ArgsUsage: "<Contract>",
+				Flags:     append(schemaFlags(), &cli.IntFlag{Name: "network", Usage: "network ID"}),
+				Action:    addrAction,
+			},
+			{
+				Name:      "wad",
+				Usage:     "convert coin amount to wei, or wei to coin amount with --wei",
+				ArgsUsage: "<amount>",
+				Flags: []cli.Flag{jsonFlag(),
+					&cli.BoolFlag{Name: "wei", Usage: "the amount is in wei"}},
+				Action: wadAction,
+			},
+		},
+	}
+}
+
+// moveFlags moves command flags which follow the positional arguments before them, so
+// `ethdrv logs Token Transfer --follow` works as `ethdrv logs --follow Token Transfer`.
+// urfave/cli stops parsing flags at the first positional argument. Arguments starting
+// with a single dash which are not command flags (eg negative numbers) are kept.
+func moveFlags(app *cli.App, args []string) []string {
+	if len(args) < 3 {
+		return args
+	}
+	cmd := app.Command(args[1])
+	if cmd == nil {
+		return args
+	}
+	var flags, positional []string
+	rest := args[2:]
+	for i := 0; i < len(rest); i++ {
+		a := rest[i]
+		if a == "--" {
+			positional = append(positional, rest[i+1:]...)
+			break
+		}
+		f, hasValue := findFlag(cmd, a)
+		if f == nil && !strings.HasPrefix(a, "--") {
+			positional = append(positional, a)
+			continue
+		}
+		flags = append(flags, a)
+		if _, isBool := f.(*cli.BoolFlag); f != nil && !isBool && !hasValue && i+1 < len(rest) {
+			i++
+			flags = append(flags, rest[i])
+		}
+	}
+	out := append(append([]string{}, args[:2]...), flags...)
+	if len(positional) == 0 {
+		return out
+	}
+	return append(append(out, "--"), positional...)
+}
+
+// findFlag returns the command flag named by the `-name` or `--name[=value]` argument
+func findFlag(cmd *cli.Command, arg string) (f cli.Flag, hasValue bool) {
+	if len(arg) < 2 || arg[0] != '-' {
+		return nil, false
+	}
+	name := strings.TrimLeft(arg, "-")
+	if i := strings.IndexByte(name, '='); i >= 0 {
+		name, hasValue = name[:i], true
+	}
+	for _, f := range append(cmd.Flags, cli.HelpFlag) {
+		for _, n := range f.Names() {
+			if n == name {
+				return f, hasValue
+			}
+		}
+	}
+	return nil, false
+}
+
+func jsonFlag() cli.Flag {
+	return &cli.BoolFlag{Name: "json", Usage: "print output as JSON"}
+}
+
+func schemaFlags() []cli.Flag {
+	return []cli.Flag{jsonFlag(),
+		&cli.StringFlag{Name: "contracts", Value: ".", EnvVars: []string{"ETHDRV_CONTRACTS"},
+			Usage: "contract artifacts directory (truffle build, Hardhat or Foundry project)"},
+	}
+}
+
+func nodeFlags() []cli.Flag {
+	return append(schemaFlags(),
+		&cli.StringFlag{Name: "rpc", Value: "http://localhost:8545", EnvVars: []string{"ETHDRV_RPC"},
+			Usage: "node endpoint: http(s) or ws(s) URL, or IPC socket path"},
+		&cli.IntFlag{Name: "network", EnvVars: []string{"ETHDRV_NETWORK"},
+			Usage: "network ID of the contract deployment, 0 to use the node chain ID"},
+	)
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/big"
+	"path"
+
+	"github.com/ethereum/go-ethereum/common"
+	. "gopkg.in/check.v1"
+)
+
+const tokenSchema = `{
+  "contractName": "Token",
+  "abi": [],
+  "networks": {
+    "1": {"address": "0x0000000000000000000000000000000000000001"},
+    "10": {"address": "0x000000000000000000000000000000000000000a"}
+  }
+}`
+
+type CmdSuite struct {
+	dir string
+}
+
+func (s *CmdSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	c.Assert(ioutil.WriteFile(path.Join(s.dir, "Token.json"), []byte(tokenSchema), 0600), IsNil)
+}
+
+func (s *CmdSuite) run(args ...string) (string, error) {
+	var out bytes.Buffer
+	app := newApp(dialClient)
+	app.Writer = &out
+	err := app.Run(moveFlags(app, append([]string{"ethdrv"}, args...)))
+	return out.String(), err
+}
+
+func (s *CmdSuite) TestAddr(c *C) {
+	out, err := s.run("addr", "--contracts", s.dir, "Token")
+	c.Assert(err, IsNil)
+	c.Check(out, Equals, "1\t0x0000000000000000000000000000000000000001\n"+
+		"10\t0x000000000000000000000000000000000000000A\n")
+	out, err = s.run("addr", "--contracts", s.dir, "--network", "10", "--json", "Token")
+	c.Assert(err, IsNil)
+	c.Check(out, Equals, `{"address":"0x000000000000000000000000000000000000000A"}`+"\n")
+
+	_, err = s.run("addr", "--contracts", s.dir, "--network", "3", "Token")
+	c.Check(err, ErrorMatches, `.*not deployed on network=3`)
+	_, err = s.run("addr", "--contracts", s.dir)
+	c.Check(err, ErrorMatches, `Expected 1 arguments: <Contract>`)
+}
+
+func (s *CmdSuite) TestFlagsAfterArgs(c *C) {
+	out, err := s.run("addr", "Token", "--network", "10", "--contracts="+s.dir, "--json")
+	c.Assert(err, IsNil)
+	c.Check(out, Equals, `{"address":"0x000000000000000000000000000000000000000A"}`+"\n")
+	_, err = s.run("addr", "Token", "--contracts", s.dir, "--bogus")
+	c.Check(err, ErrorMatches, "flag provided but not defined: -bogus")
+
+	app := newApp(dialClient)
+	c.Check(moveFlags(app, []string{"ethdrv", "logs", "Token", "Transfer", "--from", "5", "--follow", "-1"}),
+		DeepEquals, []string{"ethdrv", "logs", "--from", "5", "--follow", "--", "Token", "Transfer", "-1"})
+	c.Check(moveFlags(app, []string{"ethdrv", "call", "--rpc", "ws://x", "Token", "m", "--", "--json"}),
+		DeepEquals, []string{"ethdrv", "call", "--rpc", "ws://x", "--", "Token", "m", "--json"})
+	c.Check(moveFlags(app, []string{"ethdrv", "wad", "--json"}), DeepEquals, []string{"ethdrv", "wad", "--json"})
+}
+
+func (s *CmdSuite) TestWad(c *C) {
+	out, err := s.run("wad", "--json", "1.5")
+	c.Assert(err, IsNil)
+	c.Check(out, Equals, `{"coin":"1.5","wei":"1500000000000000000"}`+"\n")
+	out, err = s.run("wad", "--wei", "10")
+	c.Assert(err, IsNil)
+	c.Check(out, Equals, "10 wei\n0.00000000000000001 coin\n")
+	_, err = s.run("wad", "--wei", "1.5")
+	c.Check(err, ErrorMatches, `Invalid wei amount "1.5"`)
+}
+
+func (s *CmdSuite) TestJSONValue(c *C) {
+	v := struct {
+		To     common.Address `json:"to"`
+		Amount *big.Int       `json:"amount"`
+		ID     [2]byte
+		Data   []byte
+		List   []uint16
+	}{common.HexToAddress("0x01"), big.NewInt(5), [2]byte{1, 2}, []byte{3}, []uint16{7}}
+	c.Check(jsonValue(v), DeepEquals, map[string]interface{}{
+		"to":     "0x0000000000000000000000000000000000000001",
+		"amount": "5",
+		"ID":     "0x0102",
+		"Data":   "0x03",
+		"List":   []interface{}{uint16(7)},
+	})
+	c.Check(textValue(big.NewInt(-3)), Equals, "-3")
+	c.Check(textValue([]*big.Int{big.NewInt(1)}), Equals, `["1"]`)
+}
@@ -0,0 +1,249 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"io/ioutil"
+	"math/big"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	. "gopkg.in/check.v1"
+)
+
+const echoABI = `[
+  {"type": "function", "name": "echo", "stateMutability": "view",
+    "inputs": [{"name": "amount", "type": "uint256"}], "outputs": [{"name": "", "type": "uint256"}]},
+  {"type": "function", "name": "setOwner", "stateMutability": "nonpayable",
+    "inputs": [{"name": "owner", "type": "address"}], "outputs": []},
+  {"type": "event", "name": "Echo", "anonymous": false, "inputs": [
+    {"name": "from", "type": "address", "indexed": true},
+    {"name": "value", "type": "uint256", "indexed": false}]}
+]`
+
+// echoCode is a contract creation code. For any call the contract emits
+// Echo(msg.sender, <first argument>) and returns the first argument.
+func echoCode() []byte {
+	id := crypto.Keccak256([]byte("Echo(address,uint256)"))
+	runtime := "6020600460003733" + "7f" + hex.EncodeToString(id) + "60206000a2" + "60206000f3"
+	code, err := hex.DecodeString("603380600c6000396000f300" + runtime)
+	if err != nil {
+		panic(err)
+	}
+	return code
+}
+
+var simChainID = big.NewInt(1337)
+
+// simNode adapts the simulated backend to the node interface
+type simNode struct {
+	*backends.SimulatedBackend
+}
+
+func (simNode) ChainID(ctx context.Context) (*big.Int, error) {
+	return simChainID, nil
+}
+
+func (n simNode) BlockNumber(ctx context.Context) (uint64, error) {
+	return n.Blockchain().CurrentBlock().NumberU64(), nil
+}
+
+func (simNode) Close() {}
+
+// syncBuffer is a buffer safe for concurrent use
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+type NodeSuite struct {
+	dir, keystore, passFile string
+	key                     *ecdsa.PrivateKey
+	addr, echo              common.Address
+	sim                     *backends.SimulatedBackend
+}
+
+func (s *NodeSuite) SetUpTest(c *C) {
+	var err error
+	s.key, err = crypto.GenerateKey()
+	c.Assert(err, IsNil)
+	s.addr = crypto.PubkeyToAddress(s.key.PublicKey)
+	s.echo = crypto.CreateAddress(s.addr, 0)
+	s.sim = backends.NewSimulatedBackend(core.GenesisAlloc{
+		s.addr: {Balance: new(big.Int).Lsh(big.NewInt(1), 100)},
+	}, 8000000)
+
+	s.dir = c.MkDir()
+	schema := `{"contractName": "Echo", "abi": ` + echoABI + `,
+		"networks": {"1337": {"address": "` + s.echo.Hex() + `"}}}`
+	c.Assert(ioutil.WriteFile(path.Join(s.dir, "Echo.json"), []byte(schema), 0600), IsNil)
+	s.keystore = c.MkDir()
+	ks := keystore.NewKeyStore(s.keystore, keystore.LightScryptN, keystore.LightScryptP)
+	_, err = ks.ImportECDSA(s.key, "secret")
+	c.Assert(err, IsNil)
+	s.passFile = path.Join(c.MkDir(), "passphrase")
+	c.Assert(ioutil.WriteFile(s.passFile, []byte("secret\n"), 0600), IsNil)
+
+	s.sendTx(c, 0, nil, echoCode())
+	s.sim.Commit()
+}
+
+func (s *NodeSuite) TearDownTest(c *C) {
+	s.sim.Close()
+}
+
+// sendTx sends a transaction calling the echo contract, or creating a contract if `to` is nil
+func (s *NodeSuite) sendTx(c *C, nonce uint64, to *common.Address, data []byte) *types.Transaction {
+	gasPrice, err := s.sim.SuggestGasPrice(context.Background())
+	c.Assert(err, IsNil)
+	tx := types.NewTx(&types.LegacyTx{Nonce: nonce, To: to, Gas: 100000, GasPrice: gasPrice, Data: data})
+	tx, err = types.SignTx(tx, types.LatestSignerForChainID(simChainID), s.key)
+	c.Assert(err, IsNil)
+	c.Assert(s.sim.SendTransaction(context.Background(), tx), IsNil)
+	return tx
+}
+
+func (s *NodeSuite) dial(ctx context.Context, endpoint string) (node, error) {
+	return simNode{s.sim}, nil
+}
+
+func (s *NodeSuite) run(ctx context.Context, out *syncBuffer, args ...string) error {
+	app := newApp(s.dial)
+	app.Writer = out
+	return app.RunContext(ctx, moveFlags(app, append([]string{"ethdrv"}, args...)))
+}
+
+func (s *NodeSuite) sendArgs(args ...string) []string {
+	return append([]string{"send", "--contracts", s.dir, "--keystore", s.keystore,
+		"--from", s.addr.Hex(), "--passphrase-file", s.passFile}, args...)
+}
+
+func (s *NodeSuite) TestCall(c *C) {
+	var out syncBuffer
+	err := s.run(context.Background(), &out, "call", "--contracts", s.dir, "Echo", "echo", "1.5ether")
+	c.Assert(err, IsNil)
+	c.Check(out.String(), Equals, "1500000000000000000\n")
+
+	out = syncBuffer{}
+	err = s.run(context.Background(), &out, "call", "--contracts", s.dir, "--json", "Echo", "echo", "0x10")
+	c.Assert(err, IsNil)
+	c.Check(out.String(), Equals, `["16"]`+"\n")
+
+	err = s.run(context.Background(), &out, "call", "--contracts", s.dir, "Echo", "missing")
+	c.Check(err, ErrorMatches, `Contract "Echo" doesn't have "missing" method`)
+	err = s.run(context.Background(), &out, "call", "--contracts", s.dir, "--network", "5", "Echo", "echo", "1")
+	c.Check(err, ErrorMatches, `.*not deployed on network=5`)
+}
+
+func (s *NodeSuite) TestSendAndLogs(c *C) {
+	ctx := context.Background()
+	owner := "0x00000000000000000000000000000000000000aa"
+	var out syncBuffer
+	err := s.run(ctx, &out, s.sendArgs("--confirmations", "0", "Echo", "setOwner", owner)...)
+	c.Assert(err, IsNil)
+	c.Assert(out.String(), Matches, "tx_hash: 0x[0-9a-f]{64}\n")
+	txHash := strings.TrimSpace(strings.TrimPrefix(out.String(), "tx_hash: "))
+	s.sim.Commit()
+
+	// the sender waits for the receipt
+	out = syncBuffer{}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.run(ctx, &out, s.sendArgs("--json", "Echo", "setOwner", "0x00000000000000000000000000000000000000bb")...)
+	}()
+	for mined := false; !mined; {
+		select {
+		case err = <-done:
+			mined = true
+		case <-time.After(10 * time.Millisecond):
+			s.sim.Commit()
+		}
+	}
+	c.Assert(err, IsNil)
+	c.Check(out.String(), Matches, `\{"block":\d+,"gas_used":\d+,"nonce":2,"status":1,"tx_hash":"0x[0-9a-f]{64}"\}`+"\n")
+
+	err = s.run(ctx, &out, s.sendArgs("--keystore", c.MkDir(), "Echo", "setOwner", owner)...)
+	c.Check(err, ErrorMatches, ".*not found in keystore")
+
+	out = syncBuffer{}
+	err = s.run(ctx, &out, "logs", "--contracts", s.dir, "Echo", "Echo", s.addr.Hex())
+	c.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	c.Assert(lines, HasLen, 2)
+	c.Check(lines[0], Equals, "2 "+txHash+" 0 Echo from="+s.addr.Hex()+" value=170")
+	c.Check(lines[1], Matches, `\d+ 0x[0-9a-f]{64} 0 Echo from=`+s.addr.Hex()+" value=187")
+
+	out = syncBuffer{}
+	err = s.run(ctx, &out, "logs", "--contracts", s.dir, "--from", "3", "Echo", "Echo", owner)
+	c.Assert(err, IsNil)
+	c.Check(out.String(), Equals, "")
+}
+
+func (s *NodeSuite) TestLogsFollow(c *C) {
+	data := make([]byte, 36)
+	data[35] = 1
+	tx1 := s.sendTx(c, 1, &s.echo, data)
+	s.sim.Commit()
+
+	var out syncBuffer
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		// the usage from the README: flags follow the arguments
+		done <- s.run(ctx, &out, "logs", "Echo", "Echo", "*", "--contracts", s.dir, "--from", "2", "--follow")
+	}()
+	wait := func(lines int) {
+		for i := 0; i < 500 && strings.Count(out.String(), "\n") < lines; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Assert(strings.Count(out.String(), "\n"), Equals, lines, Commentf("output: %s", out.String()))
+	}
+	wait(1)
+
+	data[35] = 2
+	tx2 := s.sendTx(c, 2, &s.echo, data)
+	s.sim.Commit()
+	wait(2)
+	cancel()
+	c.Assert(<-done, IsNil)
+	c.Check(out.String(), Equals,
+		"2 "+tx1.Hash().Hex()+" 0 Echo from="+s.addr.Hex()+" value=1\n"+
+			"3 "+tx2.Hash().Hex()+" 0 Echo from="+s.addr.Hex()+" value=2\n")
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/robert-zaremba/errstack"
+	"github.com/robert-zaremba/ethdrv"
+	"github.com/urfave/cli/v2"
+)
+
+// printOutput prints `v` as JSON if the --json flag is set, otherwise prints the text.
+func printOutput(c *cli.Context, v interface{}, text string) error {
+	if !c.Bool("json") {
+		_, err := fmt.Fprintln(c.App.Writer, text)
+		return err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return errstack.WrapAsDomain(err, "Can't serialize output")
+	}
+	_, err = fmt.Fprintln(c.App.Writer, string(b))
+	return err
+}
+
+// printValues prints method outputs, one per line
+func printValues(c *cli.Context, vals []interface{}) error {
+	out := make([]interface{}, len(vals))
+	lines := make([]string, len(vals))
+	for i, v := range vals {
+		out[i] = jsonValue(v)
+		lines[i] = textValue(v)
+	}
+	return printOutput(c, out, strings.Join(lines, "\n"))
+}
+
+func printTx(c *cli.Context, tx *types.Transaction, r *types.Receipt) error {
+	out := map[string]interface{}{"tx_hash": tx.Hash().Hex(), "nonce": tx.Nonce()}
+	text := "tx_hash: " + tx.Hash().Hex()
+	if r != nil {
+		out["block"] = r.BlockNumber.Uint64()
+		out["status"] = r.Status
+		out["gas_used"] = r.GasUsed
+		text += fmt.Sprintf("\nblock: %d\nstatus: %d\ngas_used: %d", r.BlockNumber, r.Status, r.GasUsed)
+	}
+	return printOutput(c, out, text)
+}
+
+// printLog decodes and prints the contract event log
+func printLog(c *cli.Context, dc *ethdrv.DynamicContract, l types.Log) error {
+	ev, err := dc.Decode(l)
+	if err != nil {
+		return errstack.WrapAsDomain(err, "Can't decode the event log")
+	}
+	return printEvent(c, ev)
+}
+
+func printEvent(c *cli.Context, ev ethdrv.DynamicEvent) error {
+	args := map[string]interface{}{}
+	names := make([]string, 0, len(ev.Args))
+	for k, v := range ev.Args {
+		args[k] = jsonValue(v)
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	text := fmt.Sprintf("%d %s %d %s", ev.Raw.BlockNumber, ev.Raw.TxHash.Hex(), ev.Raw.Index, ev.Name)
+	for _, k := range names {
+		text += " " + k + "=" + textValue(ev.Args[k])
+	}
+	if ev.Raw.Removed {
+		text += " (removed)"
+	}
+	return printOutput(c, map[string]interface{}{
+		"event":     ev.Name,
+		"block":     ev.Raw.BlockNumber,
+		"tx_hash":   ev.Raw.TxHash.Hex(),
+		"log_index": ev.Raw.Index,
+		"removed":   ev.Raw.Removed,
+		"args":      args,
+	}, text)
+}
+
+// jsonValue converts ABI values to JSON friendly values: big integers are decimal
+// strings, bytes are hex strings and tuples are objects.
+func jsonValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case *big.Int:
+		return x.String()
+	case common.Address:
+		return x.Hex()
+	case common.Hash:
+		return x.Hex()
+	case []byte:
+		return hexutil.Encode(x)
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Array:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, rv.Len())
+			reflect.Copy(reflect.ValueOf(b), rv)
+			return hexutil.Encode(b)
+		}
+		fallthrough
+	case reflect.Slice:
+		out := make([]interface{}, rv.Len())
+		for i := range out {
+			out[i] = jsonValue(rv.Index(i).Interface())
+		}
+		return out
+	case reflect.Struct:
+		out := map[string]interface{}{}
+		for i := 0; i < rv.NumField(); i++ {
+			f := rv.Type().Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "" {
+				name = f.Name
+			}
+			out[name] = jsonValue(rv.Field(i).Interface())
+		}
+		return out
+	}
+	return v
+}
+
+// textValue formats ABI value for the text output
+func textValue(v interface{}) string {
+	jv := jsonValue(v)
+	if s, ok := jv.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(jv)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/robert-zaremba/errstack"
+	"golang.org/x/sync/singleflight"
+)
+
+// addressCache is a concurrent-safe cache of contract addresses read from schema files.
+// Concurrent reads of the same schema are done once.
+type addressCache struct {
+	sf      SchemaFactory
+	group   singleflight.Group
+	mu      sync.RWMutex
+	gen     uint64 // incremented on invalidation, so stale reads are not cached
+	entries map[string]addressEntry
+}
+
+type addressEntry struct {
+	addr  common.Address
+	files []fileState // schema files the address was read from
+}
+
+// fileState is the state of a schema file, used to detect changes
+type fileState struct {
+	name    string
+	modTime time.Time
+	size    int64
+}
+
+// changed checks if the file was modified or removed
+func (st fileState) changed() bool {
+	info, err := os.Stat(st.name)
+	return err != nil || !info.ModTime().Equal(st.modTime) || info.Size() != st.size
+}
+
+func newAddressCache(sf SchemaFactory) *addressCache {
+	return &addressCache{sf: sf, entries: map[string]addressEntry{}}
+}
+
+func (ac *addressCache) get(name string) (common.Address, errstack.E) {
+	ac.mu.RLock()
+	e, ok := ac.entries[name]
+	gen := ac.gen
+	ac.mu.RUnlock()
+	if ok {
+		return e.addr, nil
+	}
+	v, err, _ := ac.group.Do(name+"@"+strconv.FormatUint(gen, 10), func() (interface{}, error) {
+		e, err := ac.load(name, gen)
+		if err != nil {
+			return e, err
+		}
+		return e, nil
+	})
+	if err != nil {
+		return common.Address{}, err.(errstack.E)
+	}
+	return v.(addressEntry).addr, nil
+}
+
+func (ac *addressCache) load(name string, gen uint64) (e addressEntry, err errstack.E) {
+	var s Schema
+	if s, e.files, err = ac.sf.read(name); err != nil {
+		return e, err
+	}
+	if e.addr, err = s.Address(ac.sf.Network); err != nil {
+		return e, err
+	}
+	ac.mu.Lock()
+	if ac.gen == gen {
+		ac.entries[name] = e
+	}
+	ac.mu.Unlock()
+	return e, nil
+}
+
+// invalidate drops the cached address. The artifacts index is rebuilt too, because
+// a new artifact may be the reason of the invalidation.
+func (ac *addressCache) invalidate(name string) {
+	ac.mu.Lock()
+	delete(ac.entries, name)
+	ac.gen++
+	ac.mu.Unlock()
+	ac.sf.Reload()
+}
+
+func (ac *addressCache) invalidateAll() {
+	ac.mu.Lock()
+	ac.entries = map[string]addressEntry{}
+	ac.gen++
+	ac.mu.Unlock()
+	ac.sf.Reload()
+}
+
+// changed returns names of the cached contracts which schema files were modified
+func (ac *addressCache) changed() []string {
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+	var names []string
+	for name, e := range ac.entries {
+		for _, st := range e.files {
+			if st.changed() {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// watch polls the schema files of the cached contracts and calls `onChange` for the modified
+// ones until the context is done.
+func (ac *addressCache) watch(ctx context.Context, interval time.Duration, onChange func(name string)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			for _, name := range ac.changed() {
+				ac.sf.logger.Info("Contract schema file changed", "contract", name)
+				onChange(name)
+			}
+		}
+	}
+}
@@ -16,17 +16,36 @@
 package ethdrv
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
+	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/robert-zaremba/errstack"
 	"github.com/robert-zaremba/go-bat"
 	"github.com/robert-zaremba/log15"
 )
 
-// Schema is a type representing truffle-schema contract file
+// Schema is a type representing truffle-schema contract file. It's also used to
+// represent Hardhat and Foundry artifacts (see SchemaFactory.Read).
 type Schema struct {
-	Name          string `json:"contractName"`
+	Name              string          `json:"contractName"`
+	ABI               json.RawMessage // JSON ABI, parsed on demand (see ParsedABI)
+	Bytecode          string          // hex encoded, may contain library placeholders
+	DeployedBytecode  string
+	SourceMap         string
+	DeployedSourceMap string
+	// Immutables are locations of immutable variables in the deployed bytecode.
+	// They are only provided by Foundry artifacts.
+	Immutables    []CodeRange
 	Networks      map[int]NetSchema
 	SchemaVersion string `json:"schemaVersion"`
 	UpdatedAt     string `json:"updatedAt"`
@@ -34,8 +53,96 @@ type Schema struct {
 
 // NetSchema is a type representing truffle-schema network description
 type NetSchema struct {
-	Address   string
-	UpdatedAt int `json:"updated_at"`
+	Address         string            `json:"address"`
+	TransactionHash string            `json:"transactionHash,omitempty"`
+	Links           map[string]string `json:"links,omitempty"`
+	UpdatedAt       int               `json:"updated_at,omitempty"`
+}
+
+// schemaJSON is the union of truffle, Hardhat and Foundry artifact formats
+type schemaJSON struct {
+	Name              string            `json:"contractName"`
+	ABI               json.RawMessage   `json:"abi,omitempty"`
+	Bytecode          bytecodeJSON      `json:"bytecode"`
+	DeployedBytecode  bytecodeJSON      `json:"deployedBytecode"`
+	SourceMap         string            `json:"sourceMap,omitempty"`
+	DeployedSourceMap string            `json:"deployedSourceMap,omitempty"`
+	Immutables        []CodeRange       `json:"immutables,omitempty"`
+	Networks          map[int]NetSchema `json:"networks,omitempty"`
+	SchemaVersion     string            `json:"schemaVersion,omitempty"`
+	UpdatedAt         string            `json:"updatedAt,omitempty"`
+}
+
+// CodeRange is a range of bytes in the contract code
+type CodeRange struct {
+	Start  int `json:"start"`
+	Length int `json:"length"`
+}
+
+// bytecodeJSON is either a hex string (truffle, Hardhat) or an object (Foundry)
+type bytecodeJSON struct {
+	Object     string                 `json:"object"`
+	SourceMap  string                 `json:"sourceMap"`
+	Immutables map[string][]CodeRange `json:"immutableReferences"`
+}
+
+func (b *bytecodeJSON) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &b.Object)
+	}
+	type plain bytecodeJSON
+	return json.Unmarshal(data, (*plain)(b))
+}
+
+// MarshalJSON implements json.Marshaler interface. Bytecode is written as a hex string.
+func (b bytecodeJSON) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.Object)
+}
+
+// UnmarshalJSON implements json.Unmarshaler interface
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	var sj schemaJSON
+	if err := json.Unmarshal(data, &sj); err != nil {
+		return err
+	}
+	*s = Schema{sj.Name, sj.ABI, sj.Bytecode.Object, sj.DeployedBytecode.Object,
+		sj.SourceMap, sj.DeployedSourceMap, sj.Immutables, sj.Networks, sj.SchemaVersion, sj.UpdatedAt}
+	for _, refs := range sj.DeployedBytecode.Immutables {
+		s.Immutables = append(s.Immutables, refs...)
+	}
+	if s.SourceMap == "" {
+		s.SourceMap = sj.Bytecode.SourceMap
+	}
+	if s.DeployedSourceMap == "" {
+		s.DeployedSourceMap = sj.DeployedBytecode.SourceMap
+	}
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler interface. The schema is written in the
+// truffle-schema format.
+func (s Schema) MarshalJSON() ([]byte, error) {
+	return json.Marshal(schemaJSON{s.Name, s.ABI, bytecodeJSON{Object: s.Bytecode},
+		bytecodeJSON{Object: s.DeployedBytecode}, s.SourceMap, s.DeployedSourceMap,
+		s.Immutables, s.Networks, s.SchemaVersion, s.UpdatedAt})
+}
+
+// ParsedABI parses the schema ABI.
+func (s Schema) ParsedABI() (abi.ABI, errstack.E) {
+	if isEmptyABI(s.ABI) {
+		return abi.ABI{}, nil
+	}
+	a, err := abi.JSON(bytes.NewReader(s.ABI))
+	if err != nil {
+		return a, errstack.WrapAsDomain(err, "Invalid ABI of contract "+s.Name)
+	}
+	return a, nil
+}
+
+// isEmptyABI checks if the ABI is not set or doesn't define any entry.
+func isEmptyABI(data json.RawMessage) bool {
+	var entries []json.RawMessage
+	return len(data) == 0 || json.Unmarshal(data, &entries) == nil && len(entries) == 0
 }
 
 // Address is a handy method which returns smart contract address deployed for given network
@@ -47,30 +154,242 @@ func (s Schema) Address(networkID int) (a common.Address, e errstack.E) {
 	return ParseAddress(n.Address)
 }
 
+// NetworkIDs returns sorted identifiers of networks the contract is deployed on.
+func (s Schema) NetworkIDs() []int {
+	ids := make([]int, 0, len(s.Networks))
+	for id := range s.Networks {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
 // SchemaFactory is a structure which provides contract schema functions and data
 type SchemaFactory struct {
-	Dir     string
-	Network int
-	logger  log15.Logger
+	Dir       string
+	Network   int
+	logger    log15.Logger
+	artifacts *artifactIndex
 }
 
 // NewSchemaFactory creates new SchemaFactory.
 func NewSchemaFactory(contractsPath string, network int, logger log15.Logger) (SchemaFactory, errstack.E) {
-	return SchemaFactory{contractsPath, network, logger},
+	return SchemaFactory{contractsPath, network, logger, &artifactIndex{}},
 		bat.IsDir(contractsPath)
 }
 
-// Read reads truffle-schema file. The name should not finish with ".json"
-func (sf SchemaFactory) Read(name string) (s Schema, err errstack.E) {
-	if err = bat.DecodeJSONFile(path.Join(sf.Dir, name+".json"), &s, sf.logger); err != nil {
+// Read reads contract schema. The name should not finish with ".json".
+// The following layouts of the `Dir` directory are supported:
+//   - truffle build directory: <name>.json
+//   - Hardhat project: artifacts/**/<name>.sol/<name>.json, optionally with hardhat-deploy
+//     deployments/<network>/<name>.json (networks are identified by the .chainId file)
+//   - Foundry project: out/<source>.sol/<name>.json
+//
+// The artifacts and out directories are indexed on the first Read (see Reload).
+func (sf SchemaFactory) Read(name string) (Schema, errstack.E) {
+	s, _, err := sf.read(name)
+	return s, err
+}
+
+// read reads contract schema and returns the state of the files it was read from.
+func (sf SchemaFactory) read(name string) (s Schema, files []fileState, err errstack.E) {
+	var st fileState
+	fn := path.Join(sf.Dir, name+".json")
+	if isFile(fn) {
+		st, err = sf.decodeJSONFile(fn, &s)
+		if err != nil {
+			return
+		}
+		if s.Name == "" {
+			return s, nil, errstack.NewDomainF("Contract %q doesn't have defined name", name)
+		}
+		return s, []fileState{st}, nil
+	}
+	ai := sf.artifacts
+	if ai == nil {
+		ai = &artifactIndex{}
+	}
+	if fn, err = ai.find(sf.Dir, name); err != nil {
 		return
 	}
+	if fn != "" {
+		if st, err = sf.decodeJSONFile(fn, &s); err != nil {
+			return
+		}
+		files = append(files, st)
+	}
+	if files, err = sf.readDeployments(name, &s, files); err != nil {
+		return
+	}
+	if len(files) == 0 {
+		return s, nil, errstack.NewReqF("Contract %q schema not found in %q", name, sf.Dir)
+	}
 	if s.Name == "" {
-		return s, errstack.NewDomainF("Contract %q doesn't have defined name", name)
+		s.Name = name
 	}
 	return
 }
 
+// decodeJSONFile decodes the JSON file. The file state is taken before reading, so
+// a change made during the read will be detected.
+func (sf SchemaFactory) decodeJSONFile(fn string, v interface{}) (fileState, errstack.E) {
+	st := fileState{name: fn}
+	if info, err := os.Stat(fn); err == nil {
+		st.modTime, st.size = info.ModTime(), info.Size()
+	}
+	return st, bat.DecodeJSONFile(fn, v, sf.logger)
+}
+
+// Reload drops the Hardhat and Foundry artifacts index, so it's built again by the next
+// Read. The index is shared by copies of the SchemaFactory.
+func (sf SchemaFactory) Reload() {
+	if sf.artifacts != nil {
+		sf.artifacts.reset()
+	}
+}
+
+// artifactDirs are the Hardhat and Foundry artifacts directories, in the search order
+var artifactDirs = []string{"artifacts", "out"}
+
+// artifactIndex maps contract names to <name>.sol/<name>.json artifact files, separately
+// for each of the artifactDirs. It's built once, until reset, and safe for concurrent use.
+type artifactIndex struct {
+	mu    sync.Mutex
+	built bool
+	files []map[string][]string
+	err   errstack.E
+}
+
+// find returns the artifact file of the contract or empty string if it's not found.
+func (ai *artifactIndex) find(root, name string) (string, errstack.E) {
+	ai.mu.Lock()
+	defer ai.mu.Unlock()
+	if !ai.built {
+		ai.built = true
+		for _, dir := range artifactDirs {
+			files, err := indexArtifacts(path.Join(root, dir))
+			if err != nil {
+				ai.err = err
+				break
+			}
+			ai.files = append(ai.files, files)
+		}
+	}
+	if ai.err != nil {
+		return "", ai.err
+	}
+	for _, files := range ai.files {
+		switch found := files[name]; len(found) {
+		case 0:
+			continue
+		case 1:
+			return found[0], nil
+		default:
+			return "", errstack.NewReqF("Contract %q is ambiguous, found artifacts: %v", name, found)
+		}
+	}
+	return "", nil
+}
+
+// reset drops the index, so it's built again by the next find.
+func (ai *artifactIndex) reset() {
+	ai.mu.Lock()
+	ai.built, ai.files, ai.err = false, nil, nil
+	ai.mu.Unlock()
+}
+
+// indexArtifacts collects <name>.sol/<name>.json artifacts in the directory tree.
+func indexArtifacts(dir string) (map[string][]string, errstack.E) {
+	files := map[string][]string{}
+	if bat.IsDir(dir) != nil {
+		return files, nil
+	}
+	err := filepath.Walk(dir, func(fn string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == "build-info" {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ".json") && strings.HasSuffix(filepath.Dir(fn), ".sol") {
+			name := strings.TrimSuffix(info.Name(), ".json")
+			files[name] = append(files[name], fn)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errstack.WrapAsIOf(err, "Can't search artifacts in %q", dir)
+	}
+	return files, nil
+}
+
+// hardhatDeployment is the hardhat-deploy deployment file
+type hardhatDeployment struct {
+	Address          string            `json:"address"`
+	ABI              json.RawMessage   `json:"abi"`
+	TransactionHash  string            `json:"transactionHash"`
+	Bytecode         string            `json:"bytecode"`
+	DeployedBytecode string            `json:"deployedBytecode"`
+	Libraries        map[string]string `json:"libraries"`
+}
+
+// readDeployments reads hardhat-deploy deployments of the contract into the schema.
+// The state of the deployment files is appended to `files`.
+func (sf SchemaFactory) readDeployments(name string, s *Schema, files []fileState) ([]fileState, errstack.E) {
+	dir := path.Join(sf.Dir, "deployments")
+	if bat.IsDir(dir) != nil {
+		return files, nil
+	}
+	nets, errStd := ioutil.ReadDir(dir)
+	if errStd != nil {
+		return files, errstack.WrapAsIOf(errStd, "Can't read deployments directory %q", dir)
+	}
+	for _, n := range nets {
+		fn := path.Join(dir, n.Name(), name+".json")
+		if !n.IsDir() || !isFile(fn) {
+			continue
+		}
+		chainID, err := readChainID(path.Join(dir, n.Name(), ".chainId"))
+		if err != nil {
+			return files, err
+		}
+		var d hardhatDeployment
+		st, err := sf.decodeJSONFile(fn, &d)
+		if err != nil {
+			return files, err
+		}
+		files = append(files, st)
+		if s.Networks == nil {
+			s.Networks = map[int]NetSchema{}
+		}
+		s.Networks[chainID] = NetSchema{Address: d.Address, TransactionHash: d.TransactionHash, Links: d.Libraries}
+		if isEmptyABI(s.ABI) && !isEmptyABI(d.ABI) {
+			s.ABI = d.ABI
+		}
+		if s.Bytecode == "" {
+			s.Bytecode, s.DeployedBytecode = d.Bytecode, d.DeployedBytecode
+		}
+	}
+	return files, nil
+}
+
+func isFile(fn string) bool {
+	info, err := os.Stat(fn)
+	return err == nil && !info.IsDir()
+}
+
+func readChainID(fn string) (int, errstack.E) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return 0, errstack.WrapAsIOf(err, "Can't read network chain ID %q", fn)
+	}
+	id, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, errstack.WrapAsDomain(err, "Invalid chain ID in "+fn)
+	}
+	return id, nil
+}
+
 // ReadGetAddress reads schema using `Read` and extract contract address
 // using then network identifier.
 func (sf SchemaFactory) ReadGetAddress(name string) (s Schema, a common.Address, err errstack.E) {
@@ -90,3 +409,62 @@ func (sf SchemaFactory) MustReadGetAddress(name string) (Schema, common.Address)
 	}
 	return s, a
 }
+
+// MultiNetSchemaFactory provides contract schemas and addresses for many networks.
+// Each schema file is read once and cached. It's safe for concurrent use.
+type MultiNetSchemaFactory struct {
+	Dir    string
+	logger log15.Logger
+	mu     sync.Mutex
+	sf     SchemaFactory
+	cache  map[string]Schema
+}
+
+// NewMultiNetSchemaFactory creates new MultiNetSchemaFactory.
+func NewMultiNetSchemaFactory(contractsPath string, logger log15.Logger) (*MultiNetSchemaFactory, errstack.E) {
+	sf, err := NewSchemaFactory(contractsPath, 0, logger)
+	return &MultiNetSchemaFactory{Dir: contractsPath, logger: logger, sf: sf, cache: map[string]Schema{}},
+		err
+}
+
+// Read returns cached truffle-schema, reading the file if needed.
+// The name should not finish with ".json"
+func (sf *MultiNetSchemaFactory) Read(name string) (Schema, errstack.E) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if s, ok := sf.cache[name]; ok {
+		return s, nil
+	}
+	s, err := sf.sf.Read(name)
+	if err != nil {
+		return s, err
+	}
+	sf.cache[name] = s
+	return s, nil
+}
+
+// Address returns the contract address deployed on the given network.
+func (sf *MultiNetSchemaFactory) Address(name string, networkID int) (common.Address, errstack.E) {
+	s, err := sf.Read(name)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return s.Address(networkID)
+}
+
+// Networks returns sorted identifiers of networks the contract is deployed on.
+func (sf *MultiNetSchemaFactory) Networks(name string) ([]int, errstack.E) {
+	s, err := sf.Read(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.NetworkIDs(), nil
+}
+
+// Reload clears the cache, so schema files will be read and artifacts indexed again.
+func (sf *MultiNetSchemaFactory) Reload() {
+	sf.mu.Lock()
+	sf.cache = map[string]Schema{}
+	sf.sf.Reload()
+	sf.mu.Unlock()
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/robert-zaremba/log15"
+	. "gopkg.in/check.v1"
+)
+
+const tokenSchema = `{
+  "contractName": "Token",
+  "abi": ` + tokenABI + `,
+  "bytecode": "0x6080__Lib___________________________________6000",
+  "deployedBytecode": "0x6000",
+  "sourceMap": "1:2:3",
+  "networks": {
+    "1": {"address": "0x0000000000000000000000000000000000000001",
+      "transactionHash": "0xabcd", "links": {"Lib": "0x0000000000000000000000000000000000000002"}},
+    "10": {"address": "0x000000000000000000000000000000000000000a"}
+  },
+  "schemaVersion": "1.0.1"
+}`
+
+type SchemaSuite struct {
+	dir string
+}
+
+func (s *SchemaSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	c.Assert(ioutil.WriteFile(path.Join(s.dir, "Token.json"), []byte(tokenSchema), 0600), IsNil)
+}
+
+func (s *SchemaSuite) TestMultiNet(c *C) {
+	_, err := NewMultiNetSchemaFactory(path.Join(s.dir, "missing"), log15.Root())
+	c.Check(err, NotNil)
+	sf, err := NewMultiNetSchemaFactory(s.dir, log15.Root())
+	c.Assert(err, IsNil)
+
+	a, err := sf.Address("Token", 1)
+	c.Assert(err, IsNil)
+	c.Check(a, Equals, common.HexToAddress("0x01"))
+	a, err = sf.Address("Token", 10)
+	c.Assert(err, IsNil)
+	c.Check(a, Equals, common.HexToAddress("0x0a"))
+	_, err = sf.Address("Token", 3)
+	c.Check(err, ErrorMatches, `Can't get "Token" Smart-Contract address. It's not deployed on network=3`)
+	_, err = sf.Address("Missing", 1)
+	c.Check(err, NotNil)
+
+	ids, err := sf.Networks("Token")
+	c.Assert(err, IsNil)
+	c.Check(ids, DeepEquals, []int{1, 10})
+
+	// the schema is cached
+	c.Assert(os.Remove(path.Join(s.dir, "Token.json")), IsNil)
+	_, err = sf.Address("Token", 1)
+	c.Check(err, IsNil)
+	sf.Reload()
+	_, err = sf.Address("Token", 1)
+	c.Check(err, NotNil)
+}
+
+func (s *SchemaSuite) writeFile(c *C, content string, elem ...string) {
+	fn := path.Join(append([]string{s.dir}, elem...)...)
+	c.Assert(os.MkdirAll(path.Dir(fn), 0700), IsNil)
+	c.Assert(ioutil.WriteFile(fn, []byte(content), 0600), IsNil)
+}
+
+func (s *SchemaSuite) parseABI(c *C, sch Schema) abi.ABI {
+	a, err := sch.ParsedABI()
+	c.Assert(err, IsNil)
+	return a
+}
+
+func (s *SchemaSuite) TestTruffle(c *C) {
+	sf, err := NewSchemaFactory(s.dir, 1, log15.Root())
+	c.Assert(err, IsNil)
+	sch, a, err := sf.ReadGetAddress("Token")
+	c.Assert(err, IsNil)
+	c.Check(a, Equals, common.HexToAddress("0x01"))
+	a2 := s.parseABI(c, sch)
+	c.Check(a2.Events, HasLen, 2)
+	c.Check(a2.Methods["transfer"].Inputs, HasLen, 2)
+	c.Check(sch.Bytecode, Equals, "0x6080__Lib___________________________________6000")
+	c.Check(sch.DeployedBytecode, Equals, "0x6000")
+	c.Check(sch.SourceMap, Equals, "1:2:3")
+	c.Check(sch.Networks[1].TransactionHash, Equals, "0xabcd")
+	c.Check(sch.Networks[1].Links, DeepEquals, map[string]string{"Lib": "0x0000000000000000000000000000000000000002"})
+
+	s.writeFile(c, `{"abi": []}`, "Anonymous.json")
+	_, err = sf.Read("Anonymous")
+	c.Check(err, ErrorMatches, `Contract "Anonymous" doesn't have defined name`)
+	_, err = sf.Read("Missing")
+	c.Check(err, ErrorMatches, `Contract "Missing" schema not found.*`)
+
+	// malformed ABI doesn't prevent reading the address
+	s.writeFile(c, `{"contractName": "Broken", "abi": [{"type": "function", "inputs": [{"type": "foo"}]}],
+		"networks": {"1": {"address": "0x0000000000000000000000000000000000000003"}}}`, "Broken.json")
+	sch, a, err = sf.ReadGetAddress("Broken")
+	c.Assert(err, IsNil)
+	c.Check(a, Equals, common.HexToAddress("0x03"))
+	_, err = sch.ParsedABI()
+	c.Check(err, ErrorMatches, "Invalid ABI of contract Broken.*")
+	_, err = NewDynamicContract(sch, 1, nil)
+	c.Check(err, ErrorMatches, "Invalid ABI of contract Broken.*")
+}
+
+func (s *SchemaSuite) TestMarshalRoundTrip(c *C) {
+	s.writeFile(c, `{"abi": `+tokenABI+`,
+		"bytecode": {"object": "0x6001", "sourceMap": "1:1:0"},
+		"deployedBytecode": {"object": "0x6002", "sourceMap": "2:2:0",
+			"immutableReferences": {"7": [{"start": 1, "length": 32}]}}}`,
+		"out", "Coin.sol", "Coin.json")
+	sf, err := NewSchemaFactory(s.dir, 1, log15.Root())
+	c.Assert(err, IsNil)
+	for _, name := range []string{"Token", "Coin"} {
+		sch, err := sf.Read(name)
+		c.Assert(err, IsNil)
+		data, errStd := json.Marshal(sch)
+		c.Assert(errStd, IsNil)
+		var sch2 Schema
+		c.Assert(json.Unmarshal(data, &sch2), IsNil)
+		var abiJSON bytes.Buffer // the ABI is compacted by the encoder
+		c.Assert(json.Compact(&abiJSON, sch.ABI), IsNil)
+		sch.ABI = abiJSON.Bytes()
+		c.Check(sch2, DeepEquals, sch, Commentf("schema %s: %s", name, data))
+		c.Check(s.parseABI(c, sch2), DeepEquals, s.parseABI(c, sch))
+	}
+}
+
+func (s *SchemaSuite) TestHardhat(c *C) {
+	s.writeFile(c, `{"_format": "hh-sol-artifact-1", "contractName": "Coin", "sourceName": "contracts/Coin.sol",
+		"abi": `+tokenABI+`, "bytecode": "0x6001", "deployedBytecode": "0x6002",
+		"linkReferences": {}, "deployedLinkReferences": {}}`, "artifacts", "contracts", "Coin.sol", "Coin.json")
+	s.writeFile(c, `{}`, "artifacts", "build-info", "Coin.sol", "Coin.json")
+	s.writeFile(c, "5\n", "deployments", "goerli", ".chainId")
+	s.writeFile(c, `{"address": "0x0000000000000000000000000000000000000005", "abi": [],
+		"transactionHash": "0x05", "libraries": {"Lib": "0x0000000000000000000000000000000000000006"}}`,
+		"deployments", "goerli", "Coin.json")
+	s.writeFile(c, "137", "deployments", "polygon", ".chainId")
+	s.writeFile(c, `{"address": "0x0000000000000000000000000000000000000089", "abi": []}`,
+		"deployments", "polygon", "Coin.json")
+
+	sf, err := NewMultiNetSchemaFactory(s.dir, log15.Root())
+	c.Assert(err, IsNil)
+	sch, err := sf.Read("Coin")
+	c.Assert(err, IsNil)
+	c.Check(sch.Name, Equals, "Coin")
+	c.Check(s.parseABI(c, sch).Events, HasLen, 2)
+	c.Check(sch.Bytecode, Equals, "0x6001")
+	c.Check(sch.NetworkIDs(), DeepEquals, []int{5, 137})
+	c.Check(sch.Networks[5].Links["Lib"], Equals, "0x0000000000000000000000000000000000000006")
+	a, err := sf.Address("Coin", 137)
+	c.Assert(err, IsNil)
+	c.Check(a, Equals, common.HexToAddress("0x89"))
+
+	// deployment without an artifact
+	s.writeFile(c, `{"address": "0x0000000000000000000000000000000000000007", "abi": `+tokenABI+`,
+		"bytecode": "0x6003"}`, "deployments", "goerli", "Proxy.json")
+	sch, err = sf.Read("Proxy")
+	c.Assert(err, IsNil)
+	c.Check(sch.Name, Equals, "Proxy")
+	c.Check(s.parseABI(c, sch).Events, HasLen, 2)
+	c.Check(sch.Bytecode, Equals, "0x6003")
+}
+
+func (s *SchemaSuite) TestFoundry(c *C) {
+	s.writeFile(c, `{"abi": `+tokenABI+`,
+		"bytecode": {"object": "0x6001", "sourceMap": "1:1:0", "linkReferences": {}},
+		"deployedBytecode": {"object": "0x6002", "sourceMap": "2:2:0", "linkReferences": {}}}`,
+		"out", "Coin.sol", "Coin.json")
+	s.writeFile(c, `{"abi": []}`, "out", "Other.sol", "Dup.json")
+	s.writeFile(c, `{"abi": []}`, "out", "Another.sol", "Dup.json")
+	sf, err := NewSchemaFactory(s.dir, 1, log15.Root())
+	c.Assert(err, IsNil)
+	sch, err := sf.Read("Coin")
+	c.Assert(err, IsNil)
+	c.Check(sch.Name, Equals, "Coin")
+	c.Check(s.parseABI(c, sch).Methods, HasLen, 2)
+	c.Check(sch.Bytecode, Equals, "0x6001")
+	c.Check(sch.SourceMap, Equals, "1:1:0")
+	c.Check(sch.DeployedBytecode, Equals, "0x6002")
+	c.Check(sch.DeployedSourceMap, Equals, "2:2:0")
+	_, err = sf.Read("Dup")
+	c.Check(err, ErrorMatches, `Contract "Dup" is ambiguous.*`)
+
+	// artifacts are indexed once
+	s.writeFile(c, `{"abi": []}`, "out", "New.sol", "New.json")
+	_, err = sf.Read("New")
+	c.Check(err, ErrorMatches, `Contract "New" schema not found.*`)
+	msf, err := NewMultiNetSchemaFactory(s.dir, log15.Root())
+	c.Assert(err, IsNil)
+	_, err = msf.Read("New")
+	c.Check(err, IsNil)
+}
@@ -16,9 +16,12 @@
 package ethdrv
 
 import (
+	"context"
+	"sync"
+	"time"
+
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/robert-zaremba/errstack"
 )
 
@@ -27,45 +30,147 @@ type ContractFactory interface {
 	TxrFactory
 }
 
-type contractFactory struct {
-	client    *ethclient.Client
+// ContractConstructor is a contract binding constructor generated by abigen (NewFoo).
+type ContractConstructor[T any] func(common.Address, bind.ContractBackend) (*T, error)
+
+// Register registers the contract binding constructor for the `name` contract.
+// Registering the same name again replaces the constructor and drops the cached instance.
+func Register[T any](r *ContractRegistry, name string, constructor ContractConstructor[T]) {
+	r.register(name, func(addr common.Address, backend bind.ContractBackend) (interface{}, error) {
+		return constructor(addr, backend)
+	})
+}
+
+// Get returns the `name` contract instance bound to the schema address.
+// Instances are constructed once and cached until the address changes.
+func Get[T any](r *ContractRegistry, name string) (*T, common.Address, errstack.E) {
+	c, addr, err := r.contract(name)
+	if err != nil {
+		return nil, addr, err
+	}
+	t, ok := c.(*T)
+	if !ok {
+		return nil, addr, errstack.NewReqF("Contract %q is registered with %T type, not %T", name, c, t)
+	}
+	return t, addr, nil
+}
+
+// ContractRegistry is the default ContractFactory based on truffle schema files.
+// Contract bindings are registered with Register and constructed with Get.
+// Contract addresses and instances are cached. It's safe for concurrent use.
+type ContractRegistry struct {
+	client    bind.ContractBackend
 	sf        SchemaFactory
 	txrF      TxrFactory
 	isTestRPC bool
+	addrs     *addressCache
+
+	mu           sync.Mutex
+	constructors map[string]func(common.Address, bind.ContractBackend) (interface{}, error)
+	instances    map[string]contractInstance
+}
 
-	addrs map[string]common.Address
+type contractInstance struct {
+	c    interface{}
+	addr common.Address
+}
+
+// NewContractRegistry creates ContractRegistry. `c` is usually *ethclient.Client.
+func NewContractRegistry(c bind.ContractBackend, sf SchemaFactory, txrF TxrFactory, isTestRPC bool) *ContractRegistry {
+	return &ContractRegistry{client: c, sf: sf, txrF: txrF, isTestRPC: isTestRPC,
+		addrs:        newAddressCache(sf),
+		constructors: map[string]func(common.Address, bind.ContractBackend) (interface{}, error){},
+		instances:    map[string]contractInstance{}}
 }
 
 // NewContractFactory is a default contract provider based on truffle schema files.
-func NewContractFactory(c *ethclient.Client, sf SchemaFactory, txrF TxrFactory, isTestRPC bool) ContractFactory {
-	return contractFactory{c, sf, txrF, isTestRPC,
-		map[string]common.Address{}}
+// `c` is usually *ethclient.Client. See NewContractRegistry.
+func NewContractFactory(c bind.ContractBackend, sf SchemaFactory, txrF TxrFactory, isTestRPC bool) ContractFactory {
+	return NewContractRegistry(c, sf, txrF, isTestRPC)
 }
 
 // Txo implements TxrFactory interface
-func (cf contractFactory) Txo() *bind.TransactOpts {
-	return cf.txrF.Txo()
+func (r *ContractRegistry) Txo() *bind.TransactOpts {
+	return r.txrF.Txo()
+}
+
+// TxoE implements TxoCreator interface. If the registry TxrFactory is not a TxoCreator
+// it never fails.
+func (r *ContractRegistry) TxoE() (*bind.TransactOpts, errstack.E) {
+	return NewTxo(r.txrF)
+}
+
+// Done implements TxoCreator interface
+func (r *ContractRegistry) Done(ctx context.Context, txo *bind.TransactOpts, err error) errstack.E {
+	return TxDone(ctx, r.txrF, txo, err)
 }
 
 // Addr returns signer address
-func (cf contractFactory) Addr() common.Address {
-	return cf.txrF.Addr()
+func (r *ContractRegistry) Addr() common.Address {
+	return r.txrF.Addr()
 }
 
-func (cf contractFactory) getSchemaAddres(contractName string) (common.Address, errstack.E) {
-	if addr, ok := cf.addrs[contractName]; ok {
-		return addr, nil
-	}
-	_, addr, err := cf.sf.ReadGetAddress(contractName)
-	if err != nil {
-		return addr, err
+func (r *ContractRegistry) unwrapTxrFactory() TxrFactory {
+	return r.txrF
+}
+
+func (r *ContractRegistry) register(name string, constructor func(common.Address, bind.ContractBackend) (interface{}, error)) {
+	r.mu.Lock()
+	r.constructors[name] = constructor
+	delete(r.instances, name)
+	r.mu.Unlock()
+}
+
+func (r *ContractRegistry) contract(name string) (c interface{}, addr common.Address, err errstack.E) {
+	r.mu.Lock()
+	constructor, ok := r.constructors[name]
+	r.mu.Unlock()
+	if !ok {
+		return nil, addr, errstack.NewReqF("Contract %q is not registered", name)
 	}
-	cf.addrs[contractName] = addr
-	return addr, nil
+	addr, err = r.mkContract(name, func(addr common.Address) error {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if inst, ok := r.instances[name]; ok && inst.addr == addr {
+			c = inst.c
+			return nil
+		}
+		var err2 error
+		if c, err2 = constructor(addr, r.client); err2 != nil {
+			return err2
+		}
+		r.instances[name] = contractInstance{c, addr}
+		return nil
+	})
+	return c, addr, err
+}
+
+// Invalidate drops the cached `name` contract address and instance, so the schema
+// is read again by the next Get.
+func (r *ContractRegistry) Invalidate(name string) {
+	r.addrs.invalidate(name)
+	r.mu.Lock()
+	delete(r.instances, name)
+	r.mu.Unlock()
+}
+
+// InvalidateAll drops all cached addresses and instances.
+func (r *ContractRegistry) InvalidateAll() {
+	r.addrs.invalidateAll()
+	r.mu.Lock()
+	r.instances = map[string]contractInstance{}
+	r.mu.Unlock()
+}
+
+// Watch polls schema files (truffle, Hardhat or Foundry) of the cached contracts every
+// `interval` and invalidates the contracts which files changed (eg. after redeployment).
+// It blocks until the context is done.
+func (r *ContractRegistry) Watch(ctx context.Context, interval time.Duration) {
+	r.addrs.watch(ctx, interval, r.Invalidate)
 }
 
-func (cf contractFactory) mkContract(ctrName string, constructor func(common.Address) error) (common.Address, errstack.E) {
-	addr, errE := cf.getSchemaAddres(ctrName)
+func (r *ContractRegistry) mkContract(ctrName string, constructor func(common.Address) error) (common.Address, errstack.E) {
+	addr, errE := r.addrs.get(ctrName)
 	if errE != nil {
 		return addr, errE
 	}
@@ -0,0 +1,221 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	. "github.com/robert-zaremba/checkers"
+	"github.com/robert-zaremba/log15"
+	. "gopkg.in/check.v1"
+)
+
+type ContractSuite struct {
+	dir string
+	cf  *ContractRegistry
+}
+
+// testToken mimics abigen binding
+type testToken struct {
+	addr    common.Address
+	backend bind.ContractBackend
+}
+
+func newTestToken(addr common.Address, backend bind.ContractBackend) (*testToken, error) {
+	return &testToken{addr, backend}, nil
+}
+
+func (s *ContractSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	c.Assert(ioutil.WriteFile(path.Join(s.dir, "Token.json"), []byte(tokenSchema), 0600), IsNil)
+	sf, err := NewSchemaFactory(s.dir, 1, log15.Root())
+	c.Assert(err, IsNil)
+	s.cf = NewContractRegistry(nil, sf, txrFactory{}, true)
+}
+
+func (s *ContractSuite) TestGet(c *C) {
+	_, _, err := Get[testToken](s.cf, "Token")
+	c.Check(err, ErrorMatches, `Contract "Token" is not registered`)
+
+	Register(s.cf, "Token", newTestToken)
+	t, addr, err := Get[testToken](s.cf, "Token")
+	c.Assert(err, IsNil)
+	c.Check(addr, Equals, common.HexToAddress("0x01"))
+	c.Check(t.addr, Equals, addr)
+	t2, _, err := Get[testToken](s.cf, "Token")
+	c.Assert(err, IsNil)
+	c.Check(t2, Equals, t, Comment("instance should be cached"))
+
+	_, _, err = Get[ContractSuite](s.cf, "Token")
+	c.Check(err, ErrorMatches, `Contract "Token" is registered with \*ethdrv.testToken type, not \*ethdrv.ContractSuite`)
+
+	// registering again drops the cached instance
+	Register(s.cf, "Token", newTestToken)
+	t2, _, err = Get[testToken](s.cf, "Token")
+	c.Assert(err, IsNil)
+	c.Check(t2 != t, IsTrue)
+}
+
+func (s *ContractSuite) TestGetErrors(c *C) {
+	Register(s.cf, "Missing", newTestToken)
+	_, _, err := Get[testToken](s.cf, "Missing")
+	c.Check(err, NotNil)
+
+	Register(s.cf, "Token", func(common.Address, bind.ContractBackend) (*testToken, error) {
+		return nil, errors.New("boom")
+	})
+	_, _, err = Get[testToken](s.cf, "Token")
+	c.Check(err, ErrorMatches, `Can't create new "Token" contract instance.*`)
+}
+
+// redeploy changes the Token address in the schema file
+func (s *ContractSuite) redeploy(c *C, addr string) {
+	fn := path.Join(s.dir, "Token.json")
+	data := strings.Replace(tokenSchema, "0x0000000000000000000000000000000000000001", addr, 1)
+	c.Assert(ioutil.WriteFile(fn, []byte(data), 0600), IsNil)
+	future := time.Now().Add(time.Minute)
+	c.Assert(os.Chtimes(fn, future, future), IsNil)
+}
+
+func (s *ContractSuite) TestConcurrentGet(c *C) {
+	Register(s.cf, "Token", newTestToken)
+	var wg sync.WaitGroup
+	ts := make([]*testToken, 20)
+	for i := range ts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%5 == 0 {
+				s.cf.Invalidate("Token")
+			}
+			t, _, err := Get[testToken](s.cf, "Token")
+			c.Check(err, IsNil)
+			ts[i] = t
+		}(i)
+	}
+	wg.Wait()
+	for _, t := range ts {
+		c.Check(t.addr, Equals, common.HexToAddress("0x01"))
+	}
+}
+
+func (s *ContractSuite) TestInvalidate(c *C) {
+	Register(s.cf, "Token", newTestToken)
+	t, _, err := Get[testToken](s.cf, "Token")
+	c.Assert(err, IsNil)
+
+	s.redeploy(c, "0x0000000000000000000000000000000000000003")
+	_, addr, err := Get[testToken](s.cf, "Token")
+	c.Assert(err, IsNil)
+	c.Check(addr, Equals, common.HexToAddress("0x01"), Comment("address should be cached"))
+
+	s.cf.Invalidate("Token")
+	t2, addr, err := Get[testToken](s.cf, "Token")
+	c.Assert(err, IsNil)
+	c.Check(addr, Equals, common.HexToAddress("0x03"))
+	c.Check(t2.addr, Equals, addr)
+	c.Check(t2 != t, IsTrue)
+
+	s.redeploy(c, "0x0000000000000000000000000000000000000004")
+	s.cf.InvalidateAll()
+	_, addr, err = Get[testToken](s.cf, "Token")
+	c.Assert(err, IsNil)
+	c.Check(addr, Equals, common.HexToAddress("0x04"))
+}
+
+func (s *ContractSuite) TestWatch(c *C) {
+	Register(s.cf, "Token", newTestToken)
+	_, _, err := Get[testToken](s.cf, "Token")
+	c.Assert(err, IsNil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.cf.Watch(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	s.redeploy(c, "0x0000000000000000000000000000000000000003")
+	var addr common.Address
+	for i := 0; i < 100 && addr != common.HexToAddress("0x03"); i++ {
+		time.Sleep(10 * time.Millisecond)
+		_, addr, err = Get[testToken](s.cf, "Token")
+		c.Assert(err, IsNil)
+	}
+	c.Check(addr, Equals, common.HexToAddress("0x03"))
+}
+
+// writeDeployment writes the Hardhat deployment file of the Coin contract
+func (s *ContractSuite) writeDeployment(c *C, addr string) {
+	dir := path.Join(s.dir, "deployments", "mainnet")
+	c.Assert(os.MkdirAll(dir, 0700), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(dir, ".chainId"), []byte("1"), 0600), IsNil)
+	fn := path.Join(dir, "Coin.json")
+	c.Assert(ioutil.WriteFile(fn, []byte(`{"address": "`+addr+`", "abi": `+tokenABI+`}`), 0600), IsNil)
+	future := time.Now().Add(time.Minute)
+	c.Assert(os.Chtimes(fn, future, future), IsNil)
+}
+
+func (s *ContractSuite) TestWatchHardhat(c *C) {
+	Register(s.cf, "Coin", newTestToken)
+	Register(s.cf, "Vault", newTestToken)
+	s.writeDeployment(c, "0x0000000000000000000000000000000000000005")
+	_, addr, err := Get[testToken](s.cf, "Coin")
+	c.Assert(err, IsNil)
+	c.Check(addr, Equals, common.HexToAddress("0x05"))
+	_, _, err = Get[testToken](s.cf, "Vault")
+	c.Check(err, NotNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.cf.Watch(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	s.writeDeployment(c, "0x0000000000000000000000000000000000000006")
+	for i := 0; i < 100 && addr != common.HexToAddress("0x06"); i++ {
+		time.Sleep(10 * time.Millisecond)
+		_, addr, err = Get[testToken](s.cf, "Coin")
+		c.Assert(err, IsNil)
+	}
+	c.Check(addr, Equals, common.HexToAddress("0x06"), Comment("deployment file change must be detected"))
+
+	// a new artifact is found after the artifacts are indexed again
+	dir := path.Join(s.dir, "out", "Vault.sol")
+	c.Assert(os.MkdirAll(dir, 0700), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(dir, "Vault.json"), []byte(`{"abi": `+tokenABI+`,
+		"networks": {"1": {"address": "0x0000000000000000000000000000000000000007"}}}`), 0600), IsNil)
+	s.cf.InvalidateAll()
+	_, addr, err = Get[testToken](s.cf, "Vault")
+	c.Assert(err, IsNil)
+	c.Check(addr, Equals, common.HexToAddress("0x07"))
+}
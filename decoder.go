@@ -0,0 +1,241 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/robert-zaremba/errstack"
+)
+
+// UnknownEventError is returned by EventDecoder when the log topic doesn't match
+// any known event. It implements errstack.E.
+type UnknownEventError struct {
+	errstack.E
+	Topic common.Hash
+}
+
+func newUnknownEventError(topic common.Hash) *UnknownEventError {
+	e := &UnknownEventError{Topic: topic}
+	e.E = errstack.NewDomain(e.Error())
+	return e
+}
+
+func (e *UnknownEventError) Error() string {
+	return fmt.Sprintf("unknown event, topic=%s", e.Topic.Hex())
+}
+
+// EventMismatchError is returned by EventDecoder when the log doesn't match the event
+// ABI. Probably the ABI doesn't match the contract version. It implements errstack.E.
+type EventMismatchError struct {
+	errstack.E
+	Event string
+	Err   error
+}
+
+func newEventMismatchError(event string, err error) *EventMismatchError {
+	e := &EventMismatchError{Event: event, Err: err}
+	e.E = errstack.WrapAsDomain(err, fmt.Sprintf("Log doesn't match %q event ABI", event))
+	return e
+}
+
+func (e *EventMismatchError) Error() string {
+	return fmt.Sprintf("log doesn't match %q event ABI: %v", e.Event, e.Err)
+}
+
+// EventDecoder decodes logs of events defined in a set of ABIs. Both indexed (topics)
+// and non-indexed (data) arguments are decoded.
+// Registration methods are not safe for concurrent use with decoding.
+type EventDecoder struct {
+	events map[common.Hash]abi.Event
+	types  map[common.Hash]reflect.Type
+}
+
+// NewEventDecoder creates EventDecoder for all non anonymous events from the given ABIs.
+func NewEventDecoder(abis ...abi.ABI) *EventDecoder {
+	d := &EventDecoder{map[common.Hash]abi.Event{}, map[common.Hash]reflect.Type{}}
+	for _, a := range abis {
+		for _, e := range a.Events {
+			if !e.Anonymous {
+				d.events[e.ID] = e
+			}
+		}
+	}
+	return d
+}
+
+// Register sets a struct type used to decode `eventName` events. `prototype` must be
+// a struct or a pointer to a struct. Fields are matched to the event arguments by
+// the `abi` tag or by the camel-cased argument name.
+func (d *EventDecoder) Register(eventName string, prototype interface{}) errstack.E {
+	t := reflect.TypeOf(prototype)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return errstack.NewReqF("Event %q prototype must be a struct, got %T", eventName, prototype)
+	}
+	if !d.hasEvent(eventName) {
+		return errstack.NewReqF("Event %q is not defined in the ABI", eventName)
+	}
+	for id, e := range d.events {
+		if e.Name == eventName {
+			d.types[id] = t
+		}
+	}
+	return nil
+}
+
+func (d *EventDecoder) hasEvent(eventName string) bool {
+	for _, e := range d.events {
+		if e.Name == eventName {
+			return true
+		}
+	}
+	return false
+}
+
+// Event returns the event ABI matching the log.
+func (d *EventDecoder) Event(l types.Log) (abi.Event, errstack.E) {
+	if len(l.Topics) == 0 {
+		return abi.Event{}, newUnknownEventError(common.Hash{})
+	}
+	e, ok := d.events[l.Topics[0]]
+	if !ok {
+		return e, newUnknownEventError(l.Topics[0])
+	}
+	return e, nil
+}
+
+// Decode decodes the log. If a type was registered for the event, then a pointer
+// to a new value of that type is returned, otherwise a map of argument names to values.
+// Returned error is either *UnknownEventError or *EventMismatchError.
+func (d *EventDecoder) Decode(l types.Log) (string, interface{}, errstack.E) {
+	e, err := d.Event(l)
+	if err != nil {
+		return "", nil, err
+	}
+	t, ok := d.types[e.ID]
+	if !ok {
+		m, err := d.decodeMap(e, l)
+		return e.Name, m, err
+	}
+	v := reflect.New(t)
+	return e.Name, v.Interface(), d.decodeInto(e, l, v.Interface())
+}
+
+// DecodeInto decodes the log into `dest`, which must be a pointer to a struct.
+// Returned error is either *UnknownEventError or *EventMismatchError.
+func (d *EventDecoder) DecodeInto(l types.Log, dest interface{}) errstack.E {
+	e, err := d.Event(l)
+	if err != nil {
+		return err
+	}
+	return d.decodeInto(e, l, dest)
+}
+
+// DecodeMap decodes the log into a map of argument names to values.
+// Returned error is either *UnknownEventError or *EventMismatchError.
+func (d *EventDecoder) DecodeMap(l types.Log) (map[string]interface{}, errstack.E) {
+	e, err := d.Event(l)
+	if err != nil {
+		return nil, err
+	}
+	return d.decodeMap(e, l)
+}
+
+func (d *EventDecoder) decodeMap(e abi.Event, l types.Log) (map[string]interface{}, errstack.E) {
+	m := map[string]interface{}{}
+	if err := e.Inputs.UnpackIntoMap(m, l.Data); err != nil {
+		return nil, newEventMismatchError(e.Name, err)
+	}
+	var indexed abi.Arguments
+	for _, arg := range e.Inputs {
+		if arg.Indexed {
+			indexed = append(indexed, arg)
+		}
+	}
+	if len(indexed) != len(l.Topics)-1 {
+		return nil, newEventMismatchError(e.Name,
+			fmt.Errorf("expected %d indexed arguments, log has %d topics", len(indexed), len(l.Topics)-1))
+	}
+	if err := abi.ParseTopicsIntoMap(m, indexed, l.Topics[1:]); err != nil {
+		return nil, newEventMismatchError(e.Name, err)
+	}
+	return m, nil
+}
+
+func (d *EventDecoder) decodeInto(e abi.Event, l types.Log, dest interface{}) errstack.E {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return newEventMismatchError(e.Name, fmt.Errorf("destination must be a pointer to a struct, got %T", dest))
+	}
+	m, err := d.decodeMap(e, l)
+	if err != nil {
+		return err
+	}
+	v = v.Elem()
+	fields := structFields(v.Type())
+	for _, arg := range e.Inputs {
+		i, ok := fields[arg.Name]
+		if !ok {
+			i, ok = fields[abi.ToCamelCase(arg.Name)]
+		}
+		if !ok {
+			return newEventMismatchError(e.Name, fmt.Errorf("no field for %q argument in %T", arg.Name, dest))
+		}
+		if err := setField(v.Field(i), m[arg.Name]); err != nil {
+			return newEventMismatchError(e.Name, fmt.Errorf("argument %q: %v", arg.Name, err))
+		}
+	}
+	return nil
+}
+
+// structFields maps the `abi` tags and exported field names to field indexes
+func structFields(t reflect.Type) map[string]int {
+	fields := map[string]int{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		if tag := f.Tag.Get("abi"); tag != "" {
+			fields[tag] = i
+		} else {
+			fields[f.Name] = i
+		}
+	}
+	return fields
+}
+
+func setField(f reflect.Value, val interface{}) error {
+	v := reflect.ValueOf(val)
+	switch {
+	case !v.IsValid():
+		return fmt.Errorf("no value")
+	case v.Type().AssignableTo(f.Type()):
+		f.Set(v)
+	case v.Type().ConvertibleTo(f.Type()):
+		f.Set(v.Convert(f.Type()))
+	default:
+		return fmt.Errorf("can't assign %s to %s", v.Type(), f.Type())
+	}
+	return nil
+}
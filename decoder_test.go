@@ -0,0 +1,114 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	. "github.com/robert-zaremba/checkers"
+	"github.com/robert-zaremba/log15"
+	. "gopkg.in/check.v1"
+)
+
+const tokenABI = `[
+{"type":"event","name":"Transfer","anonymous":false,"inputs":[
+	{"name":"from","type":"address","indexed":true},
+	{"name":"to","type":"address","indexed":true},
+	{"name":"value","type":"uint256","indexed":false}]},
+{"type":"event","name":"Approval","anonymous":false,"inputs":[
+	{"name":"owner","type":"address","indexed":true},
+	{"name":"spender","type":"address","indexed":true},
+	{"name":"value","type":"uint256","indexed":false}]},
+{"type":"function","name":"transfer","stateMutability":"nonpayable","inputs":[
+	{"name":"to","type":"address"},{"name":"value","type":"uint256"}],
+	"outputs":[{"name":"","type":"bool"}]},
+{"type":"function","name":"balanceOf","stateMutability":"view","inputs":[
+	{"name":"owner","type":"address"}],"outputs":[{"name":"","type":"uint256"}]}
+]`
+
+type transferEvent struct {
+	From  common.Address
+	To    common.Address
+	Value *big.Int
+}
+
+type DecoderSuite struct {
+	abi      abi.ABI
+	from, to common.Address
+}
+
+func (s *DecoderSuite) SetUpSuite(c *C) {
+	s.abi = MustParseABI("Token", tokenABI, log15.Root())
+	s.from = common.HexToAddress("0xce0d46d924cc8437c806721496599fc3ffa268b9")
+	s.to = common.HexToAddress("0x12ce0d46d924cc8437c806721496599fc3ffa268")
+}
+
+func (s *DecoderSuite) transferLog(c *C, value int64) types.Log {
+	e := s.abi.Events["Transfer"]
+	data, err := e.Inputs.NonIndexed().Pack(big.NewInt(value))
+	c.Assert(err, IsNil)
+	return types.Log{
+		Topics: []common.Hash{e.ID, s.from.Hash(), s.to.Hash()},
+		Data:   data,
+	}
+}
+
+func (s *DecoderSuite) TestDecodeMap(c *C) {
+	d := NewEventDecoder(s.abi)
+	name, v, err := d.Decode(s.transferLog(c, 7))
+	c.Assert(err, IsNil)
+	c.Check(name, Equals, "Transfer")
+	m := v.(map[string]interface{})
+	c.Check(m["from"], Equals, s.from)
+	c.Check(m["to"], Equals, s.to)
+	c.Check(m["value"].(*big.Int).Int64(), Equals, int64(7))
+}
+
+func (s *DecoderSuite) TestDecodeRegistered(c *C) {
+	d := NewEventDecoder(s.abi)
+	c.Assert(d.Register("Transfer", transferEvent{}), IsNil)
+	c.Check(d.Register("Mint", transferEvent{}), ErrorMatches, ".*not defined.*")
+	c.Check(d.Register("Transfer", 1), ErrorMatches, ".*must be a struct.*")
+
+	_, v, err := d.Decode(s.transferLog(c, 9))
+	c.Assert(err, IsNil)
+	c.Check(v, DeepEquals, &transferEvent{s.from, s.to, big.NewInt(9)})
+}
+
+func (s *DecoderSuite) TestErrors(c *C) {
+	d := NewEventDecoder(s.abi)
+	l := s.transferLog(c, 1)
+	l.Topics[0] = common.HexToHash("0x01")
+	_, err := d.DecodeMap(l)
+	c.Check(err, FitsTypeOf, &UnknownEventError{})
+	var ue *UnknownEventError
+	c.Check(errors.As(err, &ue), IsTrue)
+
+	l = s.transferLog(c, 1)
+	l.Topics = l.Topics[:2]
+	_, err = d.DecodeMap(l)
+	c.Check(err, FitsTypeOf, &EventMismatchError{})
+
+	l = s.transferLog(c, 1)
+	l.Data = l.Data[:10]
+	var e transferEvent
+	err = d.DecodeInto(l, &e)
+	c.Check(err, FitsTypeOf, &EventMismatchError{})
+}
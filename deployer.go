@@ -0,0 +1,257 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/robert-zaremba/errstack"
+	"github.com/robert-zaremba/log15"
+)
+
+// DeployBackend provides methods required to deploy contracts and wait for receipts.
+// It's implemented by *ethclient.Client and the simulated backend.
+type DeployBackend interface {
+	bind.ContractBackend
+	ReceiptBackend
+}
+
+// LinkBytecode replaces library placeholders in the hex encoded bytecode with the
+// library addresses. Libraries are identified by the name (old solc versions) or by the
+// fully qualified name, eg "contracts/Math.sol:Math" (solc >= 0.5).
+func LinkBytecode(code string, libs map[string]common.Address) ([]byte, errstack.E) {
+	links := make(map[string]string, len(libs))
+	for name, addr := range libs {
+		links[name] = addr.Hex()
+	}
+	b, _, unlinked, err := decodeLinkedCode(code, links)
+	if err != nil {
+		return nil, err
+	}
+	if len(unlinked) > 0 {
+		return nil, errstack.NewReqF("Bytecode has unlinked libraries: %s", strings.Join(unlinked, ", "))
+	}
+	return b, nil
+}
+
+// Deployer deploys contracts using the SchemaFactory artifacts and writes the deployment
+// address back into the schema file for the SchemaFactory network.
+type Deployer struct {
+	backend       DeployBackend
+	sf            SchemaFactory
+	txrF          TxrFactory
+	confirmations uint64
+	logger        log15.Logger
+	mu            sync.Mutex // serializes schema files updates
+}
+
+// NewDeployer creates Deployer. Deploy waits for `confirmations` blocks.
+func NewDeployer(backend DeployBackend, sf SchemaFactory, txrF TxrFactory, confirmations uint64, logger log15.Logger) *Deployer {
+	return &Deployer{backend: backend, sf: sf, txrF: txrF, confirmations: confirmations, logger: logger}
+}
+
+// Deploy deploys the `name` contract with the constructor `args` and links `libs`
+// libraries (see LinkBytecode). It waits for the receipt and updates the schema
+// `Networks` map. The schema must be a truffle schema file (<Dir>/<name>.json).
+func (d *Deployer) Deploy(ctx context.Context, name string, libs map[string]common.Address,
+	args ...interface{}) (common.Address, *types.Receipt, errstack.E) {
+	var addr common.Address
+	fn := path.Join(d.sf.Dir, name+".json")
+	if !isFile(fn) {
+		return addr, nil, errstack.NewReqF("Contract %q truffle schema file not found in %q", name, d.sf.Dir)
+	}
+	s, err := d.sf.Read(name)
+	if err != nil {
+		return addr, nil, err
+	}
+	if s.Bytecode == "" || s.Bytecode == "0x" {
+		return addr, nil, errstack.NewReqF("Contract %q schema doesn't have bytecode", name)
+	}
+	a, err := s.ParsedABI()
+	if err != nil {
+		return addr, nil, err
+	}
+	code, err := LinkBytecode(s.Bytecode, libs)
+	if err != nil {
+		return addr, nil, err
+	}
+	txo, err := NewTxo(d.txrF)
+	if err != nil {
+		return addr, nil, err
+	}
+	txo.Context = ctx
+	addr, tx, _, errStd := bind.DeployContract(txo, a, code, d.backend, args...)
+	if err := TxDone(ctx, d.txrF, txo, errStd); err != nil {
+		d.logger.Error("Can't release transaction options", "contract", name, "err", err)
+	}
+	if errStd != nil {
+		return addr, nil, errstack.WrapAsIOf(errStd, "Can't deploy %q contract", name)
+	}
+	LogTx("Contract deployment sent", tx, d.logger)
+	receipt, err := MinedWaiter{Backend: d.backend}.Wait(ctx, tx.Hash(), d.confirmations)
+	if err != nil {
+		return addr, receipt, err
+	}
+	d.logger.Info("Contract deployed", "contract", name, "address", addr.Hex(),
+		"network", d.sf.Network, "tx_hash", tx.Hash().Hex())
+	links := map[string]string{}
+	for lib, a := range libs {
+		links[lib] = a.Hex()
+	}
+	ns := NetSchema{Address: addr.Hex(), TransactionHash: tx.Hash().Hex(), Links: links,
+		UpdatedAt: int(time.Now().UnixNano() / int64(time.Millisecond))}
+	return addr, receipt, d.writeNetwork(fn, ns)
+}
+
+// writeNetwork updates the network entry in the truffle schema file. Only the entry is
+// rewritten: other content of the file, including the keys order and formatting, is
+// preserved.
+func (d *Deployer) writeNetwork(fn string, ns NetSchema) errstack.E {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	data, errStd := ioutil.ReadFile(fn)
+	if errStd != nil {
+		return errstack.WrapAsIOf(errStd, "Can't read schema file %q", fn)
+	}
+	entry, errStd := json.Marshal(ns)
+	if errStd != nil {
+		return errstack.WrapAsDomain(errStd, "Can't serialize network schema")
+	}
+	networks, start, end, errStd := jsonObjectKey(data, "networks")
+	if errStd != nil {
+		return errstack.WrapAsDomain(errStd, "Invalid schema file "+fn)
+	}
+	if networks == nil || string(networks) == "null" {
+		networks = []byte("{}")
+	}
+	if networks, errStd = setJSONKey(networks, strconv.Itoa(d.sf.Network), entry, lineIndent(data, start)); errStd != nil {
+		return errstack.WrapAsDomain(errStd, "Invalid networks in schema file "+fn)
+	}
+	if start < 0 {
+		data, errStd = setJSONKey(data, "networks", networks, "")
+		if errStd != nil {
+			return errstack.WrapAsDomain(errStd, "Invalid schema file "+fn)
+		}
+	} else {
+		data = append(append(append([]byte{}, data[:start]...), networks...), data[end:]...)
+	}
+	tmp := fn + ".tmp"
+	if errStd = ioutil.WriteFile(tmp, data, 0644); errStd != nil {
+		return errstack.WrapAsIOf(errStd, "Can't write schema file %q", tmp)
+	}
+	return errstack.WrapAsIOf(os.Rename(tmp, fn), "Can't replace schema file %q", fn)
+}
+
+// jsonObjectKey finds the `key` value in the JSON object. It returns the value and its
+// position in `obj`, or nil value and -1 positions if the key is not found.
+func jsonObjectKey(obj []byte, key string) (value []byte, start, end int, err error) {
+	dec := json.NewDecoder(bytes.NewReader(obj))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, -1, -1, errors.New("JSON object expected")
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, -1, -1, err
+		}
+		var raw json.RawMessage
+		if err = dec.Decode(&raw); err != nil {
+			return nil, -1, -1, err
+		}
+		if t == key {
+			end = int(dec.InputOffset())
+			return raw, end - len(raw), end, nil
+		}
+	}
+	return nil, -1, -1, nil
+}
+
+// setJSONKey sets the `key` value in the JSON object, keeping the other bytes of the
+// object. A new key is added at the end of the object. The value is indented if the
+// object is multi-line or `indent` (the indentation of the object line) is not empty.
+func setJSONKey(obj []byte, key string, value []byte, indent string) ([]byte, error) {
+	_, start, end, err := jsonObjectKey(obj, key)
+	if err != nil {
+		return nil, err
+	}
+	closing := bytes.LastIndexByte(obj, '}')
+	multiline := bytes.IndexByte(obj, '\n') >= 0
+	if multiline {
+		indent = lineIndent(obj, closing)
+	}
+	multiline = multiline || indent != ""
+	if start >= 0 {
+		if multiline {
+			value = indentJSON(value, indent+"  ")
+		}
+		return append(append(append([]byte{}, obj[:start]...), value...), obj[end:]...), nil
+	}
+	body := bytes.TrimRight(obj[:closing], " \t\r\n")
+	k, _ := json.Marshal(key)
+	var b bytes.Buffer
+	b.Write(body)
+	if body[len(body)-1] != '{' {
+		b.WriteByte(',')
+	}
+	if multiline {
+		b.WriteString("\n" + indent + "  ")
+		b.Write(k)
+		b.WriteString(": ")
+		b.Write(indentJSON(value, indent+"  "))
+		b.WriteString("\n" + indent)
+	} else {
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.Write(obj[closing:])
+	return b.Bytes(), nil
+}
+
+// lineIndent returns the leading whitespace of the line containing the `pos` byte
+func lineIndent(data []byte, pos int) string {
+	if pos < 0 {
+		return ""
+	}
+	i := bytes.LastIndexByte(data[:pos], '\n') + 1
+	j := i
+	for j < pos && (data[j] == ' ' || data[j] == '\t') {
+		j++
+	}
+	return string(data[i:j])
+}
+
+// indentJSON indents the valid JSON value, with `prefix` for the nested lines
+func indentJSON(value []byte, prefix string) []byte {
+	var b bytes.Buffer
+	if err := json.Indent(&b, value, prefix, "  "); err != nil {
+		return value
+	}
+	return b.Bytes()
+}
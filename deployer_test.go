@@ -0,0 +1,170 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"math/big"
+	"path"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/robert-zaremba/errstack"
+	"github.com/robert-zaremba/log15"
+	. "gopkg.in/check.v1"
+)
+
+const libName = "contracts/Lib.sol:Lib"
+
+type DeployerSuite struct {
+	ReceiptSuite
+	dir string
+}
+
+// libUserSchema is a contract which runtime code is: PUSH20 <Lib> STOP.
+// The constructor takes one uint256 argument.
+func libUserSchema() string {
+	placeholder := "__$" + hex.EncodeToString(crypto.Keccak256([]byte(libName)))[:34] + "$__"
+	runtime := "73" + placeholder + "00"
+	return `{
+  "contractName": "LibUser",
+  "abi": [{"type": "constructor", "inputs": [{"name": "x", "type": "uint256"}]}],
+  "bytecode": "0x601680600c6000396000f300` + runtime + `",
+  "deployedBytecode": "0x` + runtime + `",
+  "networks": {"1": {"address": "0x0000000000000000000000000000000000000001"}}
+}`
+}
+
+func (s *DeployerSuite) SetUpTest(c *C) {
+	s.ReceiptSuite.SetUpTest(c)
+	s.dir = c.MkDir()
+	c.Assert(ioutil.WriteFile(path.Join(s.dir, "LibUser.json"), []byte(libUserSchema()), 0600), IsNil)
+}
+
+func (s *DeployerSuite) deploy(c *C, d *Deployer, libs map[string]common.Address) (common.Address, *types.Receipt, errstack.E) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	done := make(chan struct{})
+	go func(sim *backends.SimulatedBackend) {
+		defer close(done)
+		for ctx.Err() == nil {
+			time.Sleep(20 * time.Millisecond)
+			sim.Commit()
+		}
+	}(s.sim)
+	defer func() {
+		cancel()
+		<-done
+	}()
+	return d.Deploy(ctx, "LibUser", libs, big.NewInt(7))
+}
+
+func (s *DeployerSuite) TestDeploy(c *C) {
+	sf, err := NewSchemaFactory(s.dir, 1337, log15.Root())
+	c.Assert(err, IsNil)
+	key := hex.EncodeToString(crypto.FromECDSA(s.key))
+	txrF, err := NewPrivKeyTxrFactory(key, nil)
+	c.Assert(err, IsNil)
+	txrF = NewFeeTxrFactory(txrF, FixedFee{GasPrice: big.NewInt(1e10)}, time.Second, log15.Root())
+	d := NewDeployer(s.sim, sf, txrF, 1, log15.Root())
+
+	_, _, err = s.deploy(c, d, nil)
+	c.Check(err, ErrorMatches, "Bytecode has unlinked libraries: __\\$.*")
+
+	lib := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	addr, receipt, err := s.deploy(c, d, map[string]common.Address{libName: lib})
+	c.Assert(err, IsNil)
+	c.Check(receipt.ContractAddress, Equals, addr)
+
+	sch, a, err := sf.ReadGetAddress("LibUser")
+	c.Assert(err, IsNil)
+	c.Check(a, Equals, addr)
+	c.Check(sch.Networks[1337].TransactionHash, Equals, receipt.TxHash.Hex())
+	c.Check(sch.Networks[1337].Links, DeepEquals, map[string]string{libName: lib.Hex()})
+	c.Check(sch.Networks[1].Address, Equals, "0x0000000000000000000000000000000000000001",
+		Commentf("other networks must be preserved"))
+	parsed, err := sch.ParsedABI()
+	c.Assert(err, IsNil)
+	c.Check(parsed.Constructor.Inputs, HasLen, 1)
+	c.Check(VerifyDeployment(context.Background(), s.sim, sch, 1337), IsNil)
+
+	_, _, err = d.Deploy(context.Background(), "Missing", nil)
+	c.Check(err, ErrorMatches, `Contract "Missing" truffle schema file not found.*`)
+}
+
+func (s *DeployerSuite) TestWriteNetwork(c *C) {
+	fn := path.Join(c.MkDir(), "X.json")
+	orig := `{
+  "contractName": "X",
+  "networks": {
+    "1": {
+      "address": "0x01"
+    }
+  },
+  "abi": [],
+  "updatedAt": "2020"
+}
+`
+	c.Assert(ioutil.WriteFile(fn, []byte(orig), 0600), IsNil)
+	d := &Deployer{sf: SchemaFactory{Network: 5}}
+	c.Assert(d.writeNetwork(fn, NetSchema{Address: "0x05"}), IsNil)
+	data, err := ioutil.ReadFile(fn)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, `{
+  "contractName": "X",
+  "networks": {
+    "1": {
+      "address": "0x01"
+    },
+    "5": {
+      "address": "0x05"
+    }
+  },
+  "abi": [],
+  "updatedAt": "2020"
+}
+`)
+
+	d.sf.Network = 1
+	c.Assert(d.writeNetwork(fn, NetSchema{Address: "0x11"}), IsNil)
+	data, err = ioutil.ReadFile(fn)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, `{
+  "contractName": "X",
+  "networks": {
+    "1": {
+      "address": "0x11"
+    },
+    "5": {
+      "address": "0x05"
+    }
+  },
+  "abi": [],
+  "updatedAt": "2020"
+}
+`)
+
+	// compact file without networks
+	c.Assert(ioutil.WriteFile(fn, []byte(`{"contractName":"X","abi":[]}`), 0600), IsNil)
+	c.Assert(d.writeNetwork(fn, NetSchema{Address: "0x11"}), IsNil)
+	data, err = ioutil.ReadFile(fn)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, `{"contractName":"X","abi":[],"networks":{"1":{"address":"0x11"}}}`)
+}
@@ -0,0 +1,459 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/robert-zaremba/errstack"
+	"github.com/robert-zaremba/ethdrv/wad"
+)
+
+// DynamicContract is a contract client driven by the ABI at runtime, for contracts
+// without abigen bindings. Method and event arguments are coerced to the ABI types
+// (see CoerceArgs).
+type DynamicContract struct {
+	Name    string
+	Address common.Address
+	ABI     abi.ABI
+
+	bc      *bind.BoundContract
+	decoder *EventDecoder
+}
+
+// DynamicEvent is a decoded contract event.
+type DynamicEvent struct {
+	Name string
+	Args map[string]interface{}
+	Raw  types.Log
+}
+
+// NewDynamicContract creates DynamicContract using the schema ABI and the address
+// of the contract deployed on the `networkID` network.
+func NewDynamicContract(s Schema, networkID int, backend bind.ContractBackend) (*DynamicContract, errstack.E) {
+	addr, err := s.Address(networkID)
+	if err != nil {
+		return nil, err
+	}
+	a, err := s.ParsedABI()
+	if err != nil {
+		return nil, err
+	}
+	if len(a.Methods) == 0 && len(a.Events) == 0 {
+		return nil, errstack.NewReqF("Contract %q schema doesn't have ABI", s.Name)
+	}
+	return &DynamicContract{s.Name, addr, a,
+		bind.NewBoundContract(addr, a, backend, backend, backend),
+		NewEventDecoder(a)}, nil
+}
+
+// Call calls the constant `method` and returns its unpacked outputs.
+// If the call reverts then *RevertError is returned.
+func (dc *DynamicContract) Call(ctx context.Context, method string, args ...interface{}) ([]interface{}, errstack.E) {
+	m, ok := dc.ABI.Methods[method]
+	if !ok {
+		return nil, errstack.NewReqF("Contract %q doesn't have %q method", dc.Name, method)
+	}
+	vals, err := CoerceArgs(m.Inputs, args)
+	if err != nil {
+		return nil, err
+	}
+	var out []interface{}
+	if errStd := dc.bc.Call(&bind.CallOpts{Context: ctx}, &out, method, vals...); errStd != nil {
+		if re, ok := AsRevertError(errStd, dc.ABI); ok {
+			return nil, re
+		}
+		return nil, errstack.WrapAsIOf(errStd, "Can't call %s.%s", dc.Name, method)
+	}
+	return out, nil
+}
+
+// Transact sends a transaction invoking the `method`. If the gas estimation fails
+// because the transaction reverts then *RevertError is returned.
+func (dc *DynamicContract) Transact(txo *bind.TransactOpts, method string, args ...interface{}) (*types.Transaction, errstack.E) {
+	m, ok := dc.ABI.Methods[method]
+	if !ok {
+		return nil, errstack.NewReqF("Contract %q doesn't have %q method", dc.Name, method)
+	}
+	vals, err := CoerceArgs(m.Inputs, args)
+	if err != nil {
+		return nil, err
+	}
+	tx, errStd := dc.bc.Transact(txo, method, vals...)
+	if errStd != nil {
+		if re, ok := AsRevertError(errStd, dc.ABI); ok {
+			return nil, re
+		}
+		return nil, errstack.WrapAsIOf(errStd, "Can't transact %s.%s", dc.Name, method)
+	}
+	return tx, nil
+}
+
+// Filter returns past `event` logs. `query` filters the indexed event arguments:
+// the n-th element lists accepted values of the n-th indexed argument.
+func (dc *DynamicContract) Filter(opts *bind.FilterOpts, eventName string, query ...[]interface{}) ([]DynamicEvent, errstack.E) {
+	q, err := dc.query(eventName, query)
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &bind.FilterOpts{}
+	}
+	logs, sub, errStd := dc.bc.FilterLogs(opts, eventName, q...)
+	if errStd != nil {
+		return nil, errstack.WrapAsIOf(errStd, "Can't filter %s.%s events", dc.Name, eventName)
+	}
+	defer sub.Unsubscribe()
+	var evs []DynamicEvent
+	add := func(l types.Log) errstack.E {
+		ev, err := dc.Decode(l)
+		evs = append(evs, ev)
+		return err
+	}
+	for {
+		select {
+		case l := <-logs:
+			if err := add(l); err != nil {
+				return nil, err
+			}
+		case errStd = <-sub.Err():
+			if errStd != nil {
+				return nil, errstack.WrapAsIOf(errStd, "Can't filter %s.%s events", dc.Name, eventName)
+			}
+			for { // drain buffered logs
+				select {
+				case l := <-logs:
+					if err := add(l); err != nil {
+						return nil, err
+					}
+				default:
+					return evs, nil
+				}
+			}
+		}
+	}
+}
+
+// Watch subscribes to new `event` logs and sends them decoded to the `sink`.
+// See Filter for the `query` description.
+func (dc *DynamicContract) Watch(opts *bind.WatchOpts, eventName string, sink chan<- DynamicEvent,
+	query ...[]interface{}) (event.Subscription, errstack.E) {
+	q, err := dc.query(eventName, query)
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &bind.WatchOpts{}
+	}
+	logs, sub, errStd := dc.bc.WatchLogs(opts, eventName, q...)
+	if errStd != nil {
+		return nil, errstack.WrapAsIOf(errStd, "Can't watch %s.%s events", dc.Name, eventName)
+	}
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case l := <-logs:
+				ev, err := dc.Decode(l)
+				if err != nil {
+					return err
+				}
+				select {
+				case sink <- ev:
+				case err := <-sub.Err():
+					return err
+				case <-quit:
+					return nil
+				}
+			case err := <-sub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}), nil
+}
+
+// Topics returns the log filter topics of the `event` logs, eg for Backfill or
+// SubscribeSimple. See Filter for the `query` description.
+func (dc *DynamicContract) Topics(eventName string, query ...[]interface{}) ([][]common.Hash, errstack.E) {
+	q, err := dc.query(eventName, query)
+	if err != nil {
+		return nil, err
+	}
+	topics, errStd := abi.MakeTopics(q...)
+	if errStd != nil {
+		return nil, errstack.WrapAsReq(errStd, "Invalid "+eventName+" filter")
+	}
+	return append([][]common.Hash{{dc.ABI.Events[eventName].ID}}, topics...), nil
+}
+
+// Decode decodes the contract event log.
+func (dc *DynamicContract) Decode(l types.Log) (DynamicEvent, errstack.E) {
+	ev := DynamicEvent{Raw: l}
+	e, err := dc.decoder.Event(l)
+	if err != nil {
+		return ev, err
+	}
+	ev.Name = e.Name
+	ev.Args, err = dc.decoder.DecodeMap(l)
+	return ev, err
+}
+
+// query coerces the indexed arguments filter values
+func (dc *DynamicContract) query(eventName string, query [][]interface{}) ([][]interface{}, errstack.E) {
+	e, ok := dc.ABI.Events[eventName]
+	if !ok {
+		return nil, errstack.NewReqF("Contract %q doesn't have %q event", dc.Name, eventName)
+	}
+	var indexed abi.Arguments
+	for _, arg := range e.Inputs {
+		if arg.Indexed {
+			indexed = append(indexed, arg)
+		}
+	}
+	if len(query) > len(indexed) {
+		return nil, errstack.NewReqF("Event %q has %d indexed arguments, got %d filters",
+			eventName, len(indexed), len(query))
+	}
+	q := make([][]interface{}, len(query))
+	for i, vals := range query {
+		for _, v := range vals {
+			cv, err := CoerceArg(indexed[i].Type, v)
+			if err != nil {
+				return nil, errstack.WrapAsReq(err, "Invalid "+indexed[i].Name+" filter")
+			}
+			q[i] = append(q[i], cv)
+		}
+	}
+	return q, nil
+}
+
+// CoerceArgs converts `values` to the Go types of the ABI arguments. See CoerceArg.
+func CoerceArgs(args abi.Arguments, values []interface{}) ([]interface{}, errstack.E) {
+	if len(args) != len(values) {
+		return nil, errstack.NewReqF("Expected %d arguments, got %d", len(args), len(values))
+	}
+	out := make([]interface{}, len(values))
+	for i, v := range values {
+		var err error
+		if out[i], err = CoerceArg(args[i].Type, v); err != nil {
+			name := args[i].Name
+			if name == "" {
+				name = strconv.Itoa(i)
+			}
+			return nil, errstack.WrapAsReq(err, "Invalid argument "+name)
+		}
+	}
+	return out, nil
+}
+
+// CoerceArg converts the value to the Go type of the ABI type. Values of the right
+// type are returned as is. Otherwise values are converted from strings or decoded JSON:
+//   - address: hex string with 0x prefix (see ParseAddress)
+//   - integers: decimal or 0x prefixed hex string, or JSON number. Amounts with the
+//     "ether" suffix are converted to wei using wad.AfToWei, eg "1.5ether".
+//   - bool: strconv.ParseBool formats
+//   - bytes, fixed bytes: 0x prefixed hex string
+//   - arrays, slices: JSON array (or a JSON string of it)
+//   - tuples: JSON object with the component names (or a JSON string of it) or array
+func CoerceArg(t abi.Type, v interface{}) (interface{}, error) {
+	goType := t.GetType()
+	if v != nil && reflect.TypeOf(v) == goType {
+		return v, nil
+	}
+	if n, ok := v.(json.Number); ok {
+		v = n.String()
+	}
+	s, isStr := v.(string)
+	switch t.T {
+	case abi.AddressTy:
+		if !isStr {
+			break
+		}
+		return ParseAddress(s)
+	case abi.IntTy, abi.UintTy:
+		n, err := toBigInt(v)
+		if err != nil {
+			return nil, err
+		}
+		return convertInt(t, n)
+	case abi.BoolTy:
+		if isStr {
+			return strconv.ParseBool(s)
+		}
+	case abi.StringTy:
+		if isStr {
+			return s, nil
+		}
+	case abi.BytesTy:
+		if isStr {
+			return hexutil.Decode(s)
+		}
+	case abi.FixedBytesTy:
+		if !isStr {
+			break
+		}
+		b, err := hexutil.Decode(s)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) != t.Size {
+			return nil, fmt.Errorf("expected %d bytes, got %d", t.Size, len(b))
+		}
+		out := reflect.New(goType).Elem()
+		reflect.Copy(out, reflect.ValueOf(b))
+		return out.Interface(), nil
+	case abi.SliceTy, abi.ArrayTy:
+		if isStr {
+			if err := json.Unmarshal([]byte(s), &v); err != nil {
+				return nil, fmt.Errorf("expected JSON array: %v", err)
+			}
+		}
+		rv := reflect.ValueOf(v)
+		if v == nil || (rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array) {
+			break
+		}
+		if t.T == abi.ArrayTy && rv.Len() != t.Size {
+			return nil, fmt.Errorf("expected %d elements, got %d", t.Size, rv.Len())
+		}
+		out := reflect.New(goType).Elem()
+		if t.T == abi.SliceTy {
+			out = reflect.MakeSlice(goType, rv.Len(), rv.Len())
+		}
+		for i := 0; i < rv.Len(); i++ {
+			e, err := CoerceArg(*t.Elem, rv.Index(i).Interface())
+			if err != nil {
+				return nil, fmt.Errorf("element %d: %v", i, err)
+			}
+			out.Index(i).Set(reflect.ValueOf(e))
+		}
+		return out.Interface(), nil
+	case abi.TupleTy:
+		if isStr {
+			if err := json.Unmarshal([]byte(s), &v); err != nil {
+				return nil, fmt.Errorf("expected JSON object: %v", err)
+			}
+		}
+		return coerceTuple(t, v)
+	}
+	return nil, fmt.Errorf("can't convert %T to %s", v, t.String())
+}
+
+func coerceTuple(t abi.Type, v interface{}) (interface{}, error) {
+	out := reflect.New(t.GetType()).Elem()
+	switch vals := v.(type) {
+	case map[string]interface{}:
+		for i, name := range t.TupleRawNames {
+			fv, ok := vals[name]
+			if !ok {
+				return nil, fmt.Errorf("missing %q component", name)
+			}
+			e, err := CoerceArg(*t.TupleElems[i], fv)
+			if err != nil {
+				return nil, fmt.Errorf("component %q: %v", name, err)
+			}
+			out.Field(i).Set(reflect.ValueOf(e))
+		}
+	case []interface{}:
+		if len(vals) != len(t.TupleElems) {
+			return nil, fmt.Errorf("expected %d components, got %d", len(t.TupleElems), len(vals))
+		}
+		for i, fv := range vals {
+			e, err := CoerceArg(*t.TupleElems[i], fv)
+			if err != nil {
+				return nil, fmt.Errorf("component %d: %v", i, err)
+			}
+			out.Field(i).Set(reflect.ValueOf(e))
+		}
+	default:
+		return nil, fmt.Errorf("can't convert %T to %s", v, t.String())
+	}
+	return out.Interface(), nil
+}
+
+func toBigInt(v interface{}) (*big.Int, error) {
+	switch x := v.(type) {
+	case *big.Int:
+		return x, nil
+	case float64: // JSON number
+		if x != math.Trunc(x) || math.Abs(x) > 1<<53 {
+			return nil, fmt.Errorf("number %v is not an exact integer, use a string", x)
+		}
+		return big.NewInt(int64(x)), nil
+	case string:
+		s := strings.TrimSpace(x)
+		if amount := strings.TrimSuffix(s, "ether"); amount != s {
+			errb := errstack.NewBuilder()
+			n := wad.AfToWei(strings.TrimSpace(amount), errb.Putter("amount"))
+			if errb.NotNil() {
+				return nil, errb.ToReqErr()
+			}
+			return n, nil
+		}
+		n, ok := new(big.Int).SetString(s, 0)
+		if !ok {
+			return nil, fmt.Errorf("invalid integer %q", x)
+		}
+		return n, nil
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return big.NewInt(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return new(big.Int).SetUint64(rv.Uint()), nil
+	}
+	return nil, fmt.Errorf("can't convert %T to integer", v)
+}
+
+// convertInt checks the integer range and converts it to the ABI Go type
+func convertInt(t abi.Type, n *big.Int) (interface{}, error) {
+	if t.T == abi.UintTy && n.Sign() < 0 {
+		return nil, fmt.Errorf("%s can't be negative", t.String())
+	}
+	bits := n.BitLen()
+	if t.T == abi.IntTy {
+		bits++ // sign bit
+		if n.Sign() < 0 && new(big.Int).Add(n, common.Big1).BitLen() < n.BitLen() {
+			bits-- // -2^(k-1) fits in k bits
+		}
+	}
+	if bits > t.Size {
+		return nil, fmt.Errorf("%s overflows %s", n, t.String())
+	}
+	goType := t.GetType()
+	if goType == reflect.TypeOf(n) {
+		return n, nil
+	}
+	if t.T == abi.IntTy {
+		return reflect.ValueOf(n.Int64()).Convert(goType).Interface(), nil
+	}
+	return reflect.ValueOf(n.Uint64()).Convert(goType).Interface(), nil
+}
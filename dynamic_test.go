@@ -0,0 +1,168 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/robert-zaremba/log15"
+	. "gopkg.in/check.v1"
+)
+
+const echoABI = `[
+  {"type": "function", "name": "echo", "stateMutability": "view",
+    "inputs": [{"name": "amount", "type": "uint256"}], "outputs": [{"name": "", "type": "uint256"}]},
+  {"type": "function", "name": "setOwner", "stateMutability": "nonpayable",
+    "inputs": [{"name": "owner", "type": "address"}], "outputs": []},
+  {"type": "event", "name": "Echo", "anonymous": false, "inputs": [
+    {"name": "from", "type": "address", "indexed": true},
+    {"name": "value", "type": "uint256", "indexed": false}]}
+]`
+
+// echoCode is a contract creation code. For any call the contract emits
+// Echo(msg.sender, <first argument>) and returns the first argument.
+func echoCode() []byte {
+	id := crypto.Keccak256([]byte("Echo(address,uint256)"))
+	runtime := "6020600460003733" + "7f" + hex.EncodeToString(id) + "60206000a2" + "60206000f3"
+	code, err := hex.DecodeString("603380600c6000396000f300" + runtime)
+	if err != nil {
+		panic(err)
+	}
+	return code
+}
+
+type DynamicSuite struct {
+	ReceiptSuite
+	dc *DynamicContract
+}
+
+// deployEcho deploys the echo contract and sets `s.dc`
+func (s *DynamicSuite) deployEcho(c *C) {
+	s.sendTx(c, 0, echoCode())
+	s.sim.Commit()
+	schema := Schema{Name: "Echo", ABI: json.RawMessage(echoABI), Networks: map[int]NetSchema{
+		1337: {Address: crypto.CreateAddress(s.addr, 0).Hex()}}}
+	var err error
+	s.dc, err = NewDynamicContract(schema, 1337, s.sim)
+	c.Assert(err, IsNil)
+}
+
+func (s *DynamicSuite) TestCall(c *C) {
+	s.deployEcho(c)
+	ctx := context.Background()
+	out, err := s.dc.Call(ctx, "echo", "1.5ether")
+	c.Assert(err, IsNil)
+	c.Check(out, DeepEquals, []interface{}{big.NewInt(15e17)})
+	out, err = s.dc.Call(ctx, "echo", json.Number("0x10"))
+	c.Assert(err, IsNil)
+	c.Check(out, DeepEquals, []interface{}{big.NewInt(16)})
+
+	_, err = s.dc.Call(ctx, "echo", "-1")
+	c.Check(err, ErrorMatches, "Invalid argument amount.*")
+	_, err = s.dc.Call(ctx, "echo")
+	c.Check(err, ErrorMatches, "Expected 1 arguments, got 0")
+	_, err = s.dc.Call(ctx, "missing")
+	c.Check(err, ErrorMatches, `Contract "Echo" doesn't have "missing" method`)
+}
+
+func (s *DynamicSuite) TestTransactFilterWatch(c *C) {
+	s.deployEcho(c)
+	key := hex.EncodeToString(crypto.FromECDSA(s.key))
+	txrF, err := NewPrivKeyTxrFactory(key, nil)
+	c.Assert(err, IsNil)
+	txrF = NewFeeTxrFactory(txrF, FixedFee{GasPrice: big.NewInt(1e10), GasLimit: 100000}, time.Second, log15.Root())
+
+	sink := make(chan DynamicEvent, 1)
+	sub, errW := s.dc.Watch(nil, "Echo", sink, []interface{}{s.addr.Hex()})
+	c.Assert(errW, IsNil)
+	defer sub.Unsubscribe()
+
+	owner := "0x00000000000000000000000000000000000000aa"
+	_, errTx := s.dc.Transact(txrF.Txo(), "setOwner", owner)
+	c.Assert(errTx, IsNil)
+	s.sim.Commit()
+
+	evs, errF := s.dc.Filter(nil, "Echo", []interface{}{s.addr.Hex()})
+	c.Assert(errF, IsNil)
+	c.Assert(evs, HasLen, 1)
+	c.Check(evs[0].Name, Equals, "Echo")
+	c.Check(evs[0].Args, DeepEquals, map[string]interface{}{"from": s.addr, "value": big.NewInt(0xaa)})
+
+	evs, errF = s.dc.Filter(nil, "Echo", []interface{}{owner})
+	c.Assert(errF, IsNil)
+	c.Check(evs, HasLen, 0)
+	_, errF = s.dc.Filter(nil, "Echo", []interface{}{"0x12"})
+	c.Check(errF, ErrorMatches, "Invalid from filter.*")
+
+	select {
+	case ev := <-sink:
+		c.Check(ev.Args["value"], DeepEquals, big.NewInt(0xaa))
+	case <-time.After(time.Second):
+		c.Error("Event not received")
+	}
+}
+
+func (s *DynamicSuite) TestCoerceArg(c *C) {
+	mustType := func(t string, components ...abi.ArgumentMarshaling) abi.Type {
+		typ, err := abi.NewType(t, "", components)
+		c.Assert(err, IsNil)
+		return typ
+	}
+	tuple := []abi.ArgumentMarshaling{{Name: "to", Type: "address"}, {Name: "amount", Type: "uint64"}}
+	cases := []struct {
+		typ      abi.Type
+		in       interface{}
+		expected interface{}
+	}{
+		{mustType("uint8"), "255", uint8(255)},
+		{mustType("int8"), float64(-128), int8(-128)},
+		{mustType("int256"), "-0x10", big.NewInt(-16)},
+		{mustType("bool"), "true", true},
+		{mustType("bytes"), "0x0102", []byte{1, 2}},
+		{mustType("bytes2"), "0x0102", [2]byte{1, 2}},
+		{mustType("address[]"), `["0x0000000000000000000000000000000000000001"]`,
+			[]common.Address{common.HexToAddress("0x01")}},
+		{mustType("uint16[2]"), []interface{}{"1", float64(2)}, [2]uint16{1, 2}},
+	}
+	for _, tc := range cases {
+		v, err := CoerceArg(tc.typ, tc.in)
+		c.Check(err, IsNil, Commentf("%s %v", tc.typ, tc.in))
+		c.Check(v, DeepEquals, tc.expected, Commentf("%s %v", tc.typ, tc.in))
+	}
+
+	v, err := CoerceArg(mustType("tuple", tuple...), `{"to": "0x0000000000000000000000000000000000000002", "amount": 3}`)
+	c.Assert(err, IsNil)
+	c.Check(v, DeepEquals, struct {
+		To     common.Address `json:"to"`
+		Amount uint64         `json:"amount"`
+	}{common.HexToAddress("0x02"), 3})
+
+	for _, tc := range []struct {
+		typ string
+		in  interface{}
+	}{{"uint8", "256"}, {"int8", "-129"}, {"uint256", float64(1.5)}, {"bytes2", "0x01"},
+		{"uint16[2]", "[1]"}, {"address", "0x12"}, {"bool", 1}} {
+		_, err := CoerceArg(mustType(tc.typ), tc.in)
+		c.Check(err, NotNil, Commentf("%s %v", tc.typ, tc.in))
+	}
+}
@@ -42,9 +42,10 @@ func SubscribeSimple(ctx context.Context,
 
 // UnmarshalEvent blockchain log into the event structure
 // `dest` must be a pointer to initialized structure
+// Only non-indexed arguments are decoded. Use EventDecoder to decode topics as well.
 func UnmarshalEvent(dest interface{}, data []byte, e abi.Event) errstack.E {
 	a := abi.ABI{Events: map[string]abi.Event{"e": e}}
-	err := a.Unpack(dest, "e", data)
+	err := a.UnpackIntoInterface(dest, "e", data)
 	return errstack.WrapAsDomain(err,
 		"Probably the ABI doesn't match the contract version")
 }
@@ -16,7 +16,8 @@
 package cf
 
 import (
-	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"time"
+
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/robert-zaremba/errstack"
@@ -32,75 +33,23 @@ const (
 // ContractFactory delivers methods to easily construct contracts
 type ContractFactory interface {
 	GetSWC() (*SweetToken, common.Address, errstack.E)
-
-	ethdrv.TxrFactory
+	ethdrv.ContractFactory
+	// TxoE creates transaction options with a nonce reserved by ethdrv.NonceManager
+	ethdrv.TxoCreator
 }
 
 type contractFactory struct {
-	client    *ethclient.Client
-	sf        ethdrv.SchemaFactory
-	txrF      ethdrv.TxrFactory
-	isTestRPC bool
-
-	addrs map[string]common.Address
+	*ethdrv.ContractRegistry
 }
 
 // NewContractFactory is a default contract provider based on truffle schema files.
 func NewContractFactory(c *ethclient.Client, sf ethdrv.SchemaFactory, txrF ethdrv.TxrFactory, isTestRPC bool) ContractFactory {
-	return contractFactory{c, sf, txrF, isTestRPC,
-		map[string]common.Address{}}
-}
-
-// Txo implements TxrFactory interface
-func (cf contractFactory) Txo() *bind.TransactOpts {
-	txo := cf.txrF.Txo()
-	// nonce, err := cf.client.PendingNonceAt(context.TODO(), txo.From)
-	// logger.Info("nonce", "val", nonce)
-	// if err != nil {
-	// 	logger.Error("Can't get pending nonce", err)
-	// 	txo.Nonce = big.NewInt(1)
-	// 	return txo
-	// }
-	// if !cf.isTestRPC {
-	// 	nonce++
-	// }
-	// txo.Nonce = big.NewInt(int64(nonce))
-
-	return txo
-}
-
-// Addr returns signer address
-func (cf contractFactory) Addr() common.Address {
-	return cf.txrF.Addr()
-}
-
-func (cf contractFactory) getSchemaAddres(contractName string) (common.Address, errstack.E) {
-	if addr, ok := cf.addrs[contractName]; ok {
-		return addr, nil
-	}
-	_, addr, err := cf.sf.ReadGetAddress(contractName)
-	if err != nil {
-		return addr, err
-	}
-	cf.addrs[contractName] = addr
-	return addr, nil
-}
-
-func (cf contractFactory) GetSWC() (c *SweetToken, addr common.Address, err errstack.E) {
-	addr, err = cf.mkContract(CtrSWC, func(addr common.Address) (err2 error) {
-		c, err2 = NewSweetToken(addr, cf.client)
-		return err2
-	})
-	return
+	nonces := ethdrv.NewNonceTxrFactory(txrF, ethdrv.NewNonceManager(c), 10*time.Second)
+	r := ethdrv.NewContractRegistry(c, sf, nonces, isTestRPC)
+	ethdrv.Register(r, CtrSWC, NewSweetToken)
+	return contractFactory{r}
 }
 
-func (cf contractFactory) mkContract(ctrName string, constructor func(common.Address) error) (common.Address, errstack.E) {
-	addr, errE := cf.getSchemaAddres(ctrName)
-	if errE != nil {
-		return addr, errE
-	}
-	if err := constructor(addr); err != nil {
-		return addr, errstack.WrapAsIOf(err, "Can't construct %s contract instance", ctrName)
-	}
-	return addr, nil
+func (cf contractFactory) GetSWC() (*SweetToken, common.Address, errstack.E) {
+	return ethdrv.Get[SweetToken](cf.ContractRegistry, CtrSWC)
 }
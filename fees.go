@@ -0,0 +1,282 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"math/big"
+	"sort"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/robert-zaremba/errstack"
+	"github.com/robert-zaremba/log15"
+)
+
+// FeeStrategy sets gas price (or EIP-1559 tip and fee cap) in transaction options.
+type FeeStrategy interface {
+	Apply(ctx context.Context, txo *bind.TransactOpts) errstack.E
+}
+
+// GasPricer provides gas price suggested by the node.
+type GasPricer interface {
+	SuggestGasPrice(ctx context.Context) (*big.Int, error)
+}
+
+// BlockReader provides access to blocks.
+type BlockReader interface {
+	BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error)
+}
+
+// FeeHistoryReader provides access to `eth_feeHistory` API.
+type FeeHistoryReader interface {
+	FeeHistory(ctx context.Context, blockCount uint64, lastBlock *big.Int, rewardPercentiles []float64) (*ethereum.FeeHistory, error)
+}
+
+// FixedFee sets a constant gas price and, if not zero, gas limit.
+type FixedFee struct {
+	GasPrice *big.Int
+	GasLimit uint64
+}
+
+// Apply implements FeeStrategy interface
+func (f FixedFee) Apply(ctx context.Context, txo *bind.TransactOpts) errstack.E {
+	if f.GasPrice == nil {
+		return errstack.NewReq("FixedFee GasPrice is not set")
+	}
+	txo.GasPrice = new(big.Int).Set(f.GasPrice)
+	if f.GasLimit != 0 {
+		txo.GasLimit = f.GasLimit
+	}
+	return nil
+}
+
+// SuggestedFee sets the gas price suggested by the node multiplied by `Multiplier`
+// (1 is used when zero) and limited to `Max` (if not nil).
+type SuggestedFee struct {
+	Backend    GasPricer
+	Multiplier float64
+	Max        *big.Int
+}
+
+// Apply implements FeeStrategy interface
+func (f SuggestedFee) Apply(ctx context.Context, txo *bind.TransactOpts) errstack.E {
+	p, err := f.Backend.SuggestGasPrice(ctx)
+	if err != nil {
+		return errstack.WrapAsIO(err, "Can't get suggested gas price")
+	}
+	txo.GasPrice = capFee(mulFee(p, f.Multiplier), f.Max)
+	return nil
+}
+
+// PercentileFee sets the gas price to the `Percentile` (0-100) of gas prices paid
+// by transactions in the last `Blocks` blocks, multiplied by `Multiplier` (1 is used
+// when zero) and limited to `Max` (if not nil). If there are no transactions in these
+// blocks, then `Min` is used.
+type PercentileFee struct {
+	Backend    BlockReader
+	Blocks     int
+	Percentile float64
+	Multiplier float64
+	Min        *big.Int
+	Max        *big.Int
+}
+
+// Apply implements FeeStrategy interface
+func (f PercentileFee) Apply(ctx context.Context, txo *bind.TransactOpts) errstack.E {
+	head, err := f.Backend.BlockByNumber(ctx, nil)
+	if err != nil {
+		return errstack.WrapAsIO(err, "Can't get the latest block")
+	}
+	var prices []*big.Int
+	b := head
+	for i := 0; i < f.Blocks && b != nil; i++ {
+		for _, tx := range b.Transactions() {
+			prices = append(prices, effectiveGasPrice(tx, b.BaseFee()))
+		}
+		if b.NumberU64() == 0 {
+			break
+		}
+		b, err = f.Backend.BlockByNumber(ctx, new(big.Int).SetUint64(b.NumberU64()-1))
+		if err != nil {
+			return errstack.WrapAsIOf(err, "Can't get block %d", head.NumberU64()-uint64(i)-1)
+		}
+	}
+	p := percentile(prices, f.Percentile)
+	if p == nil {
+		if f.Min == nil {
+			return errstack.NewDomain("No transactions in recent blocks and Min gas price is not set")
+		}
+		p = f.Min
+	}
+	txo.GasPrice = capFee(mulFee(p, f.Multiplier), f.Max)
+	return nil
+}
+
+// EIP1559Fee sets the EIP-1559 tip and fee cap using the `eth_feeHistory` of the last
+// `Blocks` blocks. The tip is the average of `RewardPercentile` (0-100) rewards, and the
+// fee cap is the next block base fee multiplied by `BaseFeeMultiplier` (2 is used when
+// zero) plus the tip. Both are limited by `MaxTip` and `MaxFeeCap` (if not nil).
+// Apply fails if the next block base fee is above `MaxFeeCap`, because such transaction
+// couldn't be mined.
+type EIP1559Fee struct {
+	Backend           FeeHistoryReader
+	Blocks            uint64
+	RewardPercentile  float64
+	BaseFeeMultiplier float64
+	MaxTip            *big.Int
+	MaxFeeCap         *big.Int
+}
+
+// Apply implements FeeStrategy interface
+func (f EIP1559Fee) Apply(ctx context.Context, txo *bind.TransactOpts) errstack.E {
+	h, err := f.Backend.FeeHistory(ctx, f.Blocks, nil, []float64{f.RewardPercentile})
+	if err != nil {
+		return errstack.WrapAsIO(err, "Can't get fee history")
+	}
+	if len(h.BaseFee) == 0 {
+		return errstack.NewDomain("Empty fee history")
+	}
+	var tip = new(big.Int)
+	var n int64
+	for _, r := range h.Reward {
+		if len(r) != 0 && r[0] != nil {
+			tip.Add(tip, r[0])
+			n++
+		}
+	}
+	if n != 0 {
+		tip.Div(tip, big.NewInt(n))
+	}
+	tip = capFee(tip, f.MaxTip)
+	baseFee := h.BaseFee[len(h.BaseFee)-1]
+	if f.MaxFeeCap != nil && baseFee.Cmp(f.MaxFeeCap) > 0 {
+		return errstack.NewDomainF("Next block base fee %s is above MaxFeeCap %s", baseFee, f.MaxFeeCap)
+	}
+	m := f.BaseFeeMultiplier
+	if m == 0 {
+		m = 2
+	}
+	feeCap := mulFee(baseFee, m)
+	feeCap = capFee(feeCap.Add(feeCap, tip), f.MaxFeeCap)
+	if feeCap.Cmp(tip) < 0 {
+		tip = new(big.Int).Set(feeCap)
+	}
+	txo.GasPrice = nil
+	txo.GasTipCap = tip
+	txo.GasFeeCap = feeCap
+	return nil
+}
+
+type feeTxrFactory struct {
+	TxrFactory
+	fs      FeeStrategy
+	timeout time.Duration
+	logger  log15.Logger
+}
+
+// NewFeeTxrFactory wraps TxrFactory to return transaction options with fees set by the
+// FeeStrategy. The returned TxrFactory is a TxoCreator: `TxoE` returns an error if the
+// strategy fails. `Txo` logs the error and returns options which fail to sign
+// transactions, so they are never sent with fees picked by the contract binding.
+func NewFeeTxrFactory(txrF TxrFactory, fs FeeStrategy, timeout time.Duration, logger log15.Logger) TxrFactory {
+	return feeTxrFactory{txrF, fs, timeout, logger}
+}
+
+func (tf feeTxrFactory) unwrapTxrFactory() TxrFactory {
+	return tf.TxrFactory
+}
+
+// Txo implements TxrFactory interface
+func (tf feeTxrFactory) Txo() *bind.TransactOpts {
+	txo, err := tf.TxoE()
+	if err != nil {
+		tf.logger.Error("Can't set transaction fees", "address", tf.Addr().Hex(), "err", err)
+		return failedTxo(baseTxrFactory(tf.TxrFactory).Txo(), err)
+	}
+	return txo
+}
+
+// TxoE implements TxoCreator interface. It creates transaction options with fees set
+// by the FeeStrategy.
+func (tf feeTxrFactory) TxoE() (*bind.TransactOpts, errstack.E) {
+	txo, err := NewTxo(tf.TxrFactory)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tf.timeout)
+	defer cancel()
+	if err = tf.fs.Apply(ctx, txo); err != nil {
+		if errD := TxDone(ctx, tf.TxrFactory, txo, err); errD != nil {
+			tf.logger.Error("Can't release transaction options", "address", txo.From.Hex(), "err", errD)
+		}
+		return nil, err
+	}
+	return txo, nil
+}
+
+// Done implements TxoCreator interface
+func (tf feeTxrFactory) Done(ctx context.Context, txo *bind.TransactOpts, err error) errstack.E {
+	return TxDone(ctx, tf.TxrFactory, txo, err)
+}
+
+// effectiveGasPrice returns the gas price paid by the transaction
+func effectiveGasPrice(tx *types.Transaction, baseFee *big.Int) *big.Int {
+	if baseFee == nil || tx.Type() == types.LegacyTxType {
+		return tx.GasPrice()
+	}
+	p := new(big.Int).Add(baseFee, tx.GasTipCap())
+	if p.Cmp(tx.GasFeeCap()) > 0 {
+		return tx.GasFeeCap()
+	}
+	return p
+}
+
+// percentile returns p-th (0-100) percentile of values or nil if values are empty.
+// The values slice is sorted in place.
+func percentile(values []*big.Int, p float64) *big.Int {
+	if len(values) == 0 {
+		return nil
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Cmp(values[j]) < 0 })
+	i := int(float64(len(values)-1) * p / 100)
+	if i < 0 {
+		i = 0
+	} else if i >= len(values) {
+		i = len(values) - 1
+	}
+	return values[i]
+}
+
+// mulFee returns a new value of x*m. If m is zero, then x is not multiplied.
+func mulFee(x *big.Int, m float64) *big.Int {
+	if m == 0 || m == 1 {
+		return new(big.Int).Set(x)
+	}
+	f := new(big.Float).SetInt(x)
+	r, _ := f.Mul(f, big.NewFloat(m)).Int(nil)
+	return r
+}
+
+// capFee returns min(x, max). Nil max means no ceiling.
+func capFee(x, max *big.Int) *big.Int {
+	if max != nil && x.Cmp(max) > 0 {
+		return new(big.Int).Set(max)
+	}
+	return x
+}
@@ -0,0 +1,231 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	. "github.com/robert-zaremba/checkers"
+	"github.com/robert-zaremba/log15"
+	. "gopkg.in/check.v1"
+)
+
+type fakeFeeBackend struct {
+	price   *big.Int
+	history *ethereum.FeeHistory
+	blocks  []*types.Block
+}
+
+func (b fakeFeeBackend) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	return b.price, nil
+}
+
+func (b fakeFeeBackend) FeeHistory(ctx context.Context, blockCount uint64, lastBlock *big.Int, rewardPercentiles []float64) (*ethereum.FeeHistory, error) {
+	return b.history, nil
+}
+
+func (b fakeFeeBackend) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	if number == nil {
+		return b.blocks[len(b.blocks)-1], nil
+	}
+	return b.blocks[number.Int64()], nil
+}
+
+// mkBlocks creates a chain of blocks with legacy transactions paying `prices`
+func mkBlocks(prices ...[]int64) []*types.Block {
+	var blocks []*types.Block
+	for i, ps := range prices {
+		var txs []*types.Transaction
+		for j, p := range ps {
+			txs = append(txs, types.NewTransaction(uint64(j), common.Address{}, nil, 21000, big.NewInt(p), nil))
+		}
+		h := &types.Header{Number: big.NewInt(int64(i))}
+		blocks = append(blocks, types.NewBlockWithHeader(h).WithBody(txs, nil))
+	}
+	return blocks
+}
+
+type FeesSuite struct{}
+
+func (s FeesSuite) TestFixedFee(c *C) {
+	txo := &bind.TransactOpts{GasLimit: 50000}
+	c.Assert(FixedFee{GasPrice: big.NewInt(10)}.Apply(context.Background(), txo), IsNil)
+	c.Check(txo.GasPrice.Int64(), Equals, int64(10))
+	c.Check(txo.GasLimit, Equals, uint64(50000), Comment("zero GasLimit must not override options"))
+
+	c.Assert(FixedFee{GasPrice: big.NewInt(20), GasLimit: 90000}.Apply(context.Background(), txo), IsNil)
+	c.Check(txo.GasPrice.Int64(), Equals, int64(20))
+	c.Check(txo.GasLimit, Equals, uint64(90000))
+
+	c.Check(FixedFee{}.Apply(context.Background(), txo), ErrorMatches, ".*GasPrice is not set")
+}
+
+func (s FeesSuite) TestPercentileFee(c *C) {
+	b := fakeFeeBackend{blocks: mkBlocks([]int64{100}, []int64{10, 50}, []int64{30, 20})}
+	var cases = []struct {
+		fee      PercentileFee
+		expected int64
+	}{
+		{PercentileFee{Backend: b, Blocks: 1, Percentile: 100}, 30},
+		{PercentileFee{Backend: b, Blocks: 2, Percentile: 50}, 20},
+		{PercentileFee{Backend: b, Blocks: 10, Percentile: 100}, 100},
+		{PercentileFee{Backend: b, Blocks: 2, Percentile: 0, Multiplier: 2}, 20},
+		{PercentileFee{Backend: b, Blocks: 10, Percentile: 100, Max: big.NewInt(60)}, 60},
+	}
+	for i, tc := range cases {
+		txo := &bind.TransactOpts{}
+		c.Assert(tc.fee.Apply(context.Background(), txo), IsNil)
+		c.Check(txo.GasPrice.Int64(), Equals, tc.expected, Commentf("case %d", i))
+	}
+
+	b = fakeFeeBackend{blocks: mkBlocks(nil, nil)}
+	txo := &bind.TransactOpts{}
+	c.Check(PercentileFee{Backend: b, Blocks: 2}.Apply(context.Background(), txo), NotNil)
+	c.Assert(PercentileFee{Backend: b, Blocks: 2, Min: big.NewInt(7)}.Apply(context.Background(), txo), IsNil)
+	c.Check(txo.GasPrice.Int64(), Equals, int64(7))
+}
+
+func (s FeesSuite) TestSuggestedFee(c *C) {
+	b := fakeFeeBackend{price: big.NewInt(100)}
+	var cases = []struct {
+		fee      SuggestedFee
+		expected int64
+	}{
+		{SuggestedFee{b, 0, nil}, 100},
+		{SuggestedFee{b, 1.5, nil}, 150},
+		{SuggestedFee{b, 1.5, big.NewInt(120)}, 120},
+		{SuggestedFee{b, 1.1, big.NewInt(120)}, 110},
+	}
+	for i, tc := range cases {
+		txo := &bind.TransactOpts{}
+		c.Assert(tc.fee.Apply(context.Background(), txo), IsNil)
+		c.Check(txo.GasPrice.Int64(), Equals, tc.expected, Commentf("case %d", i))
+	}
+}
+
+func (s FeesSuite) TestEIP1559Fee(c *C) {
+	b := fakeFeeBackend{history: &ethereum.FeeHistory{
+		Reward:  [][]*big.Int{{big.NewInt(2)}, {big.NewInt(4)}},
+		BaseFee: []*big.Int{big.NewInt(90), big.NewInt(100), big.NewInt(110)},
+	}}
+	txo := &bind.TransactOpts{GasPrice: big.NewInt(1)}
+	c.Assert(EIP1559Fee{Backend: b, Blocks: 2, RewardPercentile: 50}.Apply(context.Background(), txo), IsNil)
+	c.Check(txo.GasPrice, IsNil)
+	c.Check(txo.GasTipCap.Int64(), Equals, int64(3))
+	c.Check(txo.GasFeeCap.Int64(), Equals, int64(223))
+
+	f := EIP1559Fee{Backend: b, Blocks: 2, RewardPercentile: 50, BaseFeeMultiplier: 1.5,
+		MaxTip: big.NewInt(1), MaxFeeCap: big.NewInt(150)}
+	c.Assert(f.Apply(context.Background(), txo), IsNil)
+	c.Check(txo.GasTipCap.Int64(), Equals, int64(1))
+	c.Check(txo.GasFeeCap.Int64(), Equals, int64(150))
+
+	f.MaxFeeCap = big.NewInt(100)
+	c.Check(f.Apply(context.Background(), txo), ErrorMatches, ".*base fee 110 is above MaxFeeCap 100.*")
+}
+
+// sendCounter counts transactions sent to the simulated backend
+type sendCounter struct {
+	*backends.SimulatedBackend
+	sent int
+}
+
+func (b *sendCounter) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	b.sent++
+	return b.SimulatedBackend.SendTransaction(ctx, tx)
+}
+
+func newFeeSim(c *C) (*sendCounter, TxrFactory) {
+	key, err := crypto.GenerateKey()
+	c.Assert(err, IsNil)
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{
+		crypto.PubkeyToAddress(key.PublicKey): {Balance: new(big.Int).Lsh(big.NewInt(1), 100)},
+	}, 8000000)
+	txrF, err := NewPrivKeyTxrFactory(common.Bytes2Hex(crypto.FromECDSA(key)), simChainID)
+	c.Assert(err, IsNil)
+	return &sendCounter{SimulatedBackend: sim}, txrF
+}
+
+func (s FeesSuite) TestFeeTxrFactoryEIP1559(c *C) {
+	sim, txrF := newFeeSim(c)
+	defer sim.Close()
+	head, err := sim.HeaderByNumber(context.Background(), nil)
+	c.Assert(err, IsNil)
+	b := fakeFeeBackend{history: &ethereum.FeeHistory{
+		Reward:  [][]*big.Int{{big.NewInt(1e9)}},
+		BaseFee: []*big.Int{head.BaseFee},
+	}}
+	tf := NewFeeTxrFactory(txrF, EIP1559Fee{Backend: b, Blocks: 1, RewardPercentile: 50},
+		time.Second, log15.Root())
+	to := common.HexToAddress("0x00000000000000000000000000000000000000bb")
+	txo := tf.Txo()
+	txo.Value, txo.GasLimit = big.NewInt(1000), 21000
+	tx, err := bind.NewBoundContract(to, abi.ABI{}, sim, sim, sim).Transfer(txo)
+	c.Assert(err, IsNil)
+	sim.Commit()
+	c.Check(int(tx.Type()), Equals, types.DynamicFeeTxType)
+	c.Check(tx.GasTipCap().Int64(), Equals, int64(1e9))
+	r, err := sim.TransactionReceipt(context.Background(), tx.Hash())
+	c.Assert(err, IsNil)
+	c.Check(r.Status, Equals, types.ReceiptStatusSuccessful)
+	bal, err := sim.BalanceAt(context.Background(), to, nil)
+	c.Assert(err, IsNil)
+	c.Check(bal.Int64(), Equals, int64(1000))
+}
+
+func (s FeesSuite) TestFeeTxrFactoryCeiling(c *C) {
+	sim, txrF := newFeeSim(c)
+	defer sim.Close()
+	src := &fakeNonceReader{}
+	nonces := NewNonceTxrFactory(txrF, NewNonceManager(src), time.Second)
+	b := fakeFeeBackend{history: &ethereum.FeeHistory{BaseFee: []*big.Int{big.NewInt(200e9)}}}
+	tf := NewFeeTxrFactory(nonces, EIP1559Fee{Backend: b, Blocks: 1, MaxFeeCap: big.NewInt(100e9)},
+		time.Second, log15.Root())
+
+	txo, err := tf.(TxoCreator).TxoE()
+	c.Check(err, ErrorMatches, ".*above MaxFeeCap.*")
+	c.Check(txo, IsNil)
+
+	txo = tf.Txo()
+	c.Check(txo.GasFeeCap, IsNil)
+	txo.GasLimit = 21000
+	to := common.HexToAddress("0x00000000000000000000000000000000000000bb")
+	_, errStd := bind.NewBoundContract(to, abi.ABI{}, sim, sim, sim).Transfer(txo)
+	c.Check(errStd, ErrorMatches, ".*above MaxFeeCap.*")
+	c.Check(sim.sent, Equals, 0, Comment("transaction over the fee ceiling must not be sent"))
+
+	txo, err = nonces.TxoE()
+	c.Assert(err, IsNil)
+	c.Check(txo.Nonce.Uint64(), Equals, uint64(0), Comment("nonce must be released"))
+}
+
+func (s FeesSuite) TestPercentile(c *C) {
+	c.Check(percentile(nil, 50), IsNil)
+	vals := []*big.Int{big.NewInt(5), big.NewInt(1), big.NewInt(3), big.NewInt(4), big.NewInt(2)}
+	c.Check(percentile(vals, 0).Int64(), Equals, int64(1))
+	c.Check(percentile(vals, 50).Int64(), Equals, int64(3))
+	c.Check(percentile(vals, 100).Int64(), Equals, int64(5))
+}
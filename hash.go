@@ -0,0 +1,52 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"database/sql/driver"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/robert-zaremba/errstack"
+	bat "github.com/robert-zaremba/go-bat"
+)
+
+// PgtHash is a ethereum Hash wrapper to provide DB interface
+type PgtHash struct {
+	common.Hash
+}
+
+// Scan implements sql.Sanner interface
+func (h *PgtHash) Scan(src interface{}) error {
+	if src == nil {
+		return nil
+	}
+	s, err := bat.UnsafeToString(src)
+	if err != nil {
+		return err
+	}
+	b, err := hexutil.Decode(s)
+	if err != nil || len(b) != common.HashLength {
+		return errstack.NewReq("Invalid hash")
+	}
+	h.Hash = common.BytesToHash(b)
+	return nil
+}
+
+// Value implements sql/driver.Valuer
+func (h PgtHash) Value() (driver.Value, error) {
+	return h.Hex(), nil
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/robert-zaremba/errstack"
+	"github.com/tyler-smith/go-bip39"
+)
+
+// HDWallet derives accounts from a BIP-39 mnemonic using BIP-32 derivation paths.
+type HDWallet struct {
+	master hdKey
+	signer types.Signer
+}
+
+// hdKey is a BIP-32 extended private key
+type hdKey struct {
+	key   *big.Int
+	chain []byte
+}
+
+// NewHDWallet creates HDWallet. The mnemonic checksum is validated. `passphrase` is
+// the optional BIP-39 passphrase. Derived accounts sign transactions for `chainID`,
+// see NewPrivKeyTxrFactory.
+func NewHDWallet(mnemonic, passphrase string, chainID *big.Int) (*HDWallet, errstack.E) {
+	seed, err := bip39.NewSeedWithErrorChecking(mnemonic, passphrase)
+	if err != nil {
+		return nil, errstack.WrapAsReq(err, "Invalid mnemonic")
+	}
+	return newHDWalletFromSeed(seed, chainID)
+}
+
+func newHDWalletFromSeed(seed []byte, chainID *big.Int) (*HDWallet, errstack.E) {
+	mac := hmac.New(sha512.New, []byte("Bitcoin seed"))
+	mac.Write(seed)
+	sum := mac.Sum(nil)
+	k := new(big.Int).SetBytes(sum[:32])
+	if k.Sign() == 0 || k.Cmp(crypto.S256().Params().N) >= 0 {
+		return nil, errstack.NewReq("Invalid seed")
+	}
+	return &HDWallet{hdKey{k, sum[32:]}, newSigner(chainID)}, nil
+}
+
+// Derive creates TxrFactory for the account at the given derivation path.
+func (w *HDWallet) Derive(path accounts.DerivationPath) (TxrFactory, errstack.E) {
+	k := w.master
+	var err errstack.E
+	for _, i := range path {
+		if k, err = k.child(i); err != nil {
+			return nil, errstack.WrapAsReq(err, "Can't derive "+path.String())
+		}
+	}
+	privKey, errStd := crypto.ToECDSA(math.PaddedBigBytes(k.key, 32))
+	if errStd != nil {
+		return nil, errstack.WrapAsReq(errStd, "Can't create private key")
+	}
+	return txrFactory{privKey, crypto.PubkeyToAddress(privKey.PublicKey), w.signer}, nil
+}
+
+// child implements BIP-32 private parent key to private child key derivation
+func (k hdKey) child(i uint32) (hdKey, errstack.E) {
+	var data []byte
+	if i >= 0x80000000 { // hardened
+		data = append([]byte{0}, math.PaddedBigBytes(k.key, 32)...)
+	} else {
+		x, y := crypto.S256().ScalarBaseMult(math.PaddedBigBytes(k.key, 32))
+		data = crypto.CompressPubkey(&ecdsa.PublicKey{Curve: crypto.S256(), X: x, Y: y})
+	}
+	var index [4]byte
+	binary.BigEndian.PutUint32(index[:], i)
+	data = append(data, index[:]...)
+	mac := hmac.New(sha512.New, k.chain)
+	mac.Write(data)
+	sum := mac.Sum(nil)
+	n := crypto.S256().Params().N
+	il := new(big.Int).SetBytes(sum[:32])
+	if il.Cmp(n) >= 0 {
+		return k, errstack.NewReq("Invalid child key")
+	}
+	il.Add(il, k.key).Mod(il, n)
+	if il.Sign() == 0 {
+		return k, errstack.NewReq("Invalid child key")
+	}
+	return hdKey{il, sum[32:]}, nil
+}
+
+// NewMnemonicTxrFactory creates TxrFactory for the account derived from the mnemonic
+// at `derivationPath`, eg "m/44'/60'/0'/0/0". See NewHDWallet.
+func NewMnemonicTxrFactory(mnemonic, passphrase, derivationPath string, chainID *big.Int) (TxrFactory, errstack.E) {
+	path, err := accounts.ParseDerivationPath(derivationPath)
+	if err != nil {
+		return nil, errstack.WrapAsReq(err, "Invalid derivation path")
+	}
+	w, errE := NewHDWallet(mnemonic, passphrase, chainID)
+	if errE != nil {
+		return nil, errE
+	}
+	return w.Derive(path)
+}
+
+// HDAccountIterator iterates over accounts derived by incrementing the last component
+// of a base derivation path.
+type HDAccountIterator struct {
+	w    *HDWallet
+	next func() accounts.DerivationPath
+	path accounts.DerivationPath
+	txrF TxrFactory
+	err  errstack.E
+}
+
+// Accounts returns iterator over accounts starting from the `base` path.
+// If base is nil then accounts.DefaultBaseDerivationPath (m/44'/60'/0'/0/0) is used.
+func (w *HDWallet) Accounts(base accounts.DerivationPath) *HDAccountIterator {
+	if base == nil {
+		base = accounts.DefaultBaseDerivationPath
+	}
+	return &HDAccountIterator{w: w, next: accounts.DefaultIterator(base)}
+}
+
+// Next derives the next account. It returns false if the derivation failed.
+func (it *HDAccountIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	it.path = append(accounts.DerivationPath{}, it.next()...)
+	it.txrF, it.err = it.w.Derive(it.path)
+	return it.err == nil
+}
+
+// Path returns the derivation path of the current account.
+func (it *HDAccountIterator) Path() accounts.DerivationPath {
+	return it.path
+}
+
+// TxrFactory returns TxrFactory of the current account.
+func (it *HDAccountIterator) TxrFactory() TxrFactory {
+	return it.txrF
+}
+
+// Err returns the derivation error.
+func (it *HDAccountIterator) Err() errstack.E {
+	return it.err
+}
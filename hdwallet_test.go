@@ -0,0 +1,83 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"encoding/hex"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/crypto"
+	. "github.com/robert-zaremba/checkers"
+	. "gopkg.in/check.v1"
+)
+
+const testMnemonic = "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+
+type HDWalletSuite struct{}
+
+// TestBIP32Vector checks the derivation against the BIP-32 test vector 1
+func (s HDWalletSuite) TestBIP32Vector(c *C) {
+	seed, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	w, err := newHDWalletFromSeed(seed, nil)
+	c.Assert(err, IsNil)
+	var testCases = []struct {
+		path string
+		key  string
+	}{
+		{"m/0'", "edb2e14f9ee77d26dd93b4ecede8d16ed408ce149b6cd80b0715a2d911a0afea"},
+		{"m/0'/1", "3c6cb8d0f6a264c91ea8b5030fadaa8e538b020f0a387421a12de9319dc93368"},
+		{"m/0'/1/2'/2/1000000000", "471b76e389e528d6de6d816857e012c5455051cad6660850e58372a6c3e6e7c8"},
+	}
+	for _, tc := range testCases {
+		path, errStd := accounts.ParseDerivationPath(tc.path)
+		c.Assert(errStd, IsNil)
+		txrF, err := w.Derive(path)
+		c.Assert(err, IsNil)
+		c.Check(hex.EncodeToString(crypto.FromECDSA(txrF.(txrFactory).privKey)), Equals, tc.key,
+			Commentf("path %s", tc.path))
+	}
+}
+
+func (s HDWalletSuite) TestMnemonic(c *C) {
+	txrF, err := NewMnemonicTxrFactory(testMnemonic, "", "m/44'/60'/0'/0/0", nil)
+	c.Assert(err, IsNil)
+	c.Check(txrF.Addr().Hex(), Equals, "0x9858EfFD232B4033E47d90003D41EC34EcaEda94")
+	c.Check(txrF.Txo().From, Equals, txrF.Addr())
+
+	withPassphrase, err := NewMnemonicTxrFactory(testMnemonic, "TREZOR", "m/44'/60'/0'/0/0", nil)
+	c.Assert(err, IsNil)
+	c.Check(withPassphrase.Addr(), Not(Equals), txrF.Addr())
+
+	_, err = NewMnemonicTxrFactory(testMnemonic[:len(testMnemonic)-5]+"abandon", "", "m/44'/60'/0'/0/0", nil)
+	c.Check(err, ErrorMatches, "Invalid mnemonic.*", Comment("wrong checksum"))
+	_, err = NewMnemonicTxrFactory(testMnemonic, "", "m/x", nil)
+	c.Check(err, ErrorMatches, "Invalid derivation path.*")
+}
+
+func (s HDWalletSuite) TestAccounts(c *C) {
+	w, err := NewHDWallet(testMnemonic, "", nil)
+	c.Assert(err, IsNil)
+	it := w.Accounts(nil)
+	var paths []string
+	for i := 0; i < 3 && it.Next(); i++ {
+		paths = append(paths, it.Path().String())
+		if i == 1 {
+			c.Check(it.TxrFactory().Addr().Hex(), Equals, "0x6Fac4D18c912343BF86fa7049364Dd4E424Ab9C0")
+		}
+	}
+	c.Assert(it.Err(), IsNil)
+	c.Check(paths, DeepEquals, []string{"m/44'/60'/0'/0/0", "m/44'/60'/0'/0/1", "m/44'/60'/0'/0/2"})
+}
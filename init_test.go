@@ -24,4 +24,26 @@ import (
 func Test(t *testing.T) { TestingT(t) }
 func init() {
 	Suite(&AddressSuite{})
+	Suite(&KeySuite{})
+	Suite(&NonceSuite{})
+	Suite(&ReceiptSuite{})
+	Suite(&FeesSuite{})
+	Suite(&ReplaceSuite{})
+	Suite(&SubscriptionSuite{})
+	Suite(&LogStreamSuite{})
+	Suite(&BackfillSuite{})
+	Suite(&DecoderSuite{})
+	Suite(&RouterSuite{})
+	Suite(&CheckpointSuite{})
+	Suite(&RemoteSignerSuite{})
+	Suite(&KeystoreSuite{})
+	Suite(&HDWalletSuite{})
+	Suite(&MessageSuite{})
+	Suite(&TypedDataSuite{})
+	Suite(&SchemaSuite{})
+	Suite(&VerifySuite{})
+	Suite(&DeployerSuite{})
+	Suite(&ContractSuite{})
+	Suite(&DynamicSuite{})
+	Suite(&RevertSuite{})
 }
@@ -16,14 +16,24 @@
 package ethdrv
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
 	"github.com/robert-zaremba/errstack"
 	bat "github.com/robert-zaremba/go-bat"
 	"github.com/robert-zaremba/log15"
@@ -35,38 +45,91 @@ type TxrFactory interface {
 	Addr() common.Address
 }
 
+// TxoCreator is implemented by TxrFactories which reserve resources (eg a nonce) for
+// transaction options, and so can fail to create them.
+type TxoCreator interface {
+	TxoE() (*bind.TransactOpts, errstack.E)
+	// Done must be called with the result of sending the transaction, so the resources
+	// reserved for unsent transaction are released.
+	Done(ctx context.Context, txo *bind.TransactOpts, err error) errstack.E
+}
+
+// NewTxo creates transaction options with txrF.TxoE if txrF is a TxoCreator,
+// and with txrF.Txo otherwise.
+func NewTxo(txrF TxrFactory) (*bind.TransactOpts, errstack.E) {
+	if tc, ok := txrF.(TxoCreator); ok {
+		return tc.TxoE()
+	}
+	return txrF.Txo(), nil
+}
+
+// TxDone passes the result of sending a transaction created with `txo` to txrF
+// if it's a TxoCreator. See TxoCreator.Done.
+func TxDone(ctx context.Context, txrF TxrFactory, txo *bind.TransactOpts, err error) errstack.E {
+	if tc, ok := txrF.(TxoCreator); ok {
+		return tc.Done(ctx, txo, err)
+	}
+	return nil
+}
+
+// failedTxo makes `txo` fail to sign transactions with `err`. It's used when
+// transaction options can't be completed and TxrFactory.Txo can't return an error.
+func failedTxo(txo *bind.TransactOpts, err error) *bind.TransactOpts {
+	txo.Signer = func(common.Address, *types.Transaction) (*types.Transaction, error) {
+		return nil, err
+	}
+	return txo
+}
+
 type txrFactory struct {
 	privKey *ecdsa.PrivateKey
 	addr    common.Address
+	signer  types.Signer
 }
 
-// NewJSONTxrFactory creates TxrFactory using on JSON account file and passphrase
-func NewJSONTxrFactory(filename, passphrase string, logger log15.Logger) (TxrFactory, errstack.E) {
-	data, err := bat.ReadFile(filename, logger)
+// newSigner returns the latest transaction signer for the chain. If `chainID` is nil
+// then only legacy transactions can be signed, without replay protection.
+func newSigner(chainID *big.Int) types.Signer {
+	if chainID == nil {
+		return types.HomesteadSigner{}
+	}
+	return types.LatestSignerForChainID(chainID)
+}
+
+// NewJSONTxrFactory creates TxrFactory using on JSON account file and passphrase.
+// `chainID` is required to sign EIP-1559 transactions, see newSigner.
+func NewJSONTxrFactory(filename, passphrase string, chainID *big.Int, logger log15.Logger) (TxrFactory, errstack.E) {
+	key, err := decryptKeyFile(filename, passphrase, logger)
 	if err != nil {
 		return nil, err
 	}
-	key, errStd := keystore.DecryptKey(data, passphrase)
-	if errStd != nil {
-		return nil, errstack.WrapAsReq(err, "Wrong passphrase")
-	}
-	return txrFactory{key.PrivateKey, key.Address}, nil
+	return txrFactory{key.PrivateKey, key.Address, newSigner(chainID)}, nil
 }
 
 // NewPrivKeyTxrFactory creates new transactor using a hex string of a ECDSA key.
-func NewPrivKeyTxrFactory(hexkey string) (TxrFactory, errstack.E) {
+// `chainID` is required to sign EIP-1559 transactions, see newSigner.
+func NewPrivKeyTxrFactory(hexkey string, chainID *big.Int) (TxrFactory, errstack.E) {
 	key, err := crypto.HexToECDSA(hexkey)
 	if err != nil {
 		return nil, errstack.WrapAsReq(err,
 			"Can't parse ECDSA key. Expected valid hex string.")
 	}
 	addr := crypto.PubkeyToAddress(key.PublicKey)
-	return txrFactory{key, addr}, nil
+	return txrFactory{key, addr, newSigner(chainID)}, nil
 }
 
 // Txo implements TxrFactory interface
 func (tp txrFactory) Txo() *bind.TransactOpts {
-	return bind.NewKeyedTransactor(tp.privKey)
+	return &bind.TransactOpts{
+		From:    tp.addr,
+		Context: context.Background(),
+		Signer: func(addr common.Address, tx *types.Transaction) (*types.Transaction, error) {
+			if addr != tp.addr {
+				return nil, bind.ErrNotAuthorized
+			}
+			return types.SignTx(tx, tp.signer, tp.privKey)
+		},
+	}
 }
 
 // Txo implements TxrFactory interface
@@ -74,6 +137,16 @@ func (tp txrFactory) Addr() common.Address {
 	return tp.addr
 }
 
+// SignMessage implements MessageSigner interface
+func (tp txrFactory) SignMessage(data []byte) ([]byte, errstack.E) {
+	return signMessage(tp.privKey, data)
+}
+
+// SignTypedData implements TypedDataSigner interface
+func (tp txrFactory) SignTypedData(td TypedData) ([]byte, errstack.E) {
+	return signTypedData(tp.privKey, td)
+}
+
 // KeySimple is a simple version of keystore.Key structure
 type KeySimple struct {
 	Address common.Address
@@ -116,3 +189,105 @@ func MustReadKeySimple(JSONFile string, logger log15.Logger) KeySimple {
 	}
 	return k
 }
+
+// ScryptParams are the scrypt KDF parameters used to encrypt keystore files.
+type ScryptParams struct {
+	N int
+	P int
+}
+
+// Scrypt parameters presets
+var (
+	StandardScrypt = ScryptParams{keystore.StandardScryptN, keystore.StandardScryptP}
+	LightScrypt    = ScryptParams{keystore.LightScryptN, keystore.LightScryptP}
+)
+
+func decryptKeyFile(filename, passphrase string, logger log15.Logger) (*keystore.Key, errstack.E) {
+	data, err := bat.ReadFile(filename, logger)
+	if err != nil {
+		return nil, err
+	}
+	key, errStd := keystore.DecryptKey(data, passphrase)
+	if errStd != nil {
+		return nil, errstack.WrapAsReq(errStd, "Wrong passphrase")
+	}
+	return key, nil
+}
+
+// WriteKeyFile encrypts the key and writes it as a V3 keystore file.
+// Existing file is replaced atomically.
+func WriteKeyFile(filename string, key *ecdsa.PrivateKey, passphrase string, sp ScryptParams) errstack.E {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return errstack.WrapAsIO(err, "Can't generate key ID")
+	}
+	return writeKeyFile(filename, &keystore.Key{Id: id, Address: crypto.PubkeyToAddress(key.PublicKey),
+		PrivateKey: key}, passphrase, sp)
+}
+
+func writeKeyFile(filename string, key *keystore.Key, passphrase string, sp ScryptParams) errstack.E {
+	data, err := keystore.EncryptKey(key, passphrase, sp.N, sp.P)
+	if err != nil {
+		return errstack.WrapAsDomain(err, "Can't encrypt key")
+	}
+	tmp := filename + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errstack.WrapAsIOf(err, "Can't write key file %q", tmp)
+	}
+	return errstack.WrapAsIOf(os.Rename(tmp, filename), "Can't replace key file %q", filename)
+}
+
+// keyFileName returns the keystore file name in the format used by geth
+func keyFileName(addr common.Address) string {
+	ts := time.Now().UTC().Format("2006-01-02T15-04-05.000000000Z")
+	return fmt.Sprintf("UTC--%s--%s", ts, hex.EncodeToString(addr[:]))
+}
+
+// NewKeyFile generates a new key and stores it in the keystore directory.
+// It returns the account address and the key file path.
+func NewKeyFile(dir, passphrase string, sp ScryptParams) (common.Address, string, errstack.E) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return common.Address{}, "", errstack.WrapAsIO(err, "Can't generate key")
+	}
+	return storeKey(dir, key, passphrase, sp)
+}
+
+// ImportHexKey stores the hex encoded private key in the keystore directory.
+// It returns the account address and the key file path.
+func ImportHexKey(dir, hexkey, passphrase string, sp ScryptParams) (common.Address, string, errstack.E) {
+	key, err := crypto.HexToECDSA(strings.TrimPrefix(hexkey, "0x"))
+	if err != nil {
+		return common.Address{}, "", errstack.WrapAsReq(err,
+			"Can't parse ECDSA key. Expected valid hex string.")
+	}
+	return storeKey(dir, key, passphrase, sp)
+}
+
+func storeKey(dir string, key *ecdsa.PrivateKey, passphrase string, sp ScryptParams) (common.Address, string, errstack.E) {
+	if err := bat.IsDir(dir); err != nil {
+		return common.Address{}, "", err
+	}
+	addr := crypto.PubkeyToAddress(key.PublicKey)
+	filename := path.Join(dir, keyFileName(addr))
+	return addr, filename, WriteKeyFile(filename, key, passphrase, sp)
+}
+
+// ExportHexKey decrypts the keystore file and returns the private key as a hex string.
+func ExportHexKey(filename, passphrase string, logger log15.Logger) (string, errstack.E) {
+	key, err := decryptKeyFile(filename, passphrase, logger)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(crypto.FromECDSA(key.PrivateKey)), nil
+}
+
+// ChangePassphrase re-encrypts the keystore file with a new passphrase. The key ID is
+// preserved.
+func ChangePassphrase(filename, passphrase, newPassphrase string, sp ScryptParams, logger log15.Logger) errstack.E {
+	key, err := decryptKeyFile(filename, passphrase, logger)
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(filename, key, newPassphrase, sp)
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"path"
+	"strings"
+
+	. "github.com/robert-zaremba/checkers"
+	"github.com/robert-zaremba/log15"
+	. "gopkg.in/check.v1"
+)
+
+type KeySuite struct{}
+
+func (s KeySuite) TestKeyFileLifecycle(c *C) {
+	dir := c.MkDir()
+	addr, fn, err := NewKeyFile(dir, "old", LightScrypt)
+	c.Assert(err, IsNil)
+	c.Check(path.Dir(fn), Equals, dir)
+	c.Check(strings.HasSuffix(fn, strings.ToLower(addr.Hex()[2:])), IsTrue)
+
+	k, err := ReadKeySimple(fn, log15.Root())
+	c.Assert(err, IsNil)
+	c.Check(k.Address, Equals, addr)
+
+	txrF, err := NewJSONTxrFactory(fn, "old", nil, log15.Root())
+	c.Assert(err, IsNil)
+	c.Check(txrF.Addr(), Equals, addr)
+	_, err = NewJSONTxrFactory(fn, "wrong", nil, log15.Root())
+	c.Check(err, ErrorMatches, "Wrong passphrase.*")
+
+	key, err := decryptKeyFile(fn, "old", log15.Root())
+	c.Assert(err, IsNil)
+	c.Check(ChangePassphrase(fn, "wrong", "new", LightScrypt, log15.Root()), NotNil)
+	c.Assert(ChangePassphrase(fn, "old", "new", LightScrypt, log15.Root()), IsNil)
+	_, err = NewJSONTxrFactory(fn, "old", nil, log15.Root())
+	c.Check(err, NotNil)
+	key2, err := decryptKeyFile(fn, "new", log15.Root())
+	c.Assert(err, IsNil)
+	c.Check(key2.Id, Equals, key.Id, Comment("key ID must be preserved"))
+	c.Check(key2.Address, Equals, addr)
+
+	hexkey, err := ExportHexKey(fn, "new", log15.Root())
+	c.Assert(err, IsNil)
+	c.Check(hexkey, HasLen, 64)
+	addr2, fn2, err := ImportHexKey(c.MkDir(), "0x"+hexkey, "other", LightScrypt)
+	c.Assert(err, IsNil)
+	c.Check(addr2, Equals, addr)
+	txrF, err = NewJSONTxrFactory(fn2, "other", nil, log15.Root())
+	c.Assert(err, IsNil)
+	c.Check(txrF.Addr(), Equals, addr)
+
+	_, _, err = ImportHexKey(dir, "xyz", "", LightScrypt)
+	c.Check(err, ErrorMatches, "Can't parse ECDSA key.*")
+	_, _, err = NewKeyFile(path.Join(dir, "missing"), "", LightScrypt)
+	c.Check(err, NotNil)
+}
@@ -0,0 +1,338 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/robert-zaremba/errstack"
+	bat "github.com/robert-zaremba/go-bat"
+	"github.com/robert-zaremba/log15"
+	"golang.org/x/term"
+)
+
+// PassphraseProvider provides passphrases to decrypt keystore accounts.
+type PassphraseProvider interface {
+	Passphrase(addr common.Address) (string, errstack.E)
+}
+
+// EnvPassphrase reads the passphrase from the `Name` environment variable.
+type EnvPassphrase struct {
+	Name string
+}
+
+// Passphrase implements PassphraseProvider interface
+func (p EnvPassphrase) Passphrase(addr common.Address) (string, errstack.E) {
+	s, ok := os.LookupEnv(p.Name)
+	if !ok {
+		return "", errstack.NewReqF("Environment variable %q with passphrase is not set", p.Name)
+	}
+	return s, nil
+}
+
+// FilePassphrase reads the passphrase from the first line of the `Path` file.
+type FilePassphrase struct {
+	Path   string
+	Logger log15.Logger
+}
+
+// Passphrase implements PassphraseProvider interface
+func (p FilePassphrase) Passphrase(addr common.Address) (string, errstack.E) {
+	data, err := bat.ReadFile(p.Path, p.Logger)
+	if err != nil {
+		return "", err
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		data = data[:i]
+	}
+	return string(data), nil
+}
+
+// PromptPassphrase asks for the passphrase. If `In` is a terminal then the input is
+// not echoed. Defaults are os.Stdin and os.Stderr.
+type PromptPassphrase struct {
+	In  io.Reader
+	Out io.Writer
+}
+
+// Passphrase implements PassphraseProvider interface
+func (p PromptPassphrase) Passphrase(addr common.Address) (string, errstack.E) {
+	in, out := p.In, p.Out
+	if in == nil {
+		in = os.Stdin
+	}
+	if out == nil {
+		out = os.Stderr
+	}
+	fmt.Fprintf(out, "Passphrase for %s: ", addr.Hex())
+	if f, ok := in.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		b, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(out)
+		return string(b), errstack.WrapAsIO(err, "Can't read passphrase")
+	}
+	s, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && (err != io.EOF || s == "") {
+		return "", errstack.WrapAsIO(err, "Can't read passphrase")
+	}
+	return strings.TrimRight(s, "\r\n"), nil
+}
+
+// KeystoreTxrFactory is a TxrFactory using accounts from a keystore directory.
+// Accounts must be unlocked before signing. Decrypted keys are zeroed when the account
+// is locked. `Txo` uses the account selected with `Use`, `TxoFor` selects the account
+// per call.
+type KeystoreTxrFactory struct {
+	dir     string
+	pp      PassphraseProvider
+	signer  types.Signer
+	logger  log15.Logger
+	mu      sync.Mutex
+	files   map[common.Address]string
+	keys    map[common.Address]*unlockedKey
+	current common.Address
+}
+
+type unlockedKey struct {
+	key   *ecdsa.PrivateKey
+	timer *time.Timer
+}
+
+// NewKeystoreTxrFactory creates KeystoreTxrFactory and scans the keystore directory.
+// If `chainID` is nil then transactions are signed without replay protection,
+// as in NewJSONTxrFactory.
+func NewKeystoreTxrFactory(dir string, pp PassphraseProvider, chainID *big.Int, logger log15.Logger) (*KeystoreTxrFactory, errstack.E) {
+	ks := &KeystoreTxrFactory{dir: dir, pp: pp, signer: newSigner(chainID), logger: logger,
+		keys: map[common.Address]*unlockedKey{}}
+	return ks, ks.Refresh()
+}
+
+// Refresh scans the keystore directory. Files which are not account keys are ignored.
+func (ks *KeystoreTxrFactory) Refresh() errstack.E {
+	if err := bat.IsDir(ks.dir); err != nil {
+		return err
+	}
+	fs, err := ioutil.ReadDir(ks.dir)
+	if err != nil {
+		return errstack.WrapAsIOf(err, "Can't read keystore directory %q", ks.dir)
+	}
+	files := map[common.Address]string{}
+	for _, f := range fs {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		fn := path.Join(ks.dir, f.Name())
+		k, err := ReadKeySimple(fn, ks.logger)
+		if err != nil || IsZeroAddr(k.Address) {
+			ks.logger.Debug("Skipping non key file", "path", fn)
+			continue
+		}
+		files[k.Address] = fn
+	}
+	ks.mu.Lock()
+	ks.files = files
+	ks.mu.Unlock()
+	return nil
+}
+
+// Accounts returns sorted addresses of the keystore accounts.
+func (ks *KeystoreTxrFactory) Accounts() []common.Address {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	addrs := make([]common.Address, 0, len(ks.files))
+	for a := range ks.files {
+		addrs = append(addrs, a)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return bytes.Compare(addrs[i][:], addrs[j][:]) < 0
+	})
+	return addrs
+}
+
+// Unlock decrypts the account key. If timeout > 0 then the account is locked
+// after the timeout. Unlocking already unlocked account resets its timeout.
+func (ks *KeystoreTxrFactory) Unlock(addr common.Address, timeout time.Duration) errstack.E {
+	ks.mu.Lock()
+	fn, ok := ks.files[addr]
+	ks.mu.Unlock()
+	if !ok {
+		return errstack.NewReqF("Account %s not found in keystore", addr.Hex())
+	}
+	passphrase, err := ks.pp.Passphrase(addr)
+	if err != nil {
+		return err
+	}
+	data, err := bat.ReadFile(fn, ks.logger)
+	if err != nil {
+		return err
+	}
+	key, errStd := keystore.DecryptKey(data, passphrase)
+	if errStd != nil {
+		return errstack.WrapAsReq(errStd, "Wrong passphrase")
+	}
+	uk := &unlockedKey{key: key.PrivateKey}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.lock(addr)
+	if timeout > 0 {
+		uk.timer = time.AfterFunc(timeout, func() {
+			ks.mu.Lock()
+			defer ks.mu.Unlock()
+			if ks.keys[addr] == uk {
+				ks.lock(addr)
+				ks.logger.Debug("Account locked after timeout", "address", addr.Hex())
+			}
+		})
+	}
+	ks.keys[addr] = uk
+	return nil
+}
+
+// Lock removes the decrypted account key from memory.
+func (ks *KeystoreTxrFactory) Lock(addr common.Address) {
+	ks.mu.Lock()
+	ks.lock(addr)
+	ks.mu.Unlock()
+}
+
+// LockAll locks all accounts.
+func (ks *KeystoreTxrFactory) LockAll() {
+	ks.mu.Lock()
+	for addr := range ks.keys {
+		ks.lock(addr)
+	}
+	ks.mu.Unlock()
+}
+
+// lock must be called with the lock held
+func (ks *KeystoreTxrFactory) lock(addr common.Address) {
+	uk, ok := ks.keys[addr]
+	if !ok {
+		return
+	}
+	if uk.timer != nil {
+		uk.timer.Stop()
+	}
+	zeroKey(uk.key)
+	delete(ks.keys, addr)
+}
+
+// IsUnlocked checks if the account key is decrypted.
+func (ks *KeystoreTxrFactory) IsUnlocked(addr common.Address) bool {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	_, ok := ks.keys[addr]
+	return ok
+}
+
+// Use selects the account used by `Txo` and `Addr`.
+func (ks *KeystoreTxrFactory) Use(addr common.Address) errstack.E {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if _, ok := ks.files[addr]; !ok {
+		return errstack.NewReqF("Account %s not found in keystore", addr.Hex())
+	}
+	ks.current = addr
+	return nil
+}
+
+// Txo implements TxrFactory interface
+func (ks *KeystoreTxrFactory) Txo() *bind.TransactOpts {
+	return &bind.TransactOpts{From: ks.Addr(), Signer: ks.sign}
+}
+
+// Addr implements TxrFactory interface
+func (ks *KeystoreTxrFactory) Addr() common.Address {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.current
+}
+
+// TxoFor creates TransactOpts for the `addr` account.
+func (ks *KeystoreTxrFactory) TxoFor(addr common.Address) (*bind.TransactOpts, errstack.E) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if _, ok := ks.files[addr]; !ok {
+		return nil, errstack.NewReqF("Account %s not found in keystore", addr.Hex())
+	}
+	return &bind.TransactOpts{From: addr, Signer: ks.sign}, nil
+}
+
+// SignMessage implements MessageSigner interface
+func (ks *KeystoreTxrFactory) SignMessage(data []byte) ([]byte, errstack.E) {
+	return ks.SignMessageFor(ks.Addr(), data)
+}
+
+// SignMessageFor creates EIP-191 personal signature using the `addr` account.
+func (ks *KeystoreTxrFactory) SignMessageFor(addr common.Address, data []byte) ([]byte, errstack.E) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	uk, ok := ks.keys[addr]
+	if !ok {
+		return nil, errstack.NewReqF("Account %s is locked", addr.Hex())
+	}
+	return signMessage(uk.key, data)
+}
+
+// SignTypedData implements TypedDataSigner interface
+func (ks *KeystoreTxrFactory) SignTypedData(td TypedData) ([]byte, errstack.E) {
+	return ks.SignTypedDataFor(ks.Addr(), td)
+}
+
+// SignTypedDataFor creates EIP-712 signature using the `addr` account.
+func (ks *KeystoreTxrFactory) SignTypedDataFor(addr common.Address, td TypedData) ([]byte, errstack.E) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	uk, ok := ks.keys[addr]
+	if !ok {
+		return nil, errstack.NewReqF("Account %s is locked", addr.Hex())
+	}
+	return signTypedData(uk.key, td)
+}
+
+func (ks *KeystoreTxrFactory) sign(from common.Address, tx *types.Transaction) (*types.Transaction, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	uk, ok := ks.keys[from]
+	if !ok {
+		return nil, errstack.NewReqF("Account %s is locked", from.Hex())
+	}
+	return types.SignTx(tx, ks.signer, uk.key)
+}
+
+// zeroKey zeroes the private key material
+func zeroKey(k *ecdsa.PrivateKey) {
+	b := k.D.Bits()
+	for i := range b {
+		b[i] = 0
+	}
+	k.D.SetUint64(0)
+}
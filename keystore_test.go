@@ -0,0 +1,126 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	. "github.com/robert-zaremba/checkers"
+	"github.com/robert-zaremba/log15"
+	. "gopkg.in/check.v1"
+)
+
+const testPassphrase = "secret"
+
+type KeystoreSuite struct {
+	dir   string
+	addrs []common.Address
+}
+
+func (s *KeystoreSuite) SetUpSuite(c *C) {
+	s.dir = c.MkDir()
+	for i := 0; i < 2; i++ {
+		a, err := keystore.StoreKey(s.dir, testPassphrase, keystore.LightScryptN, keystore.LightScryptP)
+		c.Assert(err, IsNil)
+		s.addrs = append(s.addrs, a.Address)
+	}
+	if bytes.Compare(s.addrs[0][:], s.addrs[1][:]) > 0 {
+		s.addrs[0], s.addrs[1] = s.addrs[1], s.addrs[0]
+	}
+	c.Assert(ioutil.WriteFile(path.Join(s.dir, "README"), []byte("not a key"), 0600), IsNil)
+}
+
+func (s *KeystoreSuite) TestPassphraseProviders(c *C) {
+	c.Assert(os.Setenv("ETHDRV_TEST_PASSPHRASE", "env"), IsNil)
+	defer os.Unsetenv("ETHDRV_TEST_PASSPHRASE")
+	p, err := EnvPassphrase{"ETHDRV_TEST_PASSPHRASE"}.Passphrase(s.addrs[0])
+	c.Assert(err, IsNil)
+	c.Check(p, Equals, "env")
+	_, err = EnvPassphrase{"ETHDRV_TEST_MISSING"}.Passphrase(s.addrs[0])
+	c.Check(err, NotNil)
+
+	fn := path.Join(c.MkDir(), "passphrase")
+	c.Assert(ioutil.WriteFile(fn, []byte("file\n"), 0600), IsNil)
+	p, err = FilePassphrase{fn, log15.Root()}.Passphrase(s.addrs[0])
+	c.Assert(err, IsNil)
+	c.Check(p, Equals, "file")
+
+	var out bytes.Buffer
+	p, err = PromptPassphrase{strings.NewReader("prompt\nnext"), &out}.Passphrase(s.addrs[0])
+	c.Assert(err, IsNil)
+	c.Check(p, Equals, "prompt")
+	c.Check(out.String(), Equals, "Passphrase for "+s.addrs[0].Hex()+": ")
+}
+
+func (s *KeystoreSuite) TestUnlockAndSign(c *C) {
+	ks, err := NewKeystoreTxrFactory(s.dir, PromptPassphrase{strings.NewReader(testPassphrase), &bytes.Buffer{}},
+		simChainID, log15.Root())
+	c.Assert(err, IsNil)
+	c.Assert(ks.Accounts(), DeepEquals, s.addrs)
+	c.Check(ks.Use(common.HexToAddress("0x01")), NotNil)
+	c.Assert(ks.Use(s.addrs[1]), IsNil)
+	c.Check(ks.Addr(), Equals, s.addrs[1])
+
+	tx := types.NewTransaction(0, common.HexToAddress("0x1234"), big.NewInt(1), 21000, big.NewInt(1), nil)
+	txo := ks.Txo()
+	_, errStd := txo.Signer(txo.From, tx)
+	c.Check(errStd, ErrorMatches, ".*is locked")
+
+	ks.pp = PromptPassphrase{strings.NewReader("wrong"), &bytes.Buffer{}}
+	c.Check(ks.Unlock(s.addrs[1], 0), ErrorMatches, "Wrong passphrase.*")
+	ks.pp = PromptPassphrase{strings.NewReader(testPassphrase), &bytes.Buffer{}}
+	c.Assert(ks.Unlock(s.addrs[1], 0), IsNil)
+	signed, errStd := txo.Signer(txo.From, tx)
+	c.Assert(errStd, IsNil)
+	sender, errStd := types.Sender(types.LatestSignerForChainID(simChainID), signed)
+	c.Assert(errStd, IsNil)
+	c.Check(sender, Equals, s.addrs[1])
+
+	txo, err = ks.TxoFor(s.addrs[0])
+	c.Assert(err, IsNil)
+	_, errStd = txo.Signer(txo.From, tx)
+	c.Check(errStd, ErrorMatches, ".*is locked", Comment("only the second account is unlocked"))
+
+	sig, err := ks.SignMessage([]byte("challenge"))
+	c.Assert(err, IsNil)
+	c.Check(VerifySignature(s.addrs[1], []byte("challenge"), sig), IsTrue)
+	_, err = ks.SignMessageFor(s.addrs[0], []byte("challenge"))
+	c.Check(err, ErrorMatches, ".*is locked")
+
+	key := ks.keys[s.addrs[1]].key
+	ks.Lock(s.addrs[1])
+	c.Check(ks.IsUnlocked(s.addrs[1]), IsFalse)
+	c.Check(key.D.Sign(), Equals, 0, Comment("key must be zeroed"))
+}
+
+func (s *KeystoreSuite) TestUnlockTimeout(c *C) {
+	ks, err := NewKeystoreTxrFactory(s.dir, PromptPassphrase{strings.NewReader(testPassphrase), &bytes.Buffer{}},
+		nil, log15.Root())
+	c.Assert(err, IsNil)
+	c.Assert(ks.Unlock(s.addrs[0], 50*time.Millisecond), IsNil)
+	c.Check(ks.IsUnlocked(s.addrs[0]), IsTrue)
+	time.Sleep(150 * time.Millisecond)
+	c.Check(ks.IsUnlocked(s.addrs[0]), IsFalse)
+}
@@ -0,0 +1,434 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"math/big"
+	"sort"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/robert-zaremba/errstack"
+	"github.com/robert-zaremba/log15"
+)
+
+// HeaderReader provides block headers.
+type HeaderReader interface {
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+}
+
+// LogEvent is an item of the LogStream.
+type LogEvent struct {
+	Log types.Log
+	// Revert is true when the log, which was previously emitted, was removed from
+	// the canonical chain and the consumer should roll back its effects.
+	Revert bool
+}
+
+// LogStreamOpts configures LogStream.
+type LogStreamOpts struct {
+	// Confirmations is the number of blocks (including the log block) required to emit
+	// a log. With 0, logs are emitted immediately.
+	Confirmations uint64
+	// Window is the number of recent blocks remembered to detect reorganisations.
+	// Default is 128.
+	Window uint64
+	// Interval is the chain head poll interval. The head is checked to confirm logs and
+	// to detect reorganisations which didn't bring new logs. If the backend supports new
+	// head subscriptions, then they are used in addition to polling.
+	// DefaultPollInterval is used by default.
+	Interval time.Duration
+	// Checkpoints, if set, is used to resume the `Consumer` after the last processed log
+	// and to save its progress. An event is acknowledged when the consumer receives the
+	// next one, and a revert moves the checkpoint back before the reverted block.
+	Checkpoints CheckpointStore
+	Consumer    string
+}
+
+type blockLogs struct {
+	hash common.Hash
+	logs []types.Log
+}
+
+// LogStream consumes a logs channel and emits logs and revert events. It keeps a window of
+// recent block hashes to detect chain reorganisations, also when the node doesn't send
+// `Removed` logs (eg after a reconnection) or the new branch has no logs at the
+// reorganised heights.
+type LogStream struct {
+	backend HeaderReader
+	opts    LogStreamOpts
+	logger  log15.Logger
+	events  chan LogEvent
+
+	emitted map[uint64]*blockLogs  // window of emitted logs by block number
+	pending map[uint64]*blockLogs  // logs waiting for confirmations
+	headers map[uint64]common.Hash // window of canonical block hashes
+	top     uint64                 // the highest seen block number
+	acker   *logAcker
+	resumed *Checkpoint // logs covered by the checkpoint are skipped
+}
+
+// NewLogStream creates LogStream processing `logs`, eg from SubscribeSimple or
+// ResilientSubscription. The events channel is closed when the context is done
+// or the `logs` channel is closed.
+func NewLogStream(ctx context.Context, backend HeaderReader, logs <-chan types.Log, opts LogStreamOpts, logger log15.Logger) *LogStream {
+	if opts.Window == 0 {
+		opts.Window = dedupWindow
+	}
+	if opts.Window < opts.Confirmations {
+		opts.Window = opts.Confirmations
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultPollInterval
+	}
+	s := &LogStream{
+		backend: backend,
+		opts:    opts,
+		logger:  logger,
+		events:  make(chan LogEvent, 5),
+		emitted: map[uint64]*blockLogs{},
+		pending: map[uint64]*blockLogs{},
+		headers: map[uint64]common.Hash{},
+		acker:   newLogAcker(opts.Checkpoints, opts.Consumer),
+	}
+	if s.acker != nil {
+		// the consumer must take an event before the previous one is acknowledged
+		s.events = make(chan LogEvent)
+	}
+	go s.loop(ctx, logs)
+	return s
+}
+
+// SubscribeReorgAware creates events subscription using SubscribeSimple and wraps it
+// into LogStream.
+func SubscribeReorgAware(ctx context.Context, client *ethclient.Client,
+	topics [][]common.Hash, addresses []common.Address, opts LogStreamOpts, logger log15.Logger) (*LogStream, ethereum.Subscription, errstack.E) {
+	logs, sub, err := SubscribeSimple(ctx, client, topics, addresses)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewLogStream(ctx, client, logs, opts, logger), sub, nil
+}
+
+// Events returns the events channel.
+func (s *LogStream) Events() <-chan LogEvent {
+	return s.events
+}
+
+func (s *LogStream) loop(ctx context.Context, logs <-chan types.Log) {
+	defer close(s.events)
+	if s.acker != nil && !s.resume(ctx) {
+		return
+	}
+	heads := make(chan *types.Header, 1)
+	if hs, ok := s.backend.(headSubscriber); ok {
+		if sub, err := hs.SubscribeNewHead(ctx, heads); err == nil {
+			defer sub.Unsubscribe()
+		} else {
+			s.logger.Debug("Can't subscribe to new heads, polling the chain head", "error", err)
+		}
+	}
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+	for {
+		var head *types.Header
+		select {
+		case <-ctx.Done():
+			return
+		case l, ok := <-logs:
+			if !ok {
+				return
+			}
+			if !s.handle(ctx, l) {
+				return
+			}
+			continue
+		case head = <-heads:
+		case <-ticker.C:
+			var err error
+			if head, err = s.backend.HeaderByNumber(ctx, nil); err != nil {
+				s.logger.Error("Can't get the latest block header", "error", err)
+				continue
+			}
+		}
+		ok, err := s.track(ctx, head)
+		if !ok {
+			return
+		}
+		if err != nil {
+			s.logger.Error("Can't check chain reorganisation", err)
+		}
+		if s.opts.Confirmations > 0 {
+			if err := s.confirm(ctx, head); err != nil {
+				s.logger.Error("Can't confirm logs", err)
+			}
+		}
+	}
+}
+
+// resume loads the consumer checkpoint, retrying every Interval. It returns false if
+// the context is done.
+func (s *LogStream) resume(ctx context.Context) bool {
+	for {
+		cp, err := s.acker.load(ctx)
+		if err == nil {
+			if cp != nil {
+				s.logger.Info("Resuming log stream", "consumer", s.opts.Consumer,
+					"block", cp.Block, "log_index", cp.LogIndex)
+			}
+			s.resumed = cp
+			return true
+		}
+		s.logger.Error("Can't load checkpoint", "consumer", s.opts.Consumer, err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(s.opts.Interval):
+		}
+	}
+}
+
+// handle processes a single log. It returns false if the context is done.
+func (s *LogStream) handle(ctx context.Context, l types.Log) bool {
+	if !l.Removed && s.resumed != nil && s.resumed.Covers(l) {
+		return true
+	}
+	if l.Removed {
+		if b, ok := s.pending[l.BlockNumber]; ok && b.hash == l.BlockHash {
+			b.logs = removeLog(b.logs, l.Index)
+			return true
+		}
+		if b, ok := s.emitted[l.BlockNumber]; ok && b.hash == l.BlockHash {
+			if logs := removeLog(b.logs, l.Index); len(logs) != len(b.logs) {
+				b.logs = logs
+				return s.send(ctx, LogEvent{l, true})
+			}
+		}
+		return true
+	}
+	if b, ok := s.emitted[l.BlockNumber]; ok && b.hash != l.BlockHash {
+		if !s.revertFrom(ctx, l.BlockNumber) {
+			return false
+		}
+	}
+	if b, ok := s.pending[l.BlockNumber]; ok && b.hash != l.BlockHash {
+		for n := range s.pending {
+			if n >= l.BlockNumber {
+				delete(s.pending, n)
+			}
+		}
+	}
+	if l.BlockNumber > s.top {
+		s.top = l.BlockNumber
+	}
+	if s.opts.Confirmations > 0 {
+		addLog(s.pending, l)
+		return true
+	}
+	if !addLog(s.emitted, l) {
+		return true
+	}
+	s.prune()
+	return s.send(ctx, LogEvent{l, false})
+}
+
+// track records the chain head in the window of canonical headers. If the head doesn't
+// extend the known chain, the canonical headers are read back to the fork point and
+// the logs from the removed blocks are reverted. It returns false if the context is done.
+func (s *LogStream) track(ctx context.Context, h *types.Header) (bool, errstack.E) {
+	n, hash := h.Number.Uint64(), h.Hash()
+	known, ok := s.knownHash(n)
+	if ok && known == hash {
+		return true, nil
+	}
+	reorg := ok
+	s.headers[n] = hash
+	fork := n
+	for parent := h.ParentHash; fork > 0; fork-- {
+		known, ok := s.knownHash(fork - 1)
+		if !ok || known == parent {
+			break
+		}
+		reorg = true
+		ph, err := s.backend.HeaderByNumber(ctx, new(big.Int).SetUint64(fork-1))
+		if err == nil && ph == nil {
+			err = ethereum.NotFound
+		}
+		if err != nil {
+			return true, errstack.WrapAsIOf(err, "Can't get block header %d", fork-1)
+		}
+		s.headers[fork-1] = ph.Hash()
+		parent = ph.ParentHash
+	}
+	for k := range s.headers {
+		if (reorg && k > n) || k+s.opts.Window < n {
+			delete(s.headers, k)
+		}
+	}
+	if !reorg {
+		return true, nil
+	}
+	for k, b := range s.pending {
+		if k >= fork && b.hash != s.headers[k] {
+			delete(s.pending, k)
+		}
+	}
+	return s.revert(ctx, fork, func(k uint64, blockHash common.Hash) bool {
+		canonical, ok := s.headers[k]
+		return !ok || canonical != blockHash
+	}), nil
+}
+
+// knownHash returns the hash of the block `n` from the headers or logs windows
+func (s *LogStream) knownHash(n uint64) (common.Hash, bool) {
+	if h, ok := s.headers[n]; ok {
+		return h, true
+	}
+	if b, ok := s.emitted[n]; ok {
+		return b.hash, true
+	}
+	if b, ok := s.pending[n]; ok {
+		return b.hash, true
+	}
+	return common.Hash{}, false
+}
+
+// revertFrom emits revert events for all emitted logs from blocks >= `number`, newest first.
+func (s *LogStream) revertFrom(ctx context.Context, number uint64) bool {
+	return s.revert(ctx, number, func(uint64, common.Hash) bool { return true })
+}
+
+// revert emits revert events for the emitted logs from blocks >= `number` selected
+// by `stale`, newest first.
+func (s *LogStream) revert(ctx context.Context, number uint64, stale func(uint64, common.Hash) bool) bool {
+	var blocks []uint64
+	for n, b := range s.emitted {
+		if n >= number && stale(n, b.hash) {
+			blocks = append(blocks, n)
+		}
+	}
+	if len(blocks) == 0 {
+		return true
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] > blocks[j] })
+	s.logger.Warn("Chain reorganisation detected", "block", number, "reverted_blocks", len(blocks))
+	for _, n := range blocks {
+		logs := s.emitted[n].logs
+		delete(s.emitted, n)
+		for i := len(logs) - 1; i >= 0; i-- {
+			l := logs[i]
+			l.Removed = true
+			if !s.send(ctx, LogEvent{l, true}) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// confirm emits pending logs from blocks which are deep enough and are still
+// in the canonical chain.
+func (s *LogStream) confirm(ctx context.Context, head *types.Header) errstack.E {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	var blocks []uint64
+	for n := range s.pending {
+		if n+s.opts.Confirmations <= head.Number.Uint64()+1 {
+			blocks = append(blocks, n)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+	for _, n := range blocks {
+		h, err := s.backend.HeaderByNumber(ctx, new(big.Int).SetUint64(n))
+		if err != nil {
+			return errstack.WrapAsIOf(err, "Can't get block header %d", n)
+		}
+		b := s.pending[n]
+		delete(s.pending, n)
+		if h == nil || h.Hash() != b.hash {
+			s.logger.Debug("Dropping logs from a reorganised block", "block", n, "hash", b.hash.Hex())
+			continue
+		}
+		if e, ok := s.emitted[n]; ok && e.hash != b.hash {
+			if !s.revertFrom(ctx, n) {
+				return nil
+			}
+		}
+		for _, l := range b.logs {
+			if addLog(s.emitted, l) && !s.send(ctx, LogEvent{l, false}) {
+				return nil
+			}
+		}
+	}
+	s.prune()
+	return nil
+}
+
+func (s *LogStream) send(ctx context.Context, e LogEvent) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case s.events <- e:
+	}
+	if s.acker != nil {
+		if err := s.acker.delivered(ctx, e.Log); err != nil {
+			s.logger.Error("Can't save checkpoint", "consumer", s.opts.Consumer, err)
+		}
+	}
+	return true
+}
+
+// prune removes blocks which are out of the window
+func (s *LogStream) prune() {
+	if s.top < s.opts.Window {
+		return
+	}
+	for n := range s.emitted {
+		if n < s.top-s.opts.Window {
+			delete(s.emitted, n)
+		}
+	}
+}
+
+// addLog adds the log to the block logs. It returns false if the log was already there.
+func addLog(blocks map[uint64]*blockLogs, l types.Log) bool {
+	b, ok := blocks[l.BlockNumber]
+	if !ok {
+		b = &blockLogs{hash: l.BlockHash}
+		blocks[l.BlockNumber] = b
+	}
+	for _, x := range b.logs {
+		if x.Index == l.Index {
+			return false
+		}
+	}
+	b.logs = append(b.logs, l)
+	return true
+}
+
+func removeLog(logs []types.Log, index uint) []types.Log {
+	for i, l := range logs {
+		if l.Index == index {
+			return append(logs[:i:i], logs[i+1:]...)
+		}
+	}
+	return logs
+}
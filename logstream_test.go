@@ -0,0 +1,187 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	. "github.com/robert-zaremba/checkers"
+	"github.com/robert-zaremba/log15"
+	. "gopkg.in/check.v1"
+)
+
+// fakeChain is a HeaderReader with replaceable blocks
+type fakeChain struct {
+	mu      sync.Mutex
+	headers []*types.Header
+}
+
+func (fc *fakeChain) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if number == nil {
+		return fc.headers[len(fc.headers)-1], nil
+	}
+	if n := number.Int64(); n < int64(len(fc.headers)) {
+		return fc.headers[n], nil
+	}
+	return nil, nil
+}
+
+// extend adds `n` blocks, marked with `fork`, starting from block `from`
+func (fc *fakeChain) extend(from, n int, fork byte) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.headers = fc.headers[:from]
+	for i := from; i < from+n; i++ {
+		h := &types.Header{Number: big.NewInt(int64(i)), Extra: []byte{fork}}
+		if i > 0 {
+			h.ParentHash = fc.headers[i-1].Hash()
+		}
+		fc.headers = append(fc.headers, h)
+	}
+}
+
+func (fc *fakeChain) log(block int, index uint) types.Log {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	h := fc.headers[block]
+	return types.Log{BlockNumber: h.Number.Uint64(), BlockHash: h.Hash(), Index: index}
+}
+
+type LogStreamSuite struct{}
+
+func (s LogStreamSuite) receive(c *C, ls *LogStream) LogEvent {
+	select {
+	case e := <-ls.Events():
+		return e
+	case <-time.After(5 * time.Second):
+		c.Fatal("event not received")
+	}
+	return LogEvent{}
+}
+
+func (s LogStreamSuite) checkEvent(c *C, e LogEvent, expected types.Log, revert bool) {
+	c.Check(e.Revert, Equals, revert)
+	c.Check(e.Log.BlockHash, Equals, expected.BlockHash)
+	c.Check(e.Log.Index, Equals, expected.Index)
+}
+
+func (s LogStreamSuite) TestRevertRemoved(c *C) {
+	fc := &fakeChain{}
+	fc.extend(0, 3, 0)
+	in := make(chan types.Log)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ls := NewLogStream(ctx, fc, in, LogStreamOpts{}, log15.Root())
+
+	l1, l2 := fc.log(1, 0), fc.log(2, 0)
+	in <- l1
+	s.checkEvent(c, s.receive(c, ls), l1, false)
+	in <- l2
+	s.checkEvent(c, s.receive(c, ls), l2, false)
+	in <- l2 // duplicate is dropped
+
+	l2.Removed = true
+	in <- l2
+	s.checkEvent(c, s.receive(c, ls), l2, true)
+}
+
+func (s LogStreamSuite) TestDetectReorg(c *C) {
+	fc := &fakeChain{}
+	fc.extend(0, 4, 0)
+	in := make(chan types.Log)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ls := NewLogStream(ctx, fc, in, LogStreamOpts{}, log15.Root())
+
+	l1, l2a, l3a := fc.log(1, 0), fc.log(2, 0), fc.log(3, 1)
+	for _, l := range []types.Log{l1, l2a, l3a} {
+		in <- l
+		s.checkEvent(c, s.receive(c, ls), l, false)
+	}
+	// reorganisation without Removed logs
+	fc.extend(2, 3, 1)
+	l2b := fc.log(2, 0)
+	in <- l2b
+	s.checkEvent(c, s.receive(c, ls), l3a, true)
+	s.checkEvent(c, s.receive(c, ls), l2a, true)
+	s.checkEvent(c, s.receive(c, ls), l2b, false)
+}
+
+func (s LogStreamSuite) TestConfirmations(c *C) {
+	fc := &fakeChain{}
+	fc.extend(0, 3, 0)
+	in := make(chan types.Log)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ls := NewLogStream(ctx, fc, in,
+		LogStreamOpts{Confirmations: 3, Interval: 5 * time.Millisecond}, log15.Root())
+
+	l1, l2a := fc.log(1, 0), fc.log(2, 0)
+	in <- l1
+	in <- l2a
+	time.Sleep(30 * time.Millisecond)
+	select {
+	case e := <-ls.Events():
+		c.Fatalf("log emitted before confirmation: %v", e)
+	default:
+	}
+
+	// block 2 is reorganised, block 1 gets 3 confirmations
+	fc.extend(2, 2, 1)
+	s.checkEvent(c, s.receive(c, ls), l1, false)
+	l2b := fc.log(2, 0)
+	in <- l2b
+	fc.extend(4, 1, 1)
+	e := s.receive(c, ls)
+	s.checkEvent(c, e, l2b, false)
+	c.Check(e.Log.BlockHash == l2a.BlockHash, IsFalse)
+}
+
+func (s LogStreamSuite) TestReorgWithoutLogs(c *C) {
+	fc := &fakeChain{}
+	fc.extend(0, 4, 0)
+	in := make(chan types.Log)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ls := NewLogStream(ctx, fc, in, LogStreamOpts{Interval: 5 * time.Millisecond}, log15.Root())
+
+	l1, l2a, l3a := fc.log(1, 0), fc.log(2, 0), fc.log(3, 1)
+	for _, l := range []types.Log{l1, l2a, l3a} {
+		in <- l
+		s.checkEvent(c, s.receive(c, ls), l, false)
+	}
+	// shorter side chain without logs, the node doesn't send Removed logs
+	fc.extend(2, 1, 1)
+	s.checkEvent(c, s.receive(c, ls), l3a, true)
+	s.checkEvent(c, s.receive(c, ls), l2a, true)
+	select {
+	case e := <-ls.Events():
+		c.Fatalf("unexpected event: %v", e)
+	case <-time.After(30 * time.Millisecond):
+	}
+
+	// the stream follows the new branch
+	fc.extend(3, 1, 1)
+	l3b := fc.log(3, 0)
+	in <- l3b
+	s.checkEvent(c, s.receive(c, ls), l3b, false)
+}
@@ -25,11 +25,15 @@ import (
 var one = big.NewInt(1)
 
 // IncNonce increments nonce by one and returns updated nonce
+//
+// Deprecated: it's not safe for concurrent use. Use NonceManager instead.
 func IncNonce(nonce *big.Int) *big.Int {
 	return nonce.Add(nonce, one)
 }
 
 // IncTxoNonce increments transaction options nonce
+//
+// Deprecated: it's not safe for concurrent use. Use NonceManager instead.
 func IncTxoNonce(txo *bind.TransactOpts, tx *types.Transaction) {
 	if txo.Nonce == nil {
 		txo.Nonce = big.NewInt(int64(tx.Nonce()))
@@ -0,0 +1,111 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"crypto/ecdsa"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/robert-zaremba/errstack"
+)
+
+// MessageSigner is implemented by TxrFactories which can create EIP-191 personal
+// signatures (as `personal_sign`).
+type MessageSigner interface {
+	SignMessage(data []byte) ([]byte, errstack.E)
+}
+
+// txrFactoryWrapper is implemented by TxrFactories wrapping another TxrFactory
+type txrFactoryWrapper interface {
+	unwrapTxrFactory() TxrFactory
+}
+
+// baseTxrFactory unwraps TxrFactory wrappers from this package. The returned TxrFactory
+// signs transactions without reserving nonces or setting fees.
+func baseTxrFactory(txrF TxrFactory) TxrFactory {
+	for {
+		w, ok := txrF.(txrFactoryWrapper)
+		if !ok {
+			return txrF
+		}
+		txrF = w.unwrapTxrFactory()
+	}
+}
+
+// SignMessage creates EIP-191 personal signature of the data using the TxrFactory
+// account. TxrFactory wrappers from this package are unwrapped to find a MessageSigner.
+func SignMessage(txrF TxrFactory, data []byte) ([]byte, errstack.E) {
+	for f := txrF; f != nil; {
+		if s, ok := f.(MessageSigner); ok {
+			return s.SignMessage(data)
+		}
+		w, ok := f.(txrFactoryWrapper)
+		if !ok {
+			break
+		}
+		f = w.unwrapTxrFactory()
+	}
+	return nil, errstack.NewReqF("%T can't sign messages", txrF)
+}
+
+// signMessage creates EIP-191 personal signature (as `personal_sign`) with v in {27, 28}
+func signMessage(key *ecdsa.PrivateKey, data []byte) ([]byte, errstack.E) {
+	return signHash(key, accounts.TextHash(data))
+}
+
+// signHash signs the hash and sets v in {27, 28}
+func signHash(key *ecdsa.PrivateKey, hash []byte) ([]byte, errstack.E) {
+	sig, err := crypto.Sign(hash, key)
+	if err != nil {
+		return nil, errstack.WrapAsDomain(err, "Can't sign message")
+	}
+	sig[crypto.RecoveryIDOffset] += 27
+	return sig, nil
+}
+
+// RecoverSigner returns the address which created the EIP-191 personal signature of
+// the message. Both 27/28 and 0/1 recovery id (v) values are accepted.
+func RecoverSigner(msg, sig []byte) (common.Address, error) {
+	return recoverHash(accounts.TextHash(msg), sig)
+}
+
+// recoverHash returns the address which signed the hash
+func recoverHash(hash, sig []byte) (common.Address, error) {
+	if len(sig) != crypto.SignatureLength {
+		return common.Address{}, errstack.NewReqF("Invalid signature length %d", len(sig))
+	}
+	sig = common.CopyBytes(sig)
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+	if sig[crypto.RecoveryIDOffset] > 1 {
+		return common.Address{}, errstack.NewReq("Invalid signature recovery id")
+	}
+	pub, err := crypto.SigToPub(hash, sig)
+	if err != nil {
+		return common.Address{}, errstack.WrapAsReq(err, "Invalid signature")
+	}
+	return crypto.PubkeyToAddress(*pub), nil
+}
+
+// VerifySignature checks if the EIP-191 personal signature of the message was created
+// by `addr`.
+func VerifySignature(addr common.Address, msg, sig []byte) bool {
+	signer, err := RecoverSigner(msg, sig)
+	return err == nil && signer == addr
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	. "github.com/robert-zaremba/checkers"
+	"github.com/robert-zaremba/log15"
+	. "gopkg.in/check.v1"
+)
+
+type MessageSuite struct{}
+
+func (s MessageSuite) TestSignAndRecover(c *C) {
+	txrF, err := NewPrivKeyTxrFactory("4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318", nil)
+	c.Assert(err, IsNil)
+	msg := []byte("Some data")
+	sig, err := SignMessage(txrF, msg)
+	c.Assert(err, IsNil)
+	// reference signature created with web3.eth.accounts.sign
+	c.Check(hexutil.Encode(sig), Equals, "0xb91467e570a6466aa9e9876cbcd013baba02900b8979d43fe208a4a4f339f5fd"+
+		"6007e74cd82e037b800186422fc2da167c747ef045e5d18a5f5d4300f8e1a0291c")
+	addr, errStd := RecoverSigner(msg, sig)
+	c.Assert(errStd, IsNil)
+	c.Check(addr, Equals, txrF.Addr())
+	c.Check(VerifySignature(txrF.Addr(), msg, sig), IsTrue)
+
+	sig[64] -= 27
+	c.Check(VerifySignature(txrF.Addr(), msg, sig), IsTrue, Comment("v in {0, 1}"))
+	c.Check(VerifySignature(txrF.Addr(), []byte("Other data"), sig), IsFalse)
+	c.Check(VerifySignature(common.HexToAddress("0x01"), msg, sig), IsFalse)
+
+	sig[64] = 5
+	_, errStd = RecoverSigner(msg, sig)
+	c.Check(errStd, ErrorMatches, "Invalid signature recovery id")
+	_, errStd = RecoverSigner(msg, sig[:64])
+	c.Check(errStd, ErrorMatches, "Invalid signature length 64")
+}
+
+type noSignerTxrFactory struct{}
+
+func (noSignerTxrFactory) Txo() *bind.TransactOpts {
+	return &bind.TransactOpts{}
+}
+
+func (noSignerTxrFactory) Addr() common.Address {
+	return common.Address{}
+}
+
+func (s MessageSuite) TestSignMessageWrapped(c *C) {
+	txrF, err := NewPrivKeyTxrFactory("4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318", nil)
+	c.Assert(err, IsNil)
+	msg := []byte("Some data")
+	wrapped := NewFeeTxrFactory(NewNonceTxrFactory(txrF, NewNonceManager(nil), time.Second),
+		FixedFee{GasPrice: big.NewInt(1)}, time.Second, log15.Root())
+	sig, err := SignMessage(wrapped, msg)
+	c.Assert(err, IsNil)
+	c.Check(VerifySignature(txrF.Addr(), msg, sig), IsTrue)
+
+	_, err = SignMessage(noSignerTxrFactory{}, msg)
+	c.Check(err, ErrorMatches, ".*noSignerTxrFactory can't sign messages")
+	_, err = SignMessage(NewFeeTxrFactory(noSignerTxrFactory{}, FixedFee{}, time.Second, log15.Root()), msg)
+	c.Check(err, NotNil)
+
+	td, err := ParseTypedData([]byte(mailTypedData))
+	c.Assert(err, IsNil)
+	sig, err = SignTypedData(wrapped, td)
+	c.Assert(err, IsNil)
+	c.Check(VerifyTypedData(txrF.Addr(), td, sig), IsTrue)
+	_, err = SignTypedData(noSignerTxrFactory{}, td)
+	c.Check(err, ErrorMatches, ".*noSignerTxrFactory can't sign typed data")
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/robert-zaremba/errstack"
+)
+
+// NonceReader provides the pending nonce of an account. Both *ethclient.Client and
+// bind.ContractBackend implement it.
+type NonceReader interface {
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+}
+
+// NonceManager allocates transaction nonces per account. It is safe for concurrent use.
+// Account state is seeded from the node (`PendingNonceAt`) on first use. Reserved nonces
+// are considered used until they are released.
+type NonceManager struct {
+	src      NonceReader
+	mu       sync.Mutex
+	accounts map[common.Address]*accountNonce
+}
+
+type accountNonce struct {
+	mu       sync.Mutex
+	seeded   bool
+	next     uint64
+	released []uint64 // sorted, all lower than next
+}
+
+// NewNonceManager creates NonceManager which reads pending nonces from `src`.
+func NewNonceManager(src NonceReader) *NonceManager {
+	return &NonceManager{src: src, accounts: map[common.Address]*accountNonce{}}
+}
+
+func (nm *NonceManager) account(addr common.Address) *accountNonce {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	a, ok := nm.accounts[addr]
+	if !ok {
+		a = &accountNonce{}
+		nm.accounts[addr] = a
+	}
+	return a
+}
+
+// Reserve returns the next free nonce for the `addr` account. Previously released nonces
+// are handed out first, lowest first.
+func (nm *NonceManager) Reserve(ctx context.Context, addr common.Address) (uint64, errstack.E) {
+	a := nm.account(addr)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.seeded {
+		if err := nm.sync(ctx, addr, a); err != nil {
+			return 0, err
+		}
+	}
+	if len(a.released) != 0 {
+		n := a.released[0]
+		a.released = a.released[1:]
+		return n, nil
+	}
+	n := a.next
+	a.next++
+	return n, nil
+}
+
+// Release gives back a reserved nonce which was not used, eg when signing or sending
+// a transaction failed. It will be handed out again by the next `Reserve` call.
+func (nm *NonceManager) Release(addr common.Address, nonce uint64) {
+	a := nm.account(addr)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.seeded || nonce >= a.next {
+		return
+	}
+	i := sort.Search(len(a.released), func(i int) bool { return a.released[i] >= nonce })
+	if i < len(a.released) && a.released[i] == nonce {
+		return
+	}
+	a.released = append(a.released, 0)
+	copy(a.released[i+1:], a.released[i:])
+	a.released[i] = nonce
+	// shrink the tail, so the released nonces don't grow infinitely
+	for l := len(a.released); l != 0 && a.released[l-1] == a.next-1; l-- {
+		a.released = a.released[:l-1]
+		a.next--
+	}
+}
+
+// Resync reads the pending nonce from the node and moves the account state forward
+// if the node is ahead of us. Released nonces which are already used on chain are dropped.
+func (nm *NonceManager) Resync(ctx context.Context, addr common.Address) errstack.E {
+	a := nm.account(addr)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return nm.sync(ctx, addr, a)
+}
+
+// Reset forgets the account state. Next `Reserve` will seed it again from the node.
+// The account state is cleared under the account lock, so it doesn't interleave with
+// pending `Reserve` and `Release` calls.
+func (nm *NonceManager) Reset(addr common.Address) {
+	a := nm.account(addr)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.seeded = false
+	a.next = 0
+	a.released = nil
+}
+
+// Done should be called with the result of sending a transaction created with a reserved
+// nonce. On error the nonce is released, or the account is resynced in case of
+// "nonce too low" error.
+func (nm *NonceManager) Done(ctx context.Context, txo *bind.TransactOpts, err error) errstack.E {
+	if err == nil || txo == nil || txo.Nonce == nil {
+		return nil
+	}
+	if IsNonceTooLow(err) {
+		return nm.Resync(ctx, txo.From)
+	}
+	nm.Release(txo.From, txo.Nonce.Uint64())
+	return nil
+}
+
+func (nm *NonceManager) sync(ctx context.Context, addr common.Address, a *accountNonce) errstack.E {
+	pending, err := nm.src.PendingNonceAt(ctx, addr)
+	if err != nil {
+		return errstack.WrapAsIOf(err, "Can't get pending nonce for %s", addr.Hex())
+	}
+	if !a.seeded || pending > a.next {
+		a.next = pending
+		a.seeded = true
+	}
+	i := sort.Search(len(a.released), func(i int) bool { return a.released[i] >= pending })
+	a.released = a.released[i:]
+	return nil
+}
+
+// IsNonceTooLow checks if the error returned by a node is a "nonce too low" error.
+func IsNonceTooLow(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "nonce too low")
+}
+
+// NonceTxrFactory is a TxrFactory which reserves transaction nonces in the NonceManager.
+type NonceTxrFactory struct {
+	TxrFactory
+	nm      *NonceManager
+	timeout time.Duration
+}
+
+// NewNonceTxrFactory wraps TxrFactory to create transaction options with a nonce
+// reserved in the NonceManager. `timeout` limits the node query when the account
+// nonce is seeded.
+func NewNonceTxrFactory(txrF TxrFactory, nm *NonceManager, timeout time.Duration) *NonceTxrFactory {
+	return &NonceTxrFactory{txrF, nm, timeout}
+}
+
+// Txo implements TxrFactory interface. It reserves a nonce as TxoE does, but the error
+// is deferred: if the nonce can't be reserved the returned options fail to sign
+// transactions. Call `Done` with the transaction result, so an unused nonce is released.
+func (tf *NonceTxrFactory) Txo() *bind.TransactOpts {
+	txo, err := tf.TxoE()
+	if err != nil {
+		return failedTxo(baseTxrFactory(tf.TxrFactory).Txo(), err)
+	}
+	return txo
+}
+
+func (tf *NonceTxrFactory) unwrapTxrFactory() TxrFactory {
+	return tf.TxrFactory
+}
+
+// TxoE creates transaction options with a reserved nonce. Call `Done` with the
+// transaction result, so the nonce is released if the transaction was not sent.
+func (tf *NonceTxrFactory) TxoE() (*bind.TransactOpts, errstack.E) {
+	txo := tf.TxrFactory.Txo()
+	ctx, cancel := context.WithTimeout(context.Background(), tf.timeout)
+	defer cancel()
+	n, err := tf.nm.Reserve(ctx, txo.From)
+	if err != nil {
+		return nil, err
+	}
+	txo.Nonce = new(big.Int).SetUint64(n)
+	return txo, nil
+}
+
+// Done releases the nonce of `txo` if the transaction was not sent. See NonceManager.Done.
+func (tf *NonceTxrFactory) Done(ctx context.Context, txo *bind.TransactOpts, err error) errstack.E {
+	return tf.nm.Done(ctx, txo, err)
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	. "github.com/robert-zaremba/checkers"
+	. "gopkg.in/check.v1"
+)
+
+type fakeNonceReader struct {
+	nonce uint64
+	calls int
+	err   error
+}
+
+func (r *fakeNonceReader) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	r.calls++
+	return r.nonce, r.err
+}
+
+type NonceSuite struct {
+	addr common.Address
+}
+
+func (s *NonceSuite) SetUpSuite(c *C) {
+	s.addr = common.HexToAddress("0xce0d46d924cc8437c806721496599fc3ffa268b9")
+}
+
+func (s *NonceSuite) reserve(c *C, nm *NonceManager) uint64 {
+	n, err := nm.Reserve(context.Background(), s.addr)
+	c.Assert(err, IsNil)
+	return n
+}
+
+func (s *NonceSuite) TestReserve(c *C) {
+	src := &fakeNonceReader{nonce: 5}
+	nm := NewNonceManager(src)
+	for i := uint64(5); i < 10; i++ {
+		c.Check(s.reserve(c, nm), Equals, i)
+	}
+	c.Check(src.calls, Equals, 1, Comment("the node should be asked only once"))
+}
+
+func (s *NonceSuite) TestConcurrentReserve(c *C) {
+	nm := NewNonceManager(&fakeNonceReader{})
+	const n = 50
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var seen = map[uint64]bool{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nonce, err := nm.Reserve(context.Background(), s.addr)
+			c.Check(err, IsNil)
+			mu.Lock()
+			seen[nonce] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	c.Assert(seen, HasLen, n)
+	for i := uint64(0); i < n; i++ {
+		c.Check(seen[i], IsTrue, Comment("missing nonce ", i))
+	}
+}
+
+func (s *NonceSuite) TestRelease(c *C) {
+	nm := NewNonceManager(&fakeNonceReader{})
+	for i := 0; i < 4; i++ {
+		s.reserve(c, nm)
+	}
+	nm.Release(s.addr, 1)
+	nm.Release(s.addr, 2)
+	c.Check(s.reserve(c, nm), Equals, uint64(1))
+	c.Check(s.reserve(c, nm), Equals, uint64(2))
+	c.Check(s.reserve(c, nm), Equals, uint64(4))
+
+	// releasing the last nonces shrinks the counter
+	nm.Release(s.addr, 4)
+	nm.Release(s.addr, 3)
+	c.Check(s.reserve(c, nm), Equals, uint64(3))
+	c.Check(s.reserve(c, nm), Equals, uint64(4))
+
+	// unknown nonce is ignored
+	nm.Release(s.addr, 100)
+	c.Check(s.reserve(c, nm), Equals, uint64(5))
+}
+
+func (s *NonceSuite) TestDone(c *C) {
+	src := &fakeNonceReader{}
+	nm := NewNonceManager(src)
+	for i := 0; i < 3; i++ {
+		s.reserve(c, nm)
+	}
+	txo := &bind.TransactOpts{From: s.addr, Nonce: big.NewInt(1)}
+	c.Assert(nm.Done(context.Background(), txo, errors.New("can't send")), IsNil)
+	c.Check(s.reserve(c, nm), Equals, uint64(1))
+
+	src.nonce = 10
+	txo.Nonce = big.NewInt(3)
+	c.Assert(nm.Done(context.Background(), txo, errors.New("nonce too low")), IsNil)
+	c.Check(s.reserve(c, nm), Equals, uint64(10))
+}
+
+func (s *NonceSuite) TestReset(c *C) {
+	src := &fakeNonceReader{nonce: 3}
+	nm := NewNonceManager(src)
+	s.reserve(c, nm)
+	s.reserve(c, nm)
+	nm.Reset(s.addr)
+	nm.Release(s.addr, 3)
+	c.Check(s.reserve(c, nm), Equals, uint64(3), Comment("account must be seeded again"))
+	c.Check(src.calls, Equals, 2)
+}
+
+func (s *NonceSuite) TestTxoE(c *C) {
+	txrF, err := NewPrivKeyTxrFactory("4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318", nil)
+	c.Assert(err, IsNil)
+	src := &fakeNonceReader{nonce: 7}
+	tf := NewNonceTxrFactory(txrF, NewNonceManager(src), time.Second)
+
+	txo, err := tf.TxoE()
+	c.Assert(err, IsNil)
+	c.Check(txo.Nonce.Uint64(), Equals, uint64(7))
+	c.Assert(tf.Done(context.Background(), txo, errors.New("can't send")), IsNil)
+	txo, err = tf.TxoE()
+	c.Assert(err, IsNil)
+	c.Check(txo.Nonce.Uint64(), Equals, uint64(7), Comment("released nonce must be reused"))
+	c.Check(tf.Txo().Nonce.Uint64(), Equals, uint64(8), Comment("Txo must reserve a nonce"))
+
+	src.err = errors.New("node is down")
+	tf = NewNonceTxrFactory(txrF, NewNonceManager(src), time.Second)
+	txo, err = tf.TxoE()
+	c.Check(err, NotNil)
+	c.Check(txo, IsNil)
+	txo = tf.Txo()
+	c.Check(txo.Nonce, IsNil)
+	_, errStd := txo.Signer(txo.From, types.NewTx(&types.LegacyTx{}))
+	c.Check(errStd, ErrorMatches, ".*node is down.*", Comment("Txo without a nonce must not sign"))
+}
+
+func (s *NonceSuite) TestNewTxo(c *C) {
+	txrF, err := NewPrivKeyTxrFactory("4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318", nil)
+	c.Assert(err, IsNil)
+	r := NewContractRegistry(nil, SchemaFactory{}, NewNonceTxrFactory(txrF,
+		NewNonceManager(&fakeNonceReader{nonce: 3}), time.Second), true)
+
+	txo, err := NewTxo(r)
+	c.Assert(err, IsNil)
+	c.Check(txo.Nonce.Uint64(), Equals, uint64(3))
+	c.Assert(TxDone(context.Background(), r, txo, errors.New("can't send")), IsNil)
+	txo, err = NewTxo(r)
+	c.Assert(err, IsNil)
+	c.Check(txo.Nonce.Uint64(), Equals, uint64(3), Comment("registry must release the nonce"))
+
+	txo, err = NewTxo(txrF)
+	c.Assert(err, IsNil)
+	c.Check(txo.Nonce, IsNil)
+	c.Check(TxDone(context.Background(), txrF, txo, errors.New("can't send")), IsNil)
+}
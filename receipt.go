@@ -0,0 +1,141 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/robert-zaremba/errstack"
+)
+
+// DefaultPollInterval is the default interval used to check the chain head.
+var DefaultPollInterval = time.Second
+
+// ReceiptBackend provides methods required to wait for transaction receipts.
+// It's implemented by *ethclient.Client and the simulated backend.
+type ReceiptBackend interface {
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+}
+
+type headSubscriber interface {
+	SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error)
+}
+
+// MinedWaiter waits for transactions to be mined and confirmed.
+// If the backend supports new head subscriptions, then they are used in addition to
+// polling the chain every `Interval`.
+type MinedWaiter struct {
+	Backend  ReceiptBackend
+	Interval time.Duration
+}
+
+// WaitMined waits until the transaction is included in a block which is `confirmations`
+// blocks deep (the inclusion block counts as the first confirmation) and returns the receipt.
+// If the inclusion block is removed by a chain reorganisation then it waits for the
+// transaction to be mined again.
+// If the transaction was reverted (receipt status = 0), then the receipt is returned
+// together with a domain error. Use ReplayRevert to get the revert reason.
+func WaitMined(ctx context.Context, b ReceiptBackend, tx *types.Transaction, confirmations uint64) (*types.Receipt, errstack.E) {
+	return MinedWaiter{b, DefaultPollInterval}.Wait(ctx, tx.Hash(), confirmations)
+}
+
+// Wait waits for `txHash` transaction. See WaitMined for details.
+func (mw MinedWaiter) Wait(ctx context.Context, txHash common.Hash, confirmations uint64) (*types.Receipt, errstack.E) {
+	heads := make(chan *types.Header, 1)
+	if hs, ok := mw.Backend.(headSubscriber); ok {
+		if sub, err := hs.SubscribeNewHead(ctx, heads); err == nil {
+			defer sub.Unsubscribe()
+		}
+	}
+	interval := mw.Interval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	w := minedWait{b: mw.Backend, txHash: txHash, confirmations: confirmations}
+	for {
+		done, err := w.step(ctx)
+		if done || err != nil {
+			return w.receipt, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errstack.WrapAsIOf(ctx.Err(), "Stopped waiting for transaction %s", txHash.Hex())
+		case <-heads:
+		case <-ticker.C:
+		}
+	}
+}
+
+// minedWait holds the state of a single WaitMined call
+type minedWait struct {
+	b             ReceiptBackend
+	txHash        common.Hash
+	confirmations uint64
+	receipt       *types.Receipt
+}
+
+// step checks the chain state once. It returns true when the receipt is confirmed.
+func (w *minedWait) step(ctx context.Context) (bool, errstack.E) {
+	if w.receipt == nil {
+		r, err := w.b.TransactionReceipt(ctx, w.txHash)
+		if err == ethereum.NotFound || (err == nil && r == nil) {
+			return false, nil
+		}
+		if err != nil {
+			return false, errstack.WrapAsIOf(err, "Can't get receipt of transaction %s", w.txHash.Hex())
+		}
+		w.receipt = r
+	}
+	head, err := w.b.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return false, errstack.WrapAsIOf(err, "Can't get the latest block header")
+	}
+	// check if the inclusion block is still in the canonical chain. The block may be
+	// not found after a reorganisation to a shorter chain.
+	inclusion, err := w.b.HeaderByNumber(ctx, w.receipt.BlockNumber)
+	if err == ethereum.NotFound {
+		w.receipt = nil
+		return false, nil
+	}
+	if err != nil {
+		return false, errstack.WrapAsIOf(err, "Can't get block header %v", w.receipt.BlockNumber)
+	}
+	if inclusion == nil || inclusion.Hash() != w.receipt.BlockHash {
+		w.receipt = nil
+		return false, nil
+	}
+	if head.Number.Cmp(w.receipt.BlockNumber) < 0 {
+		return false, nil
+	}
+	depth := new(big.Int).Sub(head.Number, w.receipt.BlockNumber).Uint64() + 1
+	if depth < w.confirmations {
+		return false, nil
+	}
+	if w.receipt.Status == types.ReceiptStatusFailed {
+		return true, errstack.NewDomainF("Transaction %s reverted in block %v",
+			w.txHash.Hex(), w.receipt.BlockNumber)
+	}
+	return true, nil
+}
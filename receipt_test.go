@@ -0,0 +1,176 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	. "github.com/robert-zaremba/checkers"
+	. "gopkg.in/check.v1"
+)
+
+// simChainID is the chain ID used by the simulated backend
+var simChainID = big.NewInt(1337)
+
+type ReceiptSuite struct {
+	key  *ecdsa.PrivateKey
+	addr common.Address
+	sim  *backends.SimulatedBackend
+}
+
+func (s *ReceiptSuite) SetUpTest(c *C) {
+	var err error
+	s.key, err = crypto.GenerateKey()
+	c.Assert(err, IsNil)
+	s.addr = crypto.PubkeyToAddress(s.key.PublicKey)
+	s.sim = backends.NewSimulatedBackend(core.GenesisAlloc{
+		s.addr: {Balance: new(big.Int).Lsh(big.NewInt(1), 100)},
+	}, 8000000)
+}
+
+func (s *ReceiptSuite) TearDownTest(c *C) {
+	s.sim.Close()
+}
+
+// sendTx sends a transaction with contract creation `code`
+func (s *ReceiptSuite) sendTx(c *C, nonce uint64, code []byte) *types.Transaction {
+	gasPrice, err := s.sim.SuggestGasPrice(context.Background())
+	c.Assert(err, IsNil)
+	tx := types.NewContractCreation(nonce, big.NewInt(0), 100000, gasPrice, code)
+	tx, err = types.SignTx(tx, types.LatestSignerForChainID(simChainID), s.key)
+	c.Assert(err, IsNil)
+	c.Assert(s.sim.SendTransaction(context.Background(), tx), IsNil)
+	return tx
+}
+
+func (s *ReceiptSuite) TestWaitMined(c *C) {
+	tx := s.sendTx(c, 0, []byte{0x00}) // STOP
+	ctx := context.Background()
+	w := minedWait{b: s.sim, txHash: tx.Hash(), confirmations: 3}
+	done, err := w.step(ctx)
+	c.Assert(err, IsNil)
+	c.Check(done, IsFalse, Comment("transaction is not mined"))
+
+	s.sim.Commit()
+	s.sim.Commit()
+	done, err = w.step(ctx)
+	c.Assert(err, IsNil)
+	c.Check(done, IsFalse, Comment("transaction has only 2 confirmations"))
+
+	s.sim.Commit()
+	done, err = w.step(ctx)
+	c.Assert(err, IsNil)
+	c.Check(done, IsTrue)
+	c.Check(w.receipt.TxHash, Equals, tx.Hash())
+	c.Check(w.receipt.BlockNumber.Uint64(), Equals, uint64(1))
+}
+
+func (s *ReceiptSuite) TestWaitMinedReorg(c *C) {
+	genesis, err := s.sim.HeaderByNumber(context.Background(), big.NewInt(0))
+	c.Assert(err, IsNil)
+	tx := s.sendTx(c, 0, []byte{0x00})
+	s.sim.Commit()
+	ctx := context.Background()
+	w := minedWait{b: s.sim, txHash: tx.Hash(), confirmations: 2}
+	done, err := w.step(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(done, IsFalse)
+	c.Assert(w.receipt, NotNil)
+
+	// build a longer side chain without the transaction
+	c.Assert(s.sim.Fork(ctx, genesis.Hash()), IsNil)
+	s.sim.Commit()
+	s.sim.Commit()
+	s.sim.Commit()
+	done, err = w.step(ctx)
+	c.Assert(err, IsNil)
+	c.Check(done, IsFalse)
+	c.Check(w.receipt, IsNil, Comment("receipt from the removed block must be dropped"))
+
+	c.Assert(s.sim.SendTransaction(ctx, tx), IsNil)
+	s.sim.Commit()
+	s.sim.Commit()
+	done, err = w.step(ctx)
+	c.Assert(err, IsNil)
+	c.Check(done, IsTrue)
+	c.Check(w.receipt.BlockNumber.Uint64(), Equals, uint64(4))
+}
+
+// shortChainBackend pretends that the chain was reorganised to a shorter one:
+// blocks above `head` are not found.
+type shortChainBackend struct {
+	*backends.SimulatedBackend
+	head *big.Int
+}
+
+func (b shortChainBackend) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	if number == nil {
+		number = b.head
+	}
+	if number.Cmp(b.head) > 0 {
+		return nil, ethereum.NotFound
+	}
+	return b.SimulatedBackend.HeaderByNumber(ctx, number)
+}
+
+func (s *ReceiptSuite) TestWaitMinedShorterChain(c *C) {
+	tx := s.sendTx(c, 0, []byte{0x00})
+	s.sim.Commit()
+	ctx := context.Background()
+	w := minedWait{b: s.sim, txHash: tx.Hash(), confirmations: 2}
+	done, err := w.step(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(done, IsFalse)
+	c.Assert(w.receipt, NotNil)
+
+	w.b = shortChainBackend{s.sim, big.NewInt(0)}
+	done, err = w.step(ctx)
+	c.Assert(err, IsNil)
+	c.Check(done, IsFalse)
+	c.Check(w.receipt, IsNil, Comment("receipt from the removed block must be dropped"))
+}
+
+func (s *ReceiptSuite) TestWaitMinedReverted(c *C) {
+	tx := s.sendTx(c, 0, []byte{0x60, 0x00, 0x60, 0x00, 0xfd}) // REVERT(0, 0)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		s.sim.Commit()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := MinedWaiter{s.sim, 10 * time.Millisecond}.Wait(ctx, tx.Hash(), 1)
+	c.Assert(r, NotNil)
+	c.Check(r.Status, Equals, types.ReceiptStatusFailed)
+	c.Check(err, ErrorMatches, "Transaction .* reverted in block 1")
+}
+
+func (s *ReceiptSuite) TestWaitMinedCancel(c *C) {
+	tx := s.sendTx(c, 0, []byte{0x00})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	r, err := MinedWaiter{s.sim, 10 * time.Millisecond}.Wait(ctx, tx.Hash(), 1)
+	c.Check(r, IsNil)
+	c.Check(err, NotNil)
+}
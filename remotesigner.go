@@ -0,0 +1,191 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"crypto/tls"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"github.com/robert-zaremba/errstack"
+	"github.com/robert-zaremba/log15"
+)
+
+// RemoteSignerOpts configures RemoteTxrFactory.
+type RemoteSignerOpts struct {
+	// Timeout of a single signing request. The signer may ask the operator to approve
+	// the transaction, so it should be long enough. Default is 1 minute.
+	Timeout time.Duration
+	// TLS is the client TLS configuration used for https endpoints.
+	TLS *tls.Config
+}
+
+// RemoteTxrFactory is a TxrFactory which delegates the transaction signing to an
+// external signer (eg Clef) using the `account_signTransaction` JSON-RPC method
+// (EIP-3030). Private keys never enter the service memory.
+type RemoteTxrFactory struct {
+	client  *rpc.Client
+	addr    common.Address
+	chainID *big.Int
+	signer  types.Signer
+	timeout time.Duration
+	logger  log15.Logger
+}
+
+// signTxResponse is the account_signTransaction result
+type signTxResponse struct {
+	Raw hexutil.Bytes      `json:"raw"`
+	Tx  *types.Transaction `json:"tx"`
+}
+
+// NewRemoteTxrFactory connects to the external signer and creates a TxrFactory for the
+// `from` account. `endpoint` is either a http(s) URL or a unix socket path.
+func NewRemoteTxrFactory(ctx context.Context, endpoint string, from common.Address, chainID *big.Int,
+	opts RemoteSignerOpts, logger log15.Logger) (*RemoteTxrFactory, errstack.E) {
+	if chainID == nil {
+		return nil, errstack.NewReq("Chain ID is required to sign transactions")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = time.Minute
+	}
+	var client *rpc.Client
+	var err error
+	if strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://") {
+		// keep the default proxy, dial timeouts and keep-alive settings
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if opts.TLS != nil {
+			transport.TLSClientConfig = opts.TLS
+		}
+		client, err = rpc.DialHTTPWithClient(endpoint, &http.Client{
+			Timeout:   opts.Timeout,
+			Transport: transport})
+	} else {
+		client, err = rpc.DialIPC(ctx, endpoint)
+	}
+	if err != nil {
+		return nil, errstack.WrapAsIOf(err, "Can't connect to the remote signer %q", endpoint)
+	}
+	return &RemoteTxrFactory{client, from, chainID, types.LatestSignerForChainID(chainID),
+		opts.Timeout, logger}, nil
+}
+
+// Txo implements TxrFactory interface
+func (tf *RemoteTxrFactory) Txo() *bind.TransactOpts {
+	return &bind.TransactOpts{From: tf.addr, Signer: tf.sign}
+}
+
+// Addr implements TxrFactory interface
+func (tf *RemoteTxrFactory) Addr() common.Address {
+	return tf.addr
+}
+
+// Close closes the connection to the remote signer.
+func (tf *RemoteTxrFactory) Close() {
+	tf.client.Close()
+}
+
+func (tf *RemoteTxrFactory) sign(from common.Address, tx *types.Transaction) (*types.Transaction, error) {
+	if from != tf.addr {
+		return nil, bind.ErrNotAuthorized
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tf.timeout)
+	defer cancel()
+	var resp signTxResponse
+	args := tf.sendTxArgs(tx) // must be addressable to marshal MixedcaseAddress
+	if err := tf.client.CallContext(ctx, &resp, "account_signTransaction", &args); err != nil {
+		return nil, errstack.WrapAsIOf(err, "Remote signer didn't sign the transaction, nonce=%d", tx.Nonce())
+	}
+	signed := new(types.Transaction)
+	if err := signed.UnmarshalBinary(resp.Raw); err != nil {
+		return nil, errstack.WrapAsDomain(err, "Remote signer returned malformed transaction")
+	}
+	if tf.signer.Hash(signed) != tf.signer.Hash(tx) {
+		return nil, errstack.NewDomain("Remote signer returned a different transaction")
+	}
+	if sender, err := types.Sender(tf.signer, signed); err != nil || sender != tf.addr {
+		return nil, errstack.NewDomainF("Remote signer returned transaction with invalid signature, sender=%s", sender.Hex())
+	}
+	tf.logger.Debug("Transaction signed remotely", "tx_hash", signed.Hash().Hex(), "nonce", signed.Nonce())
+	return signed, nil
+}
+
+// SignMessage implements MessageSigner interface. It uses the `account_signData` method
+// with "text/plain" content type.
+func (tf *RemoteTxrFactory) SignMessage(data []byte) ([]byte, errstack.E) {
+	ctx, cancel := context.WithTimeout(context.Background(), tf.timeout)
+	defer cancel()
+	var sig hexutil.Bytes
+	addr := common.NewMixedcaseAddress(tf.addr)
+	if err := tf.client.CallContext(ctx, &sig, "account_signData", "text/plain", &addr, hexutil.Bytes(data)); err != nil {
+		return nil, errstack.WrapAsIO(err, "Remote signer didn't sign the message")
+	}
+	if !VerifySignature(tf.addr, data, sig) {
+		return nil, errstack.NewDomain("Remote signer returned invalid message signature")
+	}
+	return sig, nil
+}
+
+// SignTypedData implements TypedDataSigner interface using the `account_signTypedData` method.
+func (tf *RemoteTxrFactory) SignTypedData(td TypedData) ([]byte, errstack.E) {
+	ctx, cancel := context.WithTimeout(context.Background(), tf.timeout)
+	defer cancel()
+	var sig hexutil.Bytes
+	addr := common.NewMixedcaseAddress(tf.addr)
+	if err := tf.client.CallContext(ctx, &sig, "account_signTypedData", &addr, td); err != nil {
+		return nil, errstack.WrapAsIO(err, "Remote signer didn't sign the typed data")
+	}
+	if !VerifyTypedData(tf.addr, td, sig) {
+		return nil, errstack.NewDomain("Remote signer returned invalid typed data signature")
+	}
+	return sig, nil
+}
+
+// sendTxArgs converts the transaction to the signer API arguments
+func (tf *RemoteTxrFactory) sendTxArgs(tx *types.Transaction) apitypes.SendTxArgs {
+	data := hexutil.Bytes(tx.Data())
+	args := apitypes.SendTxArgs{
+		From:    common.NewMixedcaseAddress(tf.addr),
+		Gas:     hexutil.Uint64(tx.Gas()),
+		Value:   hexutil.Big(*tx.Value()),
+		Nonce:   hexutil.Uint64(tx.Nonce()),
+		Input:   &data,
+		ChainID: (*hexutil.Big)(tf.chainID),
+	}
+	if tx.To() != nil {
+		to := common.NewMixedcaseAddress(*tx.To())
+		args.To = &to
+	}
+	if tx.Type() == types.DynamicFeeTxType {
+		args.MaxFeePerGas = (*hexutil.Big)(tx.GasFeeCap())
+		args.MaxPriorityFeePerGas = (*hexutil.Big)(tx.GasTipCap())
+	} else {
+		args.GasPrice = (*hexutil.Big)(tx.GasPrice())
+	}
+	if tx.Type() != types.LegacyTxType {
+		al := tx.AccessList()
+		args.AccessList = &al
+	}
+	return args
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	. "github.com/robert-zaremba/checkers"
+	"github.com/robert-zaremba/log15"
+	. "gopkg.in/check.v1"
+)
+
+// stubSigner implements the account_signTransaction method of the Clef API
+type stubSigner struct {
+	key   *ecdsa.PrivateKey
+	delay time.Duration
+}
+
+func (s *stubSigner) SignTransaction(ctx context.Context, args apitypes.SendTxArgs) (*signTxResponse, error) {
+	time.Sleep(s.delay)
+	tx, err := types.SignTx(args.ToTransaction(), types.LatestSignerForChainID(args.ChainID.ToInt()), s.key)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := tx.MarshalBinary()
+	return &signTxResponse{raw, tx}, err
+}
+
+func (s *stubSigner) SignData(ctx context.Context, contentType string, addr common.MixedcaseAddress,
+	data hexutil.Bytes) (hexutil.Bytes, error) {
+	txrF := txrFactory{s.key, addr.Address(), newSigner(nil)}
+	return txrF.SignMessage(data)
+}
+
+func (s *stubSigner) SignTypedData(ctx context.Context, addr common.MixedcaseAddress,
+	td TypedData) (hexutil.Bytes, error) {
+	txrF := txrFactory{s.key, addr.Address(), newSigner(nil)}
+	return txrF.SignTypedData(td)
+}
+
+type RemoteSignerSuite struct {
+	ReceiptSuite
+	stub *stubSigner
+	srv  *rpc.Server
+	http *httptest.Server
+}
+
+func (s *RemoteSignerSuite) SetUpTest(c *C) {
+	s.ReceiptSuite.SetUpTest(c)
+	s.stub = &stubSigner{key: s.key}
+	s.srv = rpc.NewServer()
+	c.Assert(s.srv.RegisterName("account", s.stub), IsNil)
+	s.http = httptest.NewServer(s.srv)
+}
+
+func (s *RemoteSignerSuite) TearDownTest(c *C) {
+	s.http.Close()
+	s.srv.Stop()
+	s.ReceiptSuite.TearDownTest(c)
+}
+
+func (s *RemoteSignerSuite) newHTTPFactory(c *C, opts RemoteSignerOpts) *RemoteTxrFactory {
+	tf, err := NewRemoteTxrFactory(context.Background(), s.http.URL, s.addr, simChainID, opts, log15.Root())
+	c.Assert(err, IsNil)
+	return tf
+}
+
+func (s *RemoteSignerSuite) send(c *C, tf TxrFactory, tx *types.Transaction) {
+	txo := tf.Txo()
+	c.Assert(txo.From, Equals, s.addr)
+	signed, err := txo.Signer(txo.From, tx)
+	c.Assert(err, IsNil)
+	c.Assert(s.sim.SendTransaction(context.Background(), signed), IsNil)
+	s.sim.Commit()
+	r, err := s.sim.TransactionReceipt(context.Background(), signed.Hash())
+	c.Assert(err, IsNil)
+	c.Check(r.Status, Equals, types.ReceiptStatusSuccessful)
+}
+
+func (s *RemoteSignerSuite) TestSignHTTP(c *C) {
+	tf := s.newHTTPFactory(c, RemoteSignerOpts{})
+	defer tf.Close()
+	to := common.HexToAddress("0x1234")
+	head, err := s.sim.HeaderByNumber(context.Background(), nil)
+	c.Assert(err, IsNil)
+	feeCap := new(big.Int).Mul(head.BaseFee, big.NewInt(2))
+	s.send(c, tf, types.NewTransaction(0, to, big.NewInt(1), 21000, feeCap, nil))
+	s.send(c, tf, types.NewTx(&types.DynamicFeeTx{Nonce: 1, To: &to, Value: big.NewInt(2),
+		Gas: 21000, GasTipCap: big.NewInt(1), GasFeeCap: feeCap}))
+}
+
+func (s *RemoteSignerSuite) TestSignUnixSocket(c *C) {
+	path := c.MkDir() + "/signer.ipc"
+	l, err := net.Listen("unix", path)
+	c.Assert(err, IsNil)
+	defer l.Close()
+	go s.srv.ServeListener(l)
+	tf, err := NewRemoteTxrFactory(context.Background(), path, s.addr, simChainID, RemoteSignerOpts{}, log15.Root())
+	c.Assert(err, IsNil)
+	defer tf.Close()
+	s.send(c, tf, types.NewContractCreation(0, big.NewInt(0), 100000, big.NewInt(1e10), []byte{0x00}))
+}
+
+func (s *RemoteSignerSuite) TestSignMessage(c *C) {
+	tf := s.newHTTPFactory(c, RemoteSignerOpts{})
+	defer tf.Close()
+	sig, err := tf.SignMessage([]byte("challenge"))
+	c.Assert(err, IsNil)
+	c.Check(VerifySignature(s.addr, []byte("challenge"), sig), IsTrue)
+
+	td, err := ParseTypedData([]byte(mailTypedData))
+	c.Assert(err, IsNil)
+	sig, err = tf.SignTypedData(td)
+	c.Assert(err, IsNil)
+	c.Check(VerifyTypedData(s.addr, td, sig), IsTrue)
+
+	s.stub.key, _ = crypto.GenerateKey()
+	_, err = tf.SignMessage([]byte("challenge"))
+	c.Check(err, ErrorMatches, "Remote signer returned invalid message signature")
+}
+
+func (s *RemoteSignerSuite) TestErrors(c *C) {
+	tf := s.newHTTPFactory(c, RemoteSignerOpts{Timeout: 100 * time.Millisecond})
+	defer tf.Close()
+	tx := types.NewContractCreation(0, big.NewInt(0), 100000, big.NewInt(1e10), []byte{0x00})
+	txo := tf.Txo()
+	_, err := txo.Signer(common.HexToAddress("0x01"), tx)
+	c.Check(err, Equals, bind.ErrNotAuthorized)
+
+	s.stub.key, err = crypto.GenerateKey()
+	c.Assert(err, IsNil)
+	_, err = txo.Signer(s.addr, tx)
+	c.Check(err, ErrorMatches, "Remote signer returned transaction with invalid signature.*")
+
+	s.stub.key = s.key
+	s.stub.delay = 300 * time.Millisecond
+	_, err = txo.Signer(s.addr, tx)
+	c.Check(err, ErrorMatches, "Remote signer didn't sign the transaction.*")
+
+	_, err = NewRemoteTxrFactory(context.Background(), s.http.URL, s.addr, nil, RemoteSignerOpts{}, log15.Root())
+	c.Check(err, NotNil)
+}
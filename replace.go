@@ -0,0 +1,286 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/robert-zaremba/errstack"
+	"github.com/robert-zaremba/log15"
+)
+
+// MinReplaceBump is the minimal fee increase (in percents) required by nodes to
+// replace a pending transaction.
+const MinReplaceBump = 10
+
+// ReplacerBackend provides methods required by TxReplacer.
+// It's implemented by *ethclient.Client.
+type ReplacerBackend interface {
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+	SendTransaction(ctx context.Context, tx *types.Transaction) error
+}
+
+// ReplacerConfig configures TxReplacer.
+type ReplacerConfig struct {
+	// Timeout after which a pending transaction is replaced with a higher fee.
+	Timeout time.Duration
+	// Bump is the fee increase in percents. MinReplaceBump is used if it's lower.
+	Bump int64
+	// MaxGasPrice is the ceiling for the gas price or EIP-1559 fee cap. Transactions
+	// which reached it are not bumped any more. Nil means no ceiling.
+	MaxGasPrice *big.Int
+}
+
+// ReplaceEvent describes a change of a tracked transaction.
+type ReplaceEvent struct {
+	Nonce uint64
+	// OldHash is the hash of the replaced transaction. It's empty in the Final event.
+	OldHash common.Hash
+	// NewHash is the hash of the new transaction or, in the Final event, of the mined one.
+	NewHash common.Hash
+	// Cancel is true if the new transaction is a cancel (self-transfer) transaction.
+	Cancel bool
+	// Final is true when one of the transaction versions was mined and the nonce
+	// is not tracked any more.
+	Final bool
+}
+
+type trackedTx struct {
+	tx     *types.Transaction
+	hashes []common.Hash // all sent versions
+	sentAt time.Time
+	cancel bool
+	// replacing is set while a replacement is signed and sent outside of the lock
+	replacing bool
+	// capped is set when the fee can't be bumped any more because of MaxGasPrice
+	capped bool
+}
+
+// TxReplacer tracks transactions sent by the TxrFactory account and replaces the ones
+// stuck in the mempool with a higher fee. It is safe for concurrent use.
+type TxReplacer struct {
+	backend  ReplacerBackend
+	txrF     TxrFactory
+	cfg      ReplacerConfig
+	callback func(ReplaceEvent)
+	logger   log15.Logger
+
+	mu  sync.Mutex
+	txs map[uint64]*trackedTx
+}
+
+// NewTxReplacer creates new TxReplacer. The `callback` is called for each replacement
+// and when a tracked transaction is finally mined.
+func NewTxReplacer(b ReplacerBackend, txrF TxrFactory, cfg ReplacerConfig, callback func(ReplaceEvent), logger log15.Logger) *TxReplacer {
+	if cfg.Bump < MinReplaceBump {
+		cfg.Bump = MinReplaceBump
+	}
+	return &TxReplacer{backend: b, txrF: txrF, cfg: cfg, callback: callback, logger: logger,
+		txs: map[uint64]*trackedTx{}}
+}
+
+// Track starts tracking a sent transaction.
+func (r *TxReplacer) Track(tx *types.Transaction) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.txs[tx.Nonce()] = &trackedTx{tx: tx, hashes: []common.Hash{tx.Hash()}, sentAt: time.Now()}
+}
+
+// Cancel replaces the tracked transaction with the given nonce with a zero value
+// self-transfer. It fails if the fee can't be bumped enough to replace the transaction
+// without exceeding MaxGasPrice.
+func (r *TxReplacer) Cancel(ctx context.Context, nonce uint64) errstack.E {
+	r.mu.Lock()
+	t, ok := r.txs[nonce]
+	busy := ok && t.replacing
+	if ok && !busy {
+		t.replacing = true
+	}
+	r.mu.Unlock()
+	if !ok {
+		return errstack.NewReqF("Transaction with nonce %d is not tracked", nonce)
+	}
+	if busy {
+		return errstack.NewReqF("Transaction with nonce %d is being replaced", nonce)
+	}
+	return r.replace(ctx, t, true)
+}
+
+// Run checks the tracked transactions every `interval` until the context is done.
+func (r *TxReplacer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Check(ctx); err != nil {
+				r.logger.Error("Can't check pending transactions", err)
+			}
+		}
+	}
+}
+
+// Check removes mined transactions and replaces the ones pending longer than the
+// configured timeout.
+func (r *TxReplacer) Check(ctx context.Context) errstack.E {
+	r.mu.Lock()
+	empty := len(r.txs) == 0
+	r.mu.Unlock()
+	if empty {
+		return nil
+	}
+	from := r.txrF.Addr()
+	mined, err := r.backend.NonceAt(ctx, from, nil)
+	if err != nil {
+		return errstack.WrapAsIOf(err, "Can't get nonce of %s", from.Hex())
+	}
+	var final = map[uint64][]common.Hash{}
+	var due []*trackedTx
+	r.mu.Lock()
+	for nonce, t := range r.txs {
+		if nonce < mined {
+			final[nonce] = append([]common.Hash(nil), t.hashes...)
+			delete(r.txs, nonce)
+			continue
+		}
+		if t.replacing || t.capped || time.Since(t.sentAt) < r.cfg.Timeout {
+			continue
+		}
+		t.replacing = true
+		due = append(due, t)
+	}
+	r.mu.Unlock()
+
+	for nonce, hashes := range final {
+		r.finalize(ctx, nonce, hashes)
+	}
+	for _, t := range due {
+		nonce := t.tx.Nonce()
+		if err := r.replace(ctx, t, t.cancel); err != nil {
+			r.logger.Error("Can't replace transaction", "nonce", nonce, err)
+		}
+	}
+	return nil
+}
+
+// finalize finds which version of the transaction was mined and reports it
+func (r *TxReplacer) finalize(ctx context.Context, nonce uint64, hashes []common.Hash) {
+	for _, h := range hashes {
+		receipt, err := r.backend.TransactionReceipt(ctx, h)
+		if err == nil && receipt != nil {
+			r.callback(ReplaceEvent{Nonce: nonce, NewHash: h, Final: true})
+			return
+		}
+		if err != nil && err != ethereum.NotFound {
+			r.logger.Error("Can't get transaction receipt", "tx_hash", h.Hex(), err)
+		}
+	}
+	r.logger.Warn("Nonce was used by an untracked transaction", "nonce", nonce)
+	r.callback(ReplaceEvent{Nonce: nonce, Final: true})
+}
+
+// replace signs and sends a new version of the transaction with bumped fees.
+// The caller must set `t.replacing`, which gives it the ownership of `t.tx`. The flag
+// is cleared when replace returns. Signing and sending is done without the lock.
+func (r *TxReplacer) replace(ctx context.Context, t *trackedTx, cancel bool) errstack.E {
+	defer func() {
+		r.mu.Lock()
+		t.replacing = false
+		r.mu.Unlock()
+	}()
+	old := t.tx
+	to, value, gas, data := old.To(), old.Value(), old.Gas(), old.Data()
+	if cancel {
+		from := r.txrF.Addr()
+		to, value, gas, data = &from, new(big.Int), 21000, nil
+	}
+	var txd types.TxData
+	var ok = true
+	if old.Type() == types.DynamicFeeTxType {
+		tip, okTip := r.bump(old.GasTipCap())
+		feeCap, okFee := r.bump(old.GasFeeCap())
+		ok = okTip && okFee
+		txd = &types.DynamicFeeTx{
+			ChainID:    old.ChainId(),
+			Nonce:      old.Nonce(),
+			GasTipCap:  tip,
+			GasFeeCap:  feeCap,
+			Gas:        gas,
+			To:         to,
+			Value:      value,
+			Data:       data,
+			AccessList: old.AccessList(),
+		}
+	} else {
+		var price *big.Int
+		price, ok = r.bump(old.GasPrice())
+		txd = &types.LegacyTx{
+			Nonce:    old.Nonce(),
+			GasPrice: price,
+			Gas:      gas,
+			To:       to,
+			Value:    value,
+			Data:     data,
+		}
+	}
+	if !ok {
+		r.mu.Lock()
+		t.capped = true
+		r.mu.Unlock()
+		return errstack.NewDomainF("Can't replace transaction %s: the fee bump would exceed MaxGasPrice",
+			old.Hash().Hex())
+	}
+	// the replacement keeps the nonce, so it's signed without reserving a new one
+	txo := baseTxrFactory(r.txrF).Txo()
+	tx, err := txo.Signer(txo.From, types.NewTx(txd))
+	if err != nil {
+		return errstack.WrapAsIOf(err, "Can't sign replacement of transaction %s", old.Hash().Hex())
+	}
+	if err = r.backend.SendTransaction(ctx, tx); err != nil {
+		return errstack.WrapAsIOf(err, "Can't send replacement of transaction %s", old.Hash().Hex())
+	}
+	LogTx("Transaction replaced", tx, r.logger)
+	r.mu.Lock()
+	t.tx, t.sentAt, t.cancel = tx, time.Now(), cancel
+	t.hashes = append(t.hashes, tx.Hash())
+	r.mu.Unlock()
+	r.callback(ReplaceEvent{Nonce: tx.Nonce(), OldHash: old.Hash(), NewHash: tx.Hash(), Cancel: cancel})
+	return nil
+}
+
+// bump increases the fee by the configured percentage (rounding up) and caps it.
+// It returns false if the capped fee is lower than the MinReplaceBump increase, which
+// nodes would reject as an underpriced replacement.
+func (r *TxReplacer) bump(fee *big.Int) (*big.Int, bool) {
+	x := capFee(percentUp(fee, r.cfg.Bump), r.cfg.MaxGasPrice)
+	return x, x.Cmp(percentUp(fee, MinReplaceBump)) >= 0
+}
+
+// percentUp returns x increased by p percents, rounding up
+func percentUp(x *big.Int, p int64) *big.Int {
+	y := new(big.Int).Mul(x, big.NewInt(100+p))
+	y.Add(y, big.NewInt(99))
+	return y.Div(y, big.NewInt(100))
+}
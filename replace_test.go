@@ -0,0 +1,185 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	. "github.com/robert-zaremba/checkers"
+	"github.com/robert-zaremba/log15"
+	. "gopkg.in/check.v1"
+)
+
+type fakeReplacerBackend struct {
+	nonce uint64
+	sent  []*types.Transaction
+	mined map[common.Hash]bool
+}
+
+func (b *fakeReplacerBackend) NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error) {
+	return b.nonce, nil
+}
+
+func (b *fakeReplacerBackend) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	if b.mined[txHash] {
+		return &types.Receipt{TxHash: txHash}, nil
+	}
+	return nil, ethereum.NotFound
+}
+
+func (b *fakeReplacerBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	b.sent = append(b.sent, tx)
+	return nil
+}
+
+type ReplaceSuite struct{}
+
+var testReplacerCfg = ReplacerConfig{Timeout: 0, Bump: 5, MaxGasPrice: big.NewInt(130)}
+
+func (s ReplaceSuite) setup(c *C) (*fakeReplacerBackend, TxrFactory, *TxReplacer, *[]ReplaceEvent) {
+	txrF, err := NewPrivKeyTxrFactory("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291", simChainID)
+	c.Assert(err, IsNil)
+	b := &fakeReplacerBackend{mined: map[common.Hash]bool{}}
+	var events []ReplaceEvent
+	r := NewTxReplacer(b, txrF, testReplacerCfg, func(e ReplaceEvent) {
+		events = append(events, e)
+	}, log15.Root())
+	return b, txrF, r, &events
+}
+
+func (s ReplaceSuite) signedTx(c *C, txrF TxrFactory, nonce uint64) *types.Transaction {
+	to := common.HexToAddress("0xce0d46d924cc8437c806721496599fc3ffa268b9")
+	txo := txrF.Txo()
+	tx, err := txo.Signer(txo.From, types.NewTransaction(nonce, to, big.NewInt(7), 50000, big.NewInt(100), []byte{1, 2}))
+	c.Assert(err, IsNil)
+	return tx
+}
+
+func (s ReplaceSuite) signedDynamicTx(c *C, txrF TxrFactory, nonce uint64) *types.Transaction {
+	to := common.HexToAddress("0xce0d46d924cc8437c806721496599fc3ffa268b9")
+	txo := txrF.Txo()
+	tx, err := txo.Signer(txo.From, types.NewTx(&types.DynamicFeeTx{ChainID: simChainID, Nonce: nonce,
+		GasTipCap: big.NewInt(20), GasFeeCap: big.NewInt(100), Gas: 50000, To: &to, Value: big.NewInt(7)}))
+	c.Assert(err, IsNil)
+	return tx
+}
+
+// checkDynamicReplacement checks the replacement type, fees and signer
+func (s ReplaceSuite) checkDynamicReplacement(c *C, tx *types.Transaction, from common.Address, tip, feeCap int64) {
+	c.Check(int(tx.Type()), Equals, types.DynamicFeeTxType)
+	c.Check(tx.ChainId(), DeepEquals, simChainID)
+	c.Check(tx.GasTipCap().Int64(), Equals, tip)
+	c.Check(tx.GasFeeCap().Int64(), Equals, feeCap)
+	sender, err := types.Sender(types.LatestSignerForChainID(simChainID), tx)
+	c.Assert(err, IsNil)
+	c.Check(sender, Equals, from)
+}
+
+func (s ReplaceSuite) TestBump(c *C) {
+	b, txrF, r, events := s.setup(c)
+	tx := s.signedTx(c, txrF, 3)
+	r.Track(tx)
+	ctx := context.Background()
+
+	c.Assert(r.Check(ctx), IsNil)
+	c.Assert(b.sent, HasLen, 1)
+	tx2 := b.sent[0]
+	c.Check(tx2.Nonce(), Equals, uint64(3))
+	c.Check(tx2.GasPrice().Int64(), Equals, int64(110), Comment("minimum bump is 10%"))
+	c.Check(tx2.Value().Int64(), Equals, int64(7))
+	c.Check(tx2.Data(), DeepEquals, []byte{1, 2})
+	c.Assert(*events, HasLen, 1)
+	c.Check((*events)[0], DeepEquals, ReplaceEvent{Nonce: 3, OldHash: tx.Hash(), NewHash: tx2.Hash()})
+
+	c.Assert(r.Check(ctx), IsNil)
+	c.Check(b.sent[1].GasPrice().Int64(), Equals, int64(121))
+	// 121 + 10% exceeds the cap and the capped fee (130) would be an underpriced replacement
+	c.Assert(r.Check(ctx), IsNil)
+	c.Check(b.sent, HasLen, 2, Comment("replacement below the minimal bump must not be sent"))
+	c.Check(*events, HasLen, 2)
+	c.Check(r.Cancel(ctx, 3), ErrorMatches, ".*exceed MaxGasPrice.*")
+	c.Check(b.sent, HasLen, 2, Comment("cancel must not resend the same price"))
+
+	// the first replacement was mined
+	b.nonce = 4
+	b.mined[tx2.Hash()] = true
+	c.Assert(r.Check(ctx), IsNil)
+	c.Check((*events)[len(*events)-1], DeepEquals, ReplaceEvent{Nonce: 3, NewHash: tx2.Hash(), Final: true})
+	c.Check(r.txs, HasLen, 0)
+}
+
+func (s ReplaceSuite) TestCancel(c *C) {
+	b, txrF, r, events := s.setup(c)
+	tx := s.signedTx(c, txrF, 0)
+	c.Check(r.Cancel(context.Background(), 0), ErrorMatches, ".*not tracked.*")
+	r.Track(tx)
+	c.Assert(r.Cancel(context.Background(), 0), IsNil)
+	c.Assert(b.sent, HasLen, 1)
+	cancelTx := b.sent[0]
+	c.Check(*cancelTx.To(), Equals, txrF.Addr())
+	c.Check(cancelTx.Value().Sign(), Equals, 0)
+	c.Check(cancelTx.Gas(), Equals, uint64(21000))
+	c.Check(cancelTx.Data(), HasLen, 0)
+	c.Check((*events)[0].Cancel, IsTrue)
+}
+
+func (s ReplaceSuite) TestBumpDynamicFee(c *C) {
+	b, txrF, r, events := s.setup(c)
+	tx := s.signedDynamicTx(c, txrF, 2)
+	r.Track(tx)
+	c.Assert(r.Check(context.Background()), IsNil)
+	c.Assert(b.sent, HasLen, 1)
+	tx2 := b.sent[0]
+	c.Check(tx2.Nonce(), Equals, uint64(2))
+	c.Check(tx2.Value().Int64(), Equals, int64(7))
+	s.checkDynamicReplacement(c, tx2, txrF.Addr(), 22, 110)
+	c.Check((*events)[0], DeepEquals, ReplaceEvent{Nonce: 2, OldHash: tx.Hash(), NewHash: tx2.Hash()})
+
+	c.Assert(r.Check(context.Background()), IsNil)
+	c.Assert(b.sent, HasLen, 2)
+	s.checkDynamicReplacement(c, b.sent[1], txrF.Addr(), 25, 121)
+}
+
+func (s ReplaceSuite) TestCancelDynamicFee(c *C) {
+	b, txrF, r, events := s.setup(c)
+	r.Track(s.signedDynamicTx(c, txrF, 0))
+	c.Assert(r.Cancel(context.Background(), 0), IsNil)
+	c.Assert(b.sent, HasLen, 1)
+	cancelTx := b.sent[0]
+	c.Check(*cancelTx.To(), Equals, txrF.Addr())
+	c.Check(cancelTx.Value().Sign(), Equals, 0)
+	c.Check(cancelTx.Gas(), Equals, uint64(21000))
+	s.checkDynamicReplacement(c, cancelTx, txrF.Addr(), 22, 110)
+	c.Check((*events)[0].Cancel, IsTrue)
+}
+
+func (s ReplaceSuite) TestReplaceKeepsNonces(c *C) {
+	b, txrF, _, _ := s.setup(c)
+	nonces := NewNonceTxrFactory(txrF, NewNonceManager(&fakeNonceReader{nonce: 5}), time.Second)
+	r := NewTxReplacer(b, nonces, testReplacerCfg, func(ReplaceEvent) {}, log15.Root())
+	r.Track(s.signedDynamicTx(c, txrF, 4))
+	c.Assert(r.Check(context.Background()), IsNil)
+	c.Assert(b.sent, HasLen, 1)
+	c.Check(b.sent[0].Nonce(), Equals, uint64(4))
+	txo, err := nonces.TxoE()
+	c.Assert(err, IsNil)
+	c.Check(txo.Nonce.Uint64(), Equals, uint64(5), Comment("replacement must not reserve a nonce"))
+}
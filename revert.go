@@ -0,0 +1,204 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/robert-zaremba/errstack"
+)
+
+// Built-in Solidity errors
+var (
+	errorSelector = crypto.Keccak256([]byte("Error(string)"))[:4]
+	panicSelector = crypto.Keccak256([]byte("Panic(uint256)"))[:4]
+	errorArgs     = abi.Arguments{{Name: "reason", Type: mustNewType("string")}}
+	panicArgs     = abi.Arguments{{Name: "code", Type: mustNewType("uint256")}}
+)
+
+// panicReasons describes Solidity Panic(uint256) codes.
+var panicReasons = map[uint64]string{
+	0x00: "generic compiler panic",
+	0x01: "assertion failed",
+	0x11: "arithmetic underflow or overflow",
+	0x12: "division or modulo by zero",
+	0x21: "invalid enum value",
+	0x22: "invalid storage byte array encoding",
+	0x31: "pop on empty array",
+	0x32: "array index out of bounds",
+	0x41: "too much memory allocated",
+	0x51: "call to zero-initialized internal function",
+}
+
+// PanicReason describes the Solidity Panic(uint256) code.
+func PanicReason(code uint64) (string, bool) {
+	reason, ok := panicReasons[code]
+	return reason, ok
+}
+
+// RevertError is a decoded contract revert. Name is "Error" for require / revert with
+// a reason string, "Panic" for failed assertions and arithmetic errors, or the name of
+// a Solidity custom error. Name is empty if the revert data can't be decoded.
+// Args are the error arguments in the ABI order and Raw is the revert data.
+// It implements errstack.E.
+type RevertError struct {
+	errstack.E
+	Name string
+	Args []interface{}
+	Raw  []byte
+}
+
+func (e *RevertError) Error() string {
+	switch {
+	case len(e.Raw) == 0:
+		return "execution reverted"
+	case e.Name == "":
+		return "execution reverted: unknown error " + hexutil.Encode(e.Raw)
+	case e.Name == "Error" && len(e.Args) == 1:
+		return fmt.Sprint("execution reverted: ", e.Args[0])
+	case e.Name == "Panic" && len(e.Args) == 1:
+		code, _ := e.Args[0].(*big.Int)
+		if code != nil && code.IsUint64() {
+			if reason, ok := PanicReason(code.Uint64()); ok {
+				return fmt.Sprintf("execution reverted: panic 0x%x (%s)", code, reason)
+			}
+		}
+		return fmt.Sprintf("execution reverted: panic %v", e.Args[0])
+	}
+	args := make([]string, len(e.Args))
+	for i, a := range e.Args {
+		args[i] = fmt.Sprint(a)
+	}
+	return "execution reverted: " + e.Name + "(" + strings.Join(args, ", ") + ")"
+}
+
+// Reason returns the revert reason string of the Error(string) revert.
+func (e *RevertError) Reason() (string, bool) {
+	if e.Name != "Error" || len(e.Args) != 1 {
+		return "", false
+	}
+	s, ok := e.Args[0].(string)
+	return s, ok
+}
+
+// DecodeRevert decodes the revert data. Custom errors are looked up in the `abis`.
+func DecodeRevert(data []byte, abis ...abi.ABI) *RevertError {
+	e := &RevertError{Raw: data}
+	e.decodeData(abis)
+	e.E = errstack.NewDomain(e.Error())
+	return e
+}
+
+func (e *RevertError) decodeData(abis []abi.ABI) {
+	if len(e.Raw) < 4 {
+		return
+	}
+	selector, args := e.Raw[:4], e.Raw[4:]
+	switch {
+	case bytes.Equal(selector, errorSelector):
+		e.decode("Error", errorArgs, args)
+		return
+	case bytes.Equal(selector, panicSelector):
+		e.decode("Panic", panicArgs, args)
+		return
+	}
+	for _, a := range abis {
+		for _, abiErr := range a.Errors {
+			if bytes.Equal(selector, abiErr.ID[:4]) && e.decode(abiErr.Name, abiErr.Inputs, args) {
+				return
+			}
+		}
+	}
+}
+
+func (e *RevertError) decode(name string, inputs abi.Arguments, data []byte) bool {
+	vals, err := inputs.Unpack(data)
+	if err != nil {
+		return false
+	}
+	e.Name, e.Args = name, vals
+	return true
+}
+
+// AsRevertError extracts the revert data from a call, gas estimation or transaction
+// error (the JSON-RPC error data) and decodes it using DecodeRevert.
+// A revert without data (eg `require(x)` without a reason) is returned as an empty
+// RevertError. It returns false if the error is not a revert.
+func AsRevertError(err error, abis ...abi.ABI) (*RevertError, bool) {
+	var re *RevertError
+	if errors.As(err, &re) {
+		return re, true
+	}
+	var de rpc.DataError
+	if errors.As(err, &de) {
+		switch d := de.ErrorData().(type) {
+		case string:
+			if data, errHex := hexutil.Decode(d); errHex == nil {
+				return DecodeRevert(data, abis...), true
+			}
+		case []byte:
+			return DecodeRevert(d, abis...), true
+		}
+	}
+	if err != nil && strings.Contains(err.Error(), "execution reverted") {
+		return DecodeRevert(nil), true
+	}
+	return nil, false
+}
+
+// ReplayRevert gets the revert of a failed (status = 0) mined transaction, eg returned
+// by MinedWaiter, by replaying it with CallContract at the receipt block. The call is
+// done on the state at the end of the block, so it may not revert the same way if the
+// state was changed by later transactions of the block.
+func ReplayRevert(ctx context.Context, b ethereum.ContractCaller, tx *types.Transaction,
+	receipt *types.Receipt, abis ...abi.ABI) (*RevertError, errstack.E) {
+	if receipt.Status != types.ReceiptStatusFailed {
+		return nil, errstack.NewReqF("Transaction %s didn't fail", tx.Hash().Hex())
+	}
+	from, errStd := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
+	if errStd != nil {
+		return nil, errstack.WrapAsReq(errStd, "Can't get the transaction sender")
+	}
+	msg := ethereum.CallMsg{From: from, To: tx.To(), Gas: tx.Gas(), Value: tx.Value(),
+		Data: tx.Data(), AccessList: tx.AccessList()}
+	_, errStd = b.CallContract(ctx, msg, receipt.BlockNumber)
+	if errStd == nil {
+		return nil, errstack.NewDomainF("Transaction %s didn't revert when replayed", tx.Hash().Hex())
+	}
+	if re, ok := AsRevertError(errStd, abis...); ok {
+		return re, nil
+	}
+	return nil, errstack.WrapAsIOf(errStd, "Can't replay transaction %s", tx.Hash().Hex())
+}
+
+func mustNewType(t string) abi.Type {
+	typ, err := abi.NewType(t, "", nil)
+	if err != nil {
+		panic(err)
+	}
+	return typ
+}
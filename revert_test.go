@@ -0,0 +1,185 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	. "github.com/robert-zaremba/checkers"
+	"github.com/robert-zaremba/log15"
+	. "gopkg.in/check.v1"
+)
+
+// reverterABI functions have the same selectors as the errors, so the reverter
+// contract reverts with the error
+const reverterABI = `[
+  {"type": "function", "name": "Error", "stateMutability": "view",
+    "inputs": [{"name": "reason", "type": "string"}], "outputs": []},
+  {"type": "function", "name": "InsufficientBalance", "stateMutability": "nonpayable",
+    "inputs": [{"name": "needed", "type": "uint256"}, {"name": "available", "type": "uint256"}], "outputs": []},
+  {"type": "error", "name": "InsufficientBalance",
+    "inputs": [{"name": "needed", "type": "uint256"}, {"name": "available", "type": "uint256"}]}
+]`
+
+// reverterCode is a contract creation code. The contract reverts with the call data.
+var reverterCode = common.FromHex("0x600a80600c6000396000f300" + "36600060003736" + "6000fd")
+
+type RevertSuite struct {
+	ReceiptSuite
+	a abi.ABI
+}
+
+func (s *RevertSuite) SetUpSuite(c *C) {
+	var err error
+	s.a, err = abi.JSON(strings.NewReader(reverterABI))
+	c.Assert(err, IsNil)
+}
+
+func (s *RevertSuite) pack(c *C, selector []byte, args abi.Arguments, vals ...interface{}) []byte {
+	data, err := args.Pack(vals...)
+	c.Assert(err, IsNil)
+	return append(append([]byte{}, selector...), data...)
+}
+
+func (s *RevertSuite) TestDecodeRevert(c *C) {
+	e := DecodeRevert(s.pack(c, errorSelector, errorArgs, "not allowed"))
+	c.Check(e.Name, Equals, "Error")
+	c.Check(e.Error(), Equals, "execution reverted: not allowed")
+	reason, ok := e.Reason()
+	c.Check(ok, IsTrue)
+	c.Check(reason, Equals, "not allowed")
+
+	e = DecodeRevert(s.pack(c, panicSelector, panicArgs, big.NewInt(0x11)))
+	c.Check(e.Name, Equals, "Panic")
+	c.Check(e.Args, DeepEquals, []interface{}{big.NewInt(0x11)})
+	c.Check(e.Error(), Equals, "execution reverted: panic 0x11 (arithmetic underflow or overflow)")
+	_, ok = e.Reason()
+	c.Check(ok, IsFalse)
+
+	abiErr := s.a.Errors["InsufficientBalance"]
+	data := s.pack(c, abiErr.ID[:4], abiErr.Inputs, big.NewInt(10), big.NewInt(3))
+	e = DecodeRevert(data)
+	c.Check(e.Name, Equals, "", Comment("custom errors require ABI"))
+	c.Check(e.Error(), Equals, fmt.Sprintf("execution reverted: unknown error 0x%x", data))
+	e = DecodeRevert(data, s.a)
+	c.Check(e.Name, Equals, "InsufficientBalance")
+	c.Check(e.Args, DeepEquals, []interface{}{big.NewInt(10), big.NewInt(3)})
+	c.Check(e.Error(), Equals, "execution reverted: InsufficientBalance(10, 3)")
+	c.Check(e.Raw, DeepEquals, data)
+
+	c.Check(DecodeRevert(nil).Error(), Equals, "execution reverted")
+	c.Check(DecodeRevert(errorSelector).Name, Equals, "", Comment("malformed data"))
+}
+
+func (s *RevertSuite) TestAsRevertError(c *C) {
+	_, ok := AsRevertError(errors.New("boom"))
+	c.Check(ok, IsFalse)
+	re := &RevertError{Name: "Error"}
+	e, ok := AsRevertError(fmt.Errorf("wrapped: %w", re))
+	c.Check(ok, IsTrue)
+	c.Check(e, Equals, re)
+
+	e, ok = AsRevertError(errors.New("execution reverted"))
+	c.Check(ok, IsTrue)
+	c.Check(e.Error(), Equals, "execution reverted")
+	_, ok = AsRevertError(nil)
+	c.Check(ok, IsFalse)
+
+	reason, ok := PanicReason(0x11)
+	c.Check(ok, IsTrue)
+	c.Check(reason, Equals, "arithmetic underflow or overflow")
+	_, ok = PanicReason(0x99)
+	c.Check(ok, IsFalse)
+}
+
+func (s *RevertSuite) TestRevertWithoutData(c *C) {
+	s.sendTx(c, 0, reverterCode)
+	s.sim.Commit()
+	to := crypto.CreateAddress(s.addr, 0)
+	_, err := s.sim.CallContract(context.Background(), ethereum.CallMsg{From: s.addr, To: &to}, nil)
+	re, ok := AsRevertError(err)
+	c.Assert(ok, IsTrue, Comment(err))
+	c.Check(re.Raw, HasLen, 0)
+	c.Check(re.Error(), Equals, "execution reverted")
+}
+
+func (s *RevertSuite) TestReplayRevert(c *C) {
+	deploy := s.sendTx(c, 0, reverterCode)
+	s.sim.Commit()
+	ctx := context.Background()
+	to := crypto.CreateAddress(s.addr, 0)
+	abiErr := s.a.Errors["InsufficientBalance"]
+	data := s.pack(c, abiErr.ID[:4], abiErr.Inputs, big.NewInt(10), big.NewInt(3))
+	gasPrice, err := s.sim.SuggestGasPrice(ctx)
+	c.Assert(err, IsNil)
+	tx, err := types.SignTx(types.NewTransaction(1, to, big.NewInt(0), 100000, gasPrice, data),
+		types.LatestSignerForChainID(simChainID), s.key)
+	c.Assert(err, IsNil)
+	c.Assert(s.sim.SendTransaction(ctx, tx), IsNil)
+	s.sim.Commit()
+
+	receipt, errW := MinedWaiter{Backend: s.sim}.Wait(ctx, tx.Hash(), 1)
+	c.Assert(errW, NotNil)
+	c.Assert(receipt, NotNil)
+	re, errR := ReplayRevert(ctx, s.sim, tx, receipt, s.a)
+	c.Assert(errR, IsNil)
+	c.Check(re.Name, Equals, "InsufficientBalance")
+	c.Check(re.Args, DeepEquals, []interface{}{big.NewInt(10), big.NewInt(3)})
+
+	receipt, errW = MinedWaiter{Backend: s.sim}.Wait(ctx, deploy.Hash(), 1)
+	c.Assert(errW, IsNil)
+	_, errR = ReplayRevert(ctx, s.sim, deploy, receipt)
+	c.Check(errR, ErrorMatches, "Transaction .* didn't fail")
+}
+
+func (s *RevertSuite) TestDynamicContract(c *C) {
+	s.sendTx(c, 0, reverterCode)
+	s.sim.Commit()
+	dc, err := NewDynamicContract(Schema{Name: "Reverter", ABI: json.RawMessage(reverterABI), Networks: map[int]NetSchema{
+		1337: {Address: crypto.CreateAddress(s.addr, 0).Hex()}}}, 1337, s.sim)
+	c.Assert(err, IsNil)
+
+	_, errCall := dc.Call(context.Background(), "Error", "only owner")
+	re, ok := AsRevertError(errCall)
+	c.Assert(ok, IsTrue, Comment(errCall))
+	c.Check(re.Name, Equals, "Error")
+	c.Check(re.Error(), Equals, "execution reverted: only owner")
+
+	_, errCall = dc.Call(context.Background(), "InsufficientBalance", "10", "3")
+	re, ok = errCall.(*RevertError)
+	c.Assert(ok, IsTrue, Comment(errCall))
+	c.Check(re.Name, Equals, "InsufficientBalance")
+	c.Check(re.Args, DeepEquals, []interface{}{big.NewInt(10), big.NewInt(3)})
+
+	txrF, err := NewPrivKeyTxrFactory(common.Bytes2Hex(crypto.FromECDSA(s.key)), nil)
+	c.Assert(err, IsNil)
+	txrF = NewFeeTxrFactory(txrF, FixedFee{GasPrice: big.NewInt(1e10)}, time.Second, log15.Root())
+	_, errTx := dc.Transact(txrF.Txo(), "InsufficientBalance", "1ether", "0")
+	re, ok = errTx.(*RevertError)
+	c.Assert(ok, IsTrue, Comment(errTx))
+	c.Check(re.Error(), Equals, "execution reverted: InsufficientBalance(1000000000000000000, 0)")
+}
@@ -0,0 +1,250 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/robert-zaremba/errstack"
+	"github.com/robert-zaremba/log15"
+)
+
+// ErrorPolicy defines what the Router does when a handler returns an error.
+type ErrorPolicy int
+
+// Handler error policies
+const (
+	// PolicyStop stops the Router, which returns the handler error.
+	PolicyStop ErrorPolicy = iota
+	// PolicySkip logs the error and continues with the next log.
+	PolicySkip
+	// PolicyRetry calls the handler again, up to RouterOpts.Retries times, and then
+	// stops the Router.
+	PolicyRetry
+)
+
+// RouterOpts configures Router.
+type RouterOpts struct {
+	// Workers is the number of goroutines calling handlers. Logs of a single contract
+	// are always handled by the same worker, in the order they were received. Default 1.
+	Workers int
+	// Retries is the number of retries for handlers with PolicyRetry. Default 3.
+	Retries int
+	// RetryDelay is the delay between retries. Default 1 second.
+	RetryDelay time.Duration
+}
+
+type routeKey struct {
+	addr  common.Address
+	event string
+}
+
+type route struct {
+	policy ErrorPolicy
+	handle func(context.Context, *EventDecoder, types.Log) error
+}
+
+// Router decodes contract logs and dispatches them to handlers registered per
+// contract address and event name.
+// Contracts and handlers must be registered before calling Run.
+type Router struct {
+	opts     RouterOpts
+	logger   log15.Logger
+	decoders map[common.Address]*EventDecoder
+	routes   map[routeKey]route
+}
+
+// NewRouter creates new Router.
+func NewRouter(opts RouterOpts, logger log15.Logger) *Router {
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if opts.Retries <= 0 {
+		opts.Retries = 3
+	}
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = time.Second
+	}
+	return &Router{opts: opts, logger: logger,
+		decoders: map[common.Address]*EventDecoder{},
+		routes:   map[routeKey]route{}}
+}
+
+// AddContract registers contract ABI used to decode logs from the `addr` address.
+func (r *Router) AddContract(addr common.Address, a abi.ABI) {
+	r.decoders[addr] = NewEventDecoder(a)
+}
+
+// On registers handler for `event` logs emitted by `addr` contract. The log is decoded
+// into T, which must be a struct (see EventDecoder) or map[string]interface{}.
+// The contract must be added with AddContract before.
+func On[T any](r *Router, addr common.Address, event string, policy ErrorPolicy,
+	handler func(context.Context, T, types.Log) error) errstack.E {
+	d, ok := r.decoders[addr]
+	if !ok {
+		return errstack.NewReqF("Contract %s is not registered in the router", addr.Hex())
+	}
+	if _, isMap := any(new(T)).(*map[string]interface{}); isMap {
+		if !d.hasEvent(event) {
+			return errstack.NewReqF("Event %q is not defined in the ABI", event)
+		}
+	} else if err := d.Register(event, new(T)); err != nil {
+		return err
+	}
+	r.routes[routeKey{addr, event}] = route{policy, func(ctx context.Context, d *EventDecoder, l types.Log) error {
+		var v T
+		var err error
+		if m, isMap := any(&v).(*map[string]interface{}); isMap {
+			*m, err = d.DecodeMap(l)
+		} else {
+			err = d.DecodeInto(l, &v)
+		}
+		if err != nil {
+			return err
+		}
+		return handler(ctx, v, l)
+	}}
+	return nil
+}
+
+// Query returns topics and addresses of all registered handlers, to be used with
+// SubscribeSimple or Backfill.
+func (r *Router) Query() ([][]common.Hash, []common.Address) {
+	var events []common.Hash
+	var addrs []common.Address
+	seenAddr := map[common.Address]bool{}
+	seenEvent := map[common.Hash]bool{}
+	for k := range r.routes {
+		if !seenAddr[k.addr] {
+			seenAddr[k.addr] = true
+			addrs = append(addrs, k.addr)
+		}
+		for id, e := range r.decoders[k.addr].events {
+			if e.Name == k.event && !seenEvent[id] {
+				seenEvent[id] = true
+				events = append(events, id)
+			}
+		}
+	}
+	return [][]common.Hash{events}, addrs
+}
+
+// Run dispatches `logs` to handlers until the context is done, the logs channel is
+// closed or a handler fails with the stop policy. In the latter case the handler
+// error is returned.
+// Logs without a registered handler are ignored.
+func (r *Router) Run(ctx context.Context, logs <-chan types.Log) errstack.E {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var runErr errstack.E
+	queues := make([]chan types.Log, r.opts.Workers)
+	for i := range queues {
+		queues[i] = make(chan types.Log, 16)
+		wg.Add(1)
+		go func(q <-chan types.Log) {
+			defer wg.Done()
+			for l := range q {
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := r.handle(ctx, l); err != nil {
+					errOnce.Do(func() { runErr = err })
+					cancel()
+				}
+			}
+		}(queues[i])
+	}
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case l, ok := <-logs:
+			if !ok {
+				break loop
+			}
+			q := queues[shard(l.Address, len(queues))]
+			select {
+			case <-ctx.Done():
+				break loop
+			case q <- l:
+			}
+		}
+	}
+	for _, q := range queues {
+		close(q)
+	}
+	wg.Wait()
+	return runErr
+}
+
+// handle calls the log handler according to its error policy. It returns an error
+// only if the router should stop.
+func (r *Router) handle(ctx context.Context, l types.Log) errstack.E {
+	d, ok := r.decoders[l.Address]
+	if !ok {
+		return nil
+	}
+	e, err := d.Event(l)
+	if err != nil {
+		r.logger.Debug("Ignoring unknown event", "contract", l.Address.Hex(), "tx_hash", l.TxHash.Hex())
+		return nil
+	}
+	rt, ok := r.routes[routeKey{l.Address, e.Name}]
+	if !ok {
+		return nil
+	}
+	for attempt := 0; ; attempt++ {
+		err := rt.handle(ctx, d, l)
+		if err == nil {
+			return nil
+		}
+		logCtx := []interface{}{"event", e.Name, "contract", l.Address.Hex(),
+			"tx_hash", l.TxHash.Hex(), "log_index", l.Index, "attempt", attempt, err}
+		switch {
+		case rt.policy == PolicySkip:
+			r.logger.Error("Event handler failed, skipping", logCtx...)
+			return nil
+		case rt.policy == PolicyRetry && attempt < r.opts.Retries:
+			r.logger.Warn("Event handler failed, retrying", logCtx...)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(r.opts.RetryDelay):
+			}
+		default:
+			r.logger.Error("Event handler failed, stopping", logCtx...)
+			return errstack.WrapAsDomain(err, "Handler of "+e.Name+" event failed")
+		}
+	}
+}
+
+// shard assigns a contract address to a worker
+func shard(addr common.Address, n int) int {
+	var h uint
+	for _, b := range addr {
+		h = h*31 + uint(b)
+	}
+	return int(h % uint(n))
+}
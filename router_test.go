@@ -0,0 +1,129 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	. "github.com/robert-zaremba/checkers"
+	"github.com/robert-zaremba/log15"
+	. "gopkg.in/check.v1"
+)
+
+type RouterSuite struct {
+	DecoderSuite
+	token1, token2 common.Address
+}
+
+func (s *RouterSuite) SetUpSuite(c *C) {
+	s.DecoderSuite.SetUpSuite(c)
+	s.token1 = common.HexToAddress("0x01")
+	s.token2 = common.HexToAddress("0x02")
+}
+
+func (s *RouterSuite) newRouter(c *C, workers int) *Router {
+	r := NewRouter(RouterOpts{Workers: workers, Retries: 2, RetryDelay: time.Millisecond}, log15.Root())
+	r.AddContract(s.token1, s.abi)
+	r.AddContract(s.token2, s.abi)
+	return r
+}
+
+func (s *RouterSuite) logs(c *C, n int) chan types.Log {
+	ch := make(chan types.Log, 2*n)
+	for i := 0; i < n; i++ {
+		for _, addr := range []common.Address{s.token1, s.token2} {
+			l := s.transferLog(c, int64(i))
+			l.Address = addr
+			ch <- l
+		}
+	}
+	close(ch)
+	return ch
+}
+
+func (s *RouterSuite) TestDispatchInOrder(c *C) {
+	r := s.newRouter(c, 3)
+	var mu sync.Mutex
+	received := map[common.Address][]int64{}
+	var maps int32
+	h := func(ctx context.Context, e transferEvent, l types.Log) error {
+		mu.Lock()
+		defer mu.Unlock()
+		received[l.Address] = append(received[l.Address], e.Value.Int64())
+		return nil
+	}
+	c.Assert(On(r, s.token1, "Transfer", PolicyStop, h), IsNil)
+	c.Assert(On(r, s.token2, "Transfer", PolicyStop, h), IsNil)
+	c.Assert(On(r, s.token2, "Approval", PolicyStop,
+		func(ctx context.Context, e map[string]interface{}, l types.Log) error {
+			atomic.AddInt32(&maps, 1)
+			return nil
+		}), IsNil)
+	c.Check(On(r, s.token1, "Mint", PolicyStop, h), ErrorMatches, ".*not defined.*")
+	c.Check(On(r, common.HexToAddress("0x03"), "Transfer", PolicyStop, h), ErrorMatches, ".*not registered.*")
+
+	topics, addrs := r.Query()
+	c.Check(topics, HasLen, 1)
+	c.Check(topics[0], HasLen, 2)
+	c.Check(addrs, HasLen, 2)
+
+	c.Assert(r.Run(context.Background(), s.logs(c, 50)), IsNil)
+	for _, addr := range []common.Address{s.token1, s.token2} {
+		c.Assert(received[addr], HasLen, 50)
+		for i, v := range received[addr] {
+			c.Assert(v, Equals, int64(i))
+		}
+	}
+	c.Check(atomic.LoadInt32(&maps), Equals, int32(0))
+}
+
+func (s *RouterSuite) TestPolicies(c *C) {
+	r := s.newRouter(c, 2)
+	var mu sync.Mutex
+	var skipped, retried int
+	c.Assert(On(r, s.token1, "Transfer", PolicySkip,
+		func(ctx context.Context, e transferEvent, l types.Log) error {
+			mu.Lock()
+			defer mu.Unlock()
+			skipped++
+			return errors.New("skip me")
+		}), IsNil)
+	c.Assert(On(r, s.token2, "Transfer", PolicyRetry,
+		func(ctx context.Context, e transferEvent, l types.Log) error {
+			mu.Lock()
+			defer mu.Unlock()
+			retried++
+			if e.Value.Cmp(big.NewInt(2)) == 0 {
+				return errors.New("permanent failure")
+			}
+			if retried%2 == 1 {
+				return errors.New("temporary failure")
+			}
+			return nil
+		}), IsNil)
+	err := r.Run(context.Background(), s.logs(c, 5))
+	c.Check(err, ErrorMatches, "Handler of Transfer event failed.*")
+	c.Check(skipped > 0, IsTrue)
+	// values 0 and 1 need 2 calls each, value 2 fails 3 times
+	c.Check(retried, Equals, 7)
+}
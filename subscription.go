@@ -0,0 +1,322 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/robert-zaremba/errstack"
+	"github.com/robert-zaremba/log15"
+)
+
+// dedupWindow is the number of blocks for which processed logs are remembered
+const dedupWindow = 128
+
+// LogBackend provides methods required to subscribe and backfill logs.
+// It's implemented by *ethclient.Client and the simulated backend.
+type LogBackend interface {
+	ethereum.LogFilterer
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+}
+
+// SubscriptionOpts configures ResilientSubscription.
+type SubscriptionOpts struct {
+	// FromBlock is the first block to stream logs from. If nil, the logs are streamed
+	// from the chain head at the time of the first connection.
+	FromBlock *big.Int
+	// MinBackoff and MaxBackoff limit the exponential delay between reconnections.
+	// Defaults are 1 second and 1 minute.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Buffer is the size of the logs channel. Default is 5.
+	Buffer int
+	// Checkpoints, if set, is used to resume the `Consumer` from the last acknowledged
+	// log. The checkpoint takes precedence over FromBlock. A log is acknowledged when the
+	// consumer receives the next one, or explicitly with ResilientSubscription.Ack.
+	// The logs channel is unbuffered in this mode.
+	Checkpoints CheckpointStore
+	Consumer    string
+}
+
+// logKey identifies a log in a block
+type logKey struct {
+	block common.Hash
+	index uint
+}
+
+// ResilientSubscription is a logs subscription which automatically reconnects when the
+// underlying subscription fails. Logs which were emitted while disconnected are
+// backfilled (see Backfill) and duplicates are dropped.
+type ResilientSubscription struct {
+	backend LogBackend
+	query   ethereum.FilterQuery
+	opts    SubscriptionOpts
+	logger  log15.Logger
+	logs    chan types.Log
+
+	mu        sync.Mutex
+	cursor    *big.Int // next block to backfill from
+	lastBlock uint64   // the highest processed block number
+	lastIndex uint     // index of the last processed log in lastBlock
+	seen      map[logKey]uint64
+	resumed   *Checkpoint // logs covered by the checkpoint are skipped
+	acker     *logAcker
+}
+
+// NewResilientSubscription creates logs subscription for the given topics and addresses
+// (see SubscribeSimple) and starts streaming. The logs channel is closed when the
+// context is done.
+func NewResilientSubscription(ctx context.Context, backend LogBackend,
+	topics [][]common.Hash, addresses []common.Address, opts SubscriptionOpts, logger log15.Logger) *ResilientSubscription {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = time.Second
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = time.Minute
+	}
+	if opts.Buffer <= 0 {
+		opts.Buffer = 5
+	}
+	s := &ResilientSubscription{
+		backend: backend,
+		query:   ethereum.FilterQuery{Topics: topics, Addresses: addresses},
+		opts:    opts,
+		logger:  logger,
+		logs:    make(chan types.Log, opts.Buffer),
+		seen:    map[logKey]uint64{},
+		acker:   newLogAcker(opts.Checkpoints, opts.Consumer),
+	}
+	if s.acker != nil {
+		s.logs = make(chan types.Log)
+	}
+	if opts.FromBlock != nil {
+		s.cursor = new(big.Int).Set(opts.FromBlock)
+	}
+	go s.loop(ctx)
+	return s
+}
+
+// Logs returns the logs channel.
+func (s *ResilientSubscription) Logs() <-chan types.Log {
+	return s.logs
+}
+
+// Last returns the block number and log index of the last processed log.
+func (s *ResilientSubscription) Last() (uint64, uint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastBlock, s.lastIndex
+}
+
+// Ack stores the checkpoint of a processed log, if the Checkpoints store is configured.
+// Logs are acknowledged automatically when the next log is received, so it's needed
+// only for the last log, eg before the consumer stops.
+func (s *ResilientSubscription) Ack(ctx context.Context, l types.Log) errstack.E {
+	if s.acker == nil {
+		return nil
+	}
+	return s.acker.ack(ctx, l)
+}
+
+// resume loads the consumer checkpoint
+func (s *ResilientSubscription) resume(ctx context.Context) errstack.E {
+	cp, err := s.acker.load(ctx)
+	if err != nil || cp == nil {
+		return err
+	}
+	s.logger.Info("Resuming logs subscription", "consumer", s.opts.Consumer,
+		"block", cp.Block, "log_index", cp.LogIndex)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resumed = cp
+	s.cursor = new(big.Int).SetUint64(cp.Block)
+	s.lastBlock, s.lastIndex = cp.Block, cp.LogIndex
+	return nil
+}
+
+func (s *ResilientSubscription) loop(ctx context.Context) {
+	defer close(s.logs)
+	backoff := s.opts.MinBackoff
+	for s.opts.Checkpoints != nil {
+		err := s.resume(ctx)
+		if err == nil {
+			break
+		}
+		s.logger.Error("Can't load checkpoint", "consumer", s.opts.Consumer, "backoff", backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+	}
+	for {
+		err := s.run(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.logger.Warn("Logs subscription failed, reconnecting", "backoff", backoff, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if err == nil { // the subscription was working, so we reset the backoff
+			backoff = s.opts.MinBackoff
+		} else if backoff *= 2; backoff > s.opts.MaxBackoff {
+			backoff = s.opts.MaxBackoff
+		}
+	}
+}
+
+// run subscribes, backfills the gap and streams logs until the subscription fails.
+// It returns nil error if the subscription failed after it was successfully established.
+// The gap is backfilled in chunks up to the current head, while new logs are buffered.
+func (s *ResilientSubscription) run(ctx context.Context) errstack.E {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch := make(chan types.Log, s.opts.Buffer)
+	sub, err := s.backend.SubscribeFilterLogs(ctx, s.query, ch)
+	if err != nil {
+		return errstack.WrapAsIO(err, "Can't create Ethereum Subscription")
+	}
+	defer sub.Unsubscribe()
+	live := BufferLogs(ctx, ch)
+
+	h, err := s.backend.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return errstack.WrapAsIO(err, "Can't get the latest block header")
+	}
+	s.mu.Lock()
+	if s.cursor == nil {
+		s.cursor = h.Number
+	}
+	cursor := s.cursor.Uint64()
+	s.mu.Unlock()
+	if head := h.Number.Uint64(); cursor <= head {
+		it := Backfill(ctx, s.backend, s.query.Topics, s.query.Addresses, cursor, head, BackfillOpts{})
+		defer it.Close()
+		for it.Next() {
+			if !s.emit(ctx, it.Log()) {
+				return nil
+			}
+		}
+		if err := it.Err(); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-sub.Err():
+			s.logger.Warn("Logs subscription dropped", "error", err)
+			return nil
+		case l, ok := <-live:
+			if !ok || !s.emit(ctx, l) {
+				return nil
+			}
+		}
+	}
+}
+
+// BufferLogs forwards logs from `in` to the returned channel. Logs are buffered without
+// a limit, so the subscription writing to `in` is not blocked by a slow reader, eg while
+// past logs are backfilled. The returned channel is closed when `in` is closed (and the
+// buffer is drained) or when the context is done.
+func BufferLogs(ctx context.Context, in <-chan types.Log) <-chan types.Log {
+	out := make(chan types.Log)
+	go func() {
+		defer close(out)
+		var queue []types.Log
+		for in != nil || len(queue) != 0 {
+			var send chan<- types.Log
+			var next types.Log
+			if len(queue) != 0 {
+				send, next = out, queue[0]
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case l, ok := <-in:
+				if !ok {
+					in = nil
+					continue
+				}
+				queue = append(queue, l)
+			case send <- next:
+				queue = queue[1:]
+			}
+		}
+	}()
+	return out
+}
+
+// emit sends the log to the consumer unless it was already sent.
+// It returns false if the context is done.
+func (s *ResilientSubscription) emit(ctx context.Context, l types.Log) bool {
+	k := logKey{l.BlockHash, l.Index}
+	s.mu.Lock()
+	if s.resumed != nil && !l.Removed && s.resumed.Covers(l) {
+		s.mu.Unlock()
+		return true
+	}
+	_, seen := s.seen[k]
+	if l.Removed {
+		delete(s.seen, k)
+	} else if !seen {
+		s.seen[k] = l.BlockNumber
+		if l.BlockNumber > s.lastBlock || (l.BlockNumber == s.lastBlock && l.Index > s.lastIndex) {
+			s.lastBlock, s.lastIndex = l.BlockNumber, l.Index
+			s.cursor = new(big.Int).SetUint64(l.BlockNumber)
+		}
+		s.prune()
+	}
+	s.mu.Unlock()
+	if seen && !l.Removed {
+		return true
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case s.logs <- l:
+	}
+	if s.acker != nil {
+		if err := s.acker.delivered(ctx, l); err != nil {
+			s.logger.Error("Can't save checkpoint", "consumer", s.opts.Consumer, err)
+		}
+	}
+	return true
+}
+
+// prune removes old entries from the seen set. Must be called with the lock held.
+func (s *ResilientSubscription) prune() {
+	if len(s.seen) < 4*dedupWindow || s.lastBlock < dedupWindow {
+		return
+	}
+	for k, n := range s.seen {
+		if n < s.lastBlock-dedupWindow {
+			delete(s.seen, k)
+		}
+	}
+}
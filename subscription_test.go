@@ -0,0 +1,170 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/core/types"
+	. "github.com/robert-zaremba/checkers"
+	"github.com/robert-zaremba/log15"
+	. "gopkg.in/check.v1"
+)
+
+// logEmitterCode is a contract creation code which emits an empty LOG0
+var logEmitterCode = []byte{0x60, 0x00, 0x60, 0x00, 0xa0, 0x00}
+
+// flakyLogBackend allows to break the logs subscriptions
+type flakyLogBackend struct {
+	*backends.SimulatedBackend
+	mu      sync.Mutex
+	subs    []*flakySub
+	queries []ethereum.FilterQuery
+}
+
+type flakySub struct {
+	ethereum.Subscription
+	errc chan error
+}
+
+func (s *flakySub) Err() <-chan error {
+	return s.errc
+}
+
+func (b *flakyLogBackend) SubscribeFilterLogs(ctx context.Context, q ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	sub, err := b.SimulatedBackend.SubscribeFilterLogs(ctx, q, ch)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := &flakySub{sub, make(chan error, 1)}
+	b.subs = append(b.subs, s)
+	return s, nil
+}
+
+func (b *flakyLogBackend) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	b.mu.Lock()
+	b.queries = append(b.queries, q)
+	b.mu.Unlock()
+	return b.SimulatedBackend.FilterLogs(ctx, q)
+}
+
+func (b *flakyLogBackend) breakSubscription() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[len(b.subs)-1].errc <- errors.New("connection lost")
+}
+
+func (b *flakyLogBackend) numSubscriptions() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+type SubscriptionSuite struct {
+	ReceiptSuite
+}
+
+func (s *SubscriptionSuite) receive(c *C, logs <-chan types.Log) types.Log {
+	select {
+	case l, ok := <-logs:
+		c.Assert(ok, IsTrue, Commentf("logs channel closed"))
+		return l
+	case <-time.After(5 * time.Second):
+		c.Fatal("log not received")
+	}
+	return types.Log{}
+}
+
+func (s *SubscriptionSuite) waitSubscriptions(c *C, b *flakyLogBackend, n int) {
+	for i := 0; i < 500 && b.numSubscriptions() < n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(b.numSubscriptions(), Equals, n)
+}
+
+func (s *SubscriptionSuite) TestReconnectAndBackfill(c *C) {
+	b := &flakyLogBackend{SimulatedBackend: s.sim}
+	ctx, cancel := context.WithCancel(context.Background())
+	rs := NewResilientSubscription(ctx, b, nil, nil,
+		SubscriptionOpts{MinBackoff: 50 * time.Millisecond}, log15.Root())
+	s.waitSubscriptions(c, b, 1)
+
+	tx1 := s.sendTx(c, 0, logEmitterCode)
+	s.sim.Commit()
+	l := s.receive(c, rs.Logs())
+	c.Check(l.TxHash, Equals, tx1.Hash())
+
+	b.breakSubscription()
+	tx2 := s.sendTx(c, 1, logEmitterCode)
+	s.sim.Commit()
+	l = s.receive(c, rs.Logs())
+	c.Check(l.TxHash, Equals, tx2.Hash())
+	s.waitSubscriptions(c, b, 2)
+
+	tx3 := s.sendTx(c, 2, logEmitterCode)
+	s.sim.Commit()
+	l = s.receive(c, rs.Logs())
+	c.Check(l.TxHash, Equals, tx3.Hash(), Commentf("logs must not be duplicated"))
+	block, index := rs.Last()
+	c.Check(block, Equals, uint64(3))
+	c.Check(index, Equals, uint(0))
+	b.mu.Lock()
+	c.Check(len(b.queries) >= 2, IsTrue)
+	for _, q := range b.queries {
+		c.Check(q.ToBlock, NotNil, Comment("backfill range must be bounded"))
+	}
+	b.mu.Unlock()
+
+	cancel()
+	for range rs.Logs() {
+		c.Error("unexpected log")
+	}
+}
+
+func (s *SubscriptionSuite) TestBufferLogs(c *C) {
+	in := make(chan types.Log)
+	out := BufferLogs(context.Background(), in)
+	for i := uint(0); i < 100; i++ {
+		in <- types.Log{Index: i} // must not block while nobody reads
+	}
+	close(in)
+	var n uint
+	for l := range out {
+		c.Check(l.Index, Equals, n)
+		n++
+	}
+	c.Check(n, Equals, uint(100))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	in = make(chan types.Log)
+	out = BufferLogs(ctx, in)
+	in <- types.Log{}
+	cancel()
+	select {
+	case <-time.After(5 * time.Second):
+		c.Fatal("channel not closed")
+	case <-out:
+		for range out {
+		}
+	}
+}
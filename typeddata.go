@@ -0,0 +1,141 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"github.com/robert-zaremba/errstack"
+)
+
+// TypedData is the EIP-712 structured data: type definitions, domain, primary type and
+// the message.
+type TypedData = apitypes.TypedData
+
+// ParseTypedData parses EIP-712 typed data in the `eth_signTypedData_v4` JSON format.
+// The domain chainId can be a number or a string.
+func ParseTypedData(data []byte) (TypedData, errstack.E) {
+	var td TypedData
+	data, err := quoteChainID(data)
+	if err == nil {
+		err = json.Unmarshal(data, &td)
+	}
+	if err != nil {
+		return td, errstack.WrapAsReq(err, "Can't parse typed data")
+	}
+	return td, nil
+}
+
+// quoteChainID converts the numeric domain chainId into a string, as required by
+// apitypes.TypedDataDomain
+func quoteChainID(data []byte) ([]byte, error) {
+	var td map[string]json.RawMessage
+	var domain map[string]json.RawMessage
+	if err := json.Unmarshal(data, &td); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(td["domain"], &domain); err != nil || domain == nil {
+		return data, nil
+	}
+	id, ok := domain["chainId"]
+	if !ok || len(id) == 0 || id[0] == '"' {
+		return data, nil
+	}
+	domain["chainId"] = append(append([]byte{'"'}, id...), '"')
+	var err error
+	if td["domain"], err = json.Marshal(domain); err != nil {
+		return nil, err
+	}
+	return json.Marshal(td)
+}
+
+// DomainSeparator computes the EIP-712 domain separator.
+func DomainSeparator(td TypedData) (common.Hash, errstack.E) {
+	h, err := td.HashStruct("EIP712Domain", td.Domain.Map())
+	if err != nil {
+		return common.Hash{}, errstack.WrapAsReq(err, "Can't hash typed data domain")
+	}
+	return common.BytesToHash(h), nil
+}
+
+// HashStruct computes the EIP-712 hash of the typed data message.
+func HashStruct(td TypedData) (common.Hash, errstack.E) {
+	h, err := td.HashStruct(td.PrimaryType, td.Message)
+	if err != nil {
+		return common.Hash{}, errstack.WrapAsReq(err, "Can't hash typed data message")
+	}
+	return common.BytesToHash(h), nil
+}
+
+// TypedDataHash computes the EIP-712 digest which is signed:
+// keccak256("\x19\x01" ‖ domainSeparator ‖ hashStruct(message))
+func TypedDataHash(td TypedData) (common.Hash, errstack.E) {
+	h, _, err := apitypes.TypedDataAndHash(td)
+	if err != nil {
+		return common.Hash{}, errstack.WrapAsReq(err, "Can't hash typed data")
+	}
+	return common.BytesToHash(h), nil
+}
+
+// TypedDataSigner is implemented by TxrFactories which can create EIP-712 signatures
+// (as `eth_signTypedData_v4`).
+type TypedDataSigner interface {
+	SignTypedData(td TypedData) ([]byte, errstack.E)
+}
+
+// SignTypedData creates EIP-712 signature of the typed data using the TxrFactory account.
+// TxrFactory wrappers from this package are unwrapped to find a TypedDataSigner.
+func SignTypedData(txrF TxrFactory, td TypedData) ([]byte, errstack.E) {
+	for f := txrF; f != nil; {
+		if s, ok := f.(TypedDataSigner); ok {
+			return s.SignTypedData(td)
+		}
+		w, ok := f.(txrFactoryWrapper)
+		if !ok {
+			break
+		}
+		f = w.unwrapTxrFactory()
+	}
+	return nil, errstack.NewReqF("%T can't sign typed data", txrF)
+}
+
+// signTypedData creates EIP-712 signature with v in {27, 28}
+func signTypedData(key *ecdsa.PrivateKey, td TypedData) ([]byte, errstack.E) {
+	h, err := TypedDataHash(td)
+	if err != nil {
+		return nil, err
+	}
+	return signHash(key, h[:])
+}
+
+// RecoverTypedDataSigner returns the address which created the EIP-712 signature.
+// Both 27/28 and 0/1 recovery id (v) values are accepted.
+func RecoverTypedDataSigner(td TypedData, sig []byte) (common.Address, error) {
+	h, err := TypedDataHash(td)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return recoverHash(h[:], sig)
+}
+
+// VerifyTypedData checks if the EIP-712 signature was created by `addr`.
+func VerifyTypedData(addr common.Address, td TypedData, sig []byte) bool {
+	signer, err := RecoverTypedDataSigner(td, sig)
+	return err == nil && signer == addr
+}
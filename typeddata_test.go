@@ -0,0 +1,100 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	. "github.com/robert-zaremba/checkers"
+	. "gopkg.in/check.v1"
+)
+
+// mailTypedData is the example from the EIP-712 specification
+const mailTypedData = `{
+  "types": {
+    "EIP712Domain": [
+      {"name": "name", "type": "string"},
+      {"name": "version", "type": "string"},
+      {"name": "chainId", "type": "uint256"},
+      {"name": "verifyingContract", "type": "address"}
+    ],
+    "Person": [
+      {"name": "name", "type": "string"},
+      {"name": "wallet", "type": "address"}
+    ],
+    "Mail": [
+      {"name": "from", "type": "Person"},
+      {"name": "to", "type": "Person"},
+      {"name": "contents", "type": "string"}
+    ]
+  },
+  "primaryType": "Mail",
+  "domain": {
+    "name": "Ether Mail",
+    "version": "1",
+    "chainId": 1,
+    "verifyingContract": "0xCcCCccccCCCCcCCCCCCcCcCccCcCCCcCcccccccC"
+  },
+  "message": {
+    "from": {"name": "Cow", "wallet": "0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826"},
+    "to": {"name": "Bob", "wallet": "0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB"},
+    "contents": "Hello, Bob!"
+  }
+}`
+
+type TypedDataSuite struct{}
+
+func (s TypedDataSuite) TestEIPVector(c *C) {
+	td, err := ParseTypedData([]byte(mailTypedData))
+	c.Assert(err, IsNil)
+	h, err := DomainSeparator(td)
+	c.Assert(err, IsNil)
+	c.Check(h.Hex(), Equals, "0xf2cee375fa42b42143804025fc449deafd50cc031ca257e0b194a650a912090f")
+	h, err = HashStruct(td)
+	c.Assert(err, IsNil)
+	c.Check(h.Hex(), Equals, "0xc52c0ee5d84264471806290a3f2c4cecfc5490626bf912d01f240d7a274b371e")
+	h, err = TypedDataHash(td)
+	c.Assert(err, IsNil)
+	c.Check(h.Hex(), Equals, "0xbe609aee343fb3c4b28e1df9e632fca64fcfaede20f02e86244efddf30957bd2")
+
+	txrF, err := NewPrivKeyTxrFactory(crypto.Keccak256Hash([]byte("cow")).Hex()[2:], nil)
+	c.Assert(err, IsNil)
+	c.Check(txrF.Addr().Hex(), Equals, "0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826")
+	sig, err := SignTypedData(txrF, td)
+	c.Assert(err, IsNil)
+	c.Check(hexutil.Encode(sig), Equals, "0x4355c47d63924e8a72e509b65029052eb6c299d53a04e167c5775fd466751c9d"+
+		"07299936d304c153f6443dfa05f40ff007d72911b6f72307f996231605b91562"+"1c")
+
+	addr, errStd := RecoverTypedDataSigner(td, sig)
+	c.Assert(errStd, IsNil)
+	c.Check(addr, Equals, txrF.Addr())
+	c.Check(VerifyTypedData(txrF.Addr(), td, sig), IsTrue)
+	td.Message["contents"] = "Hello, Alice!"
+	c.Check(VerifyTypedData(txrF.Addr(), td, sig), IsFalse)
+	c.Check(VerifySignature(common.HexToAddress("0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826"),
+		[]byte(mailTypedData), sig), IsFalse, Comment("typed data signature isn't a personal signature"))
+}
+
+func (s TypedDataSuite) TestInvalid(c *C) {
+	_, err := ParseTypedData([]byte("{"))
+	c.Check(err, ErrorMatches, "Can't parse typed data.*")
+	td, err := ParseTypedData([]byte(mailTypedData))
+	c.Assert(err, IsNil)
+	td.PrimaryType = "Letter"
+	_, err = TypedDataHash(td)
+	c.Check(err, NotNil)
+}
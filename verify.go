@@ -0,0 +1,227 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/robert-zaremba/errstack"
+)
+
+// CodeReader provides the deployed contract code (`eth_getCode`).
+// It's implemented by *ethclient.Client and the simulated backend.
+type CodeReader interface {
+	CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) ([]byte, error)
+}
+
+// BytecodeMismatchError is returned by VerifyDeployment when the deployed code doesn't
+// match the schema deployedBytecode. It implements errstack.E.
+type BytecodeMismatchError struct {
+	errstack.E
+	Contract    string
+	Network     int
+	Address     common.Address
+	Reason      string
+	ExpectedLen int // code length without metadata
+	ActualLen   int
+	Diffs       []CodeRange // differing ranges, only when the lengths are equal
+}
+
+func (e *BytecodeMismatchError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "contract %q at %s on network=%d doesn't match the schema: %s",
+		e.Contract, e.Address.Hex(), e.Network, e.Reason)
+	for i, d := range e.Diffs {
+		if i == 5 {
+			fmt.Fprintf(&sb, " ... (%d more)", len(e.Diffs)-i)
+			break
+		}
+		fmt.Fprintf(&sb, " [%d:%d]", d.Start, d.Start+d.Length)
+	}
+	return sb.String()
+}
+
+// VerifyDeployment checks that the code deployed at the schema address for the network
+// matches the schema deployedBytecode. Solidity metadata is ignored. Library placeholders
+// are replaced by the network links; placeholders of unknown libraries and immutable
+// variables are not compared. Immutables are located using the schema `Immutables`
+// or, if not available, by looking for PUSH32 instructions with zero argument.
+// Returns *BytecodeMismatchError if the code doesn't match.
+func VerifyDeployment(ctx context.Context, client CodeReader, s Schema, networkID int) errstack.E {
+	addr, err := s.Address(networkID)
+	if err != nil {
+		return err
+	}
+	if s.DeployedBytecode == "" {
+		return errstack.NewReqF("Contract %q schema doesn't have deployedBytecode", s.Name)
+	}
+	expected, mask, _, err := decodeLinkedCode(s.DeployedBytecode, s.Networks[networkID].Links)
+	if err != nil {
+		return err
+	}
+	actual, errStd := client.CodeAt(ctx, addr, nil)
+	if errStd != nil {
+		return errstack.WrapAsIOf(errStd, "Can't get %q contract code", s.Name)
+	}
+	merr := &BytecodeMismatchError{Contract: s.Name, Network: networkID, Address: addr}
+	mismatch := func(reason string) errstack.E {
+		merr.Reason = reason
+		merr.E = errstack.NewDomain(merr.Error())
+		return merr
+	}
+	if len(actual) == 0 {
+		return mismatch("no code at the address")
+	}
+	expected = stripMetadata(expected)
+	mask = mask[:len(expected)]
+	actual = stripMetadata(actual)
+	merr.ExpectedLen, merr.ActualLen = len(expected), len(actual)
+	if len(expected) != len(actual) {
+		return mismatch(fmt.Sprintf("code length %d, expected %d", len(actual), len(expected)))
+	}
+	if len(s.Immutables) > 0 {
+		for _, r := range s.Immutables {
+			for i := r.Start; i < r.Start+r.Length && i < len(mask); i++ {
+				mask[i] = true
+			}
+		}
+	} else {
+		maskZeroPush32(expected, mask)
+	}
+	for i := 0; i < len(expected); i++ {
+		if mask[i] || expected[i] == actual[i] {
+			continue
+		}
+		if n := len(merr.Diffs); n > 0 && merr.Diffs[n-1].Start+merr.Diffs[n-1].Length == i {
+			merr.Diffs[n-1].Length++
+		} else {
+			merr.Diffs = append(merr.Diffs, CodeRange{i, 1})
+		}
+	}
+	if len(merr.Diffs) > 0 {
+		return mismatch(fmt.Sprintf("%d differing byte ranges", len(merr.Diffs)))
+	}
+	return nil
+}
+
+// decodeLinkedCode decodes hex code with library placeholders. Placeholders are
+// replaced with the linked addresses. Returned mask marks bytes of unknown libraries,
+// which placeholders are listed in `unlinked`.
+// Both "__$<keccak256(name)[:17]>$__" (solc >= 0.5) and "__<name>___" formats are
+// supported.
+func decodeLinkedCode(code string, links map[string]string) (out []byte, mask []bool, unlinked []string, err errstack.E) {
+	code = strings.TrimPrefix(code, "0x")
+	for len(code) > 0 {
+		i := strings.Index(code, "__")
+		if i < 0 {
+			i = len(code)
+		}
+		b, errStd := hex.DecodeString(code[:i])
+		if errStd != nil {
+			return nil, nil, nil, errstack.WrapAsDomain(errStd, "Invalid bytecode")
+		}
+		out = append(out, b...)
+		mask = append(mask, make([]bool, len(b))...)
+		code = code[i:]
+		if len(code) == 0 {
+			break
+		}
+		if len(code) < 2*common.AddressLength {
+			return nil, nil, nil, errstack.NewDomain("Invalid library placeholder in bytecode")
+		}
+		placeholder := code[:2*common.AddressLength]
+		code = code[2*common.AddressLength:]
+		if lib, ok := findLink(placeholder, links); ok {
+			out = append(out, lib.Bytes()...)
+			mask = append(mask, make([]bool, common.AddressLength)...)
+			continue
+		}
+		unlinked = append(unlinked, placeholder)
+		out = append(out, make([]byte, common.AddressLength)...)
+		for j := 0; j < common.AddressLength; j++ {
+			mask = append(mask, true)
+		}
+	}
+	return out, mask, unlinked, nil
+}
+
+// findLink returns the linked library address matching the placeholder
+func findLink(placeholder string, links map[string]string) (common.Address, bool) {
+	for name, addr := range links {
+		var p string
+		if strings.HasPrefix(placeholder, "__$") {
+			p = "__$" + hex.EncodeToString(crypto.Keccak256([]byte(name)))[:34] + "$__"
+		} else {
+			if len(name) > 36 {
+				name = name[:36]
+			}
+			p = "__" + name + strings.Repeat("_", 38-len(name))
+		}
+		if p == placeholder && common.IsHexAddress(addr) {
+			return common.HexToAddress(addr), true
+		}
+	}
+	return common.Address{}, false
+}
+
+// stripMetadata removes the CBOR encoded Solidity metadata from the end of the code.
+// The last 2 bytes of the code are the metadata length.
+func stripMetadata(code []byte) []byte {
+	if len(code) < 2 {
+		return code
+	}
+	n := int(code[len(code)-2])<<8 | int(code[len(code)-1])
+	start := len(code) - 2 - n
+	// metadata is a CBOR map with at most 16 entries
+	if n == 0 || start < 0 || code[start]&0xf0 != 0xa0 {
+		return code
+	}
+	return code[:start]
+}
+
+// maskZeroPush32 marks arguments of PUSH32 instructions which are all zero. Solidity
+// uses them as placeholders for immutable variables.
+func maskZeroPush32(code []byte, mask []bool) {
+	const push1, push32 = 0x60, 0x7f
+	for i := 0; i < len(code); i++ {
+		op := code[i]
+		if op < push1 || op > push32 {
+			continue
+		}
+		n := int(op-push1) + 1
+		if op == push32 && i+1+n <= len(code) && isZero(code[i+1:i+1+n]) {
+			for j := i + 1; j < i+1+n; j++ {
+				mask[j] = true
+			}
+		}
+		i += n
+	}
+}
+
+func isZero(b []byte) bool {
+	for _, x := range b {
+		if x != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2017 Robert Zaremba
+// Copyright (c) 2017 Sweetbridge Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethdrv
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	. "github.com/robert-zaremba/checkers"
+	. "gopkg.in/check.v1"
+)
+
+type VerifySuite struct {
+	ReceiptSuite
+	lib     common.Address
+	runtime []byte
+}
+
+// deploy deploys the code: PUSH32 1 (immutable), PUSH20 lib, STOP, metadata
+func (s *VerifySuite) deploy(c *C) common.Address {
+	s.lib = common.HexToAddress("0x1111111111111111111111111111111111111111")
+	s.runtime = append([]byte{0x7f}, common.LeftPadBytes([]byte{1}, 32)...)
+	s.runtime = append(append(s.runtime, 0x73), s.lib.Bytes()...)
+	s.runtime = append(s.runtime, 0x00, 0xa1, 0x01, 0x02, 0x00, 0x03)
+	n := byte(len(s.runtime))
+	code := append([]byte{0x60, n, 0x80, 0x60, 12, 0x60, 0, 0x39, 0x60, 0, 0xf3, 0x00}, s.runtime...)
+	s.sendTx(c, 0, code)
+	s.sim.Commit()
+	return crypto.CreateAddress(s.addr, 0)
+}
+
+func (s *VerifySuite) schema(addr common.Address, placeholder string, links map[string]string) Schema {
+	code := "0x7f" + strings.Repeat("00", 32) + "73" + placeholder + "00" + "a2010203" + "0004"
+	return Schema{Name: "LibUser", DeployedBytecode: code,
+		Networks: map[int]NetSchema{1337: {Address: addr.Hex(), Links: links}}}
+}
+
+func (s *VerifySuite) TestVerify(c *C) {
+	addr := s.deploy(c)
+	ctx := context.Background()
+	libName := "contracts/Lib.sol:Lib"
+	placeholder := "__$" + hex.EncodeToString(crypto.Keccak256([]byte(libName)))[:34] + "$__"
+
+	sch := s.schema(addr, placeholder, map[string]string{libName: s.lib.Hex()})
+	c.Check(VerifyDeployment(ctx, s.sim, sch, 1337), IsNil)
+	c.Check(VerifyDeployment(ctx, s.sim, s.schema(addr, "__Lib___________________________________", nil), 1337),
+		IsNil, Commentf("unknown libraries are not compared"))
+
+	sch = s.schema(addr, placeholder, map[string]string{libName: "0x2222222222222222222222222222222222222222"})
+	err := VerifyDeployment(ctx, s.sim, sch, 1337)
+	c.Assert(err, FitsTypeOf, &BytecodeMismatchError{})
+	var me *BytecodeMismatchError
+	c.Assert(errors.As(err, &me), IsTrue)
+	c.Check(me.Diffs, DeepEquals, []CodeRange{{34, 20}})
+	c.Check(err, ErrorMatches, `contract "LibUser" at .* doesn't match the schema: 1 differing byte ranges \[34:54\]`)
+
+	sch.Immutables = []CodeRange{{0, 1}}
+	sch.Networks[1337].Links[libName] = s.lib.Hex()
+	err = VerifyDeployment(ctx, s.sim, sch, 1337)
+	c.Check(err, ErrorMatches, `.*1 differing byte ranges \[32:33\]`, Commentf("immutables are provided"))
+
+	sch = s.schema(addr, placeholder+"00", nil)
+	err = VerifyDeployment(ctx, s.sim, sch, 1337)
+	c.Check(err, ErrorMatches, `.*code length 55, expected 56`)
+
+	sch = s.schema(common.HexToAddress("0x01"), placeholder, nil)
+	err = VerifyDeployment(ctx, s.sim, sch, 1337)
+	c.Check(err, ErrorMatches, `.*no code at the address`)
+	c.Check(VerifyDeployment(ctx, s.sim, sch, 1), ErrorMatches, ".*not deployed on network=1")
+}